@@ -3,8 +3,11 @@ package config
 import (
 	"context"
 	"fmt"
+	"io"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/golang/glog"
@@ -16,15 +19,39 @@ import (
 // RegisterMode is a name of register mode
 type RegisterMode string
 
-// "RegisterSingleMode", "RegisterNodeMode" and "RegisterPodMode"
+// "RegisterSingleMode", "RegisterNodeMode", "RegisterPodMode" and "RegisterCatalogMode"
 // defines correct value of `register_mode` option.
 // "RegisterSingleMode" determine correct value for `single` mode.
 // "RegisterNodeMode" determine correct value for `node` mode.
 // "RegisterNodeMode" determine correct value for `pod` mode.
+// "RegisterCatalogMode" determine correct value for `catalog` mode.
 const (
-	RegisterSingleMode RegisterMode = "single"
-	RegisterNodeMode   RegisterMode = "node"
-	RegisterPodMode    RegisterMode = "pod"
+	RegisterSingleMode  RegisterMode = "single"
+	RegisterNodeMode    RegisterMode = "node"
+	RegisterPodMode     RegisterMode = "pod"
+	RegisterCatalogMode RegisterMode = "catalog"
+)
+
+// NotReadyPolicy is a name of the policy which is applied to services of not ready container
+type NotReadyPolicy string
+
+// "NotReadyDeregister", "NotReadyCritical" and "NotReadyMaintenance" defines correct values of `not_ready_policy` option.
+// "NotReadyDeregister" deregisters services of the container.
+// "NotReadyCritical" sets the TTL check of services to `critical`.
+// "NotReadyMaintenance" puts services into maintenance mode.
+const (
+	NotReadyDeregister  NotReadyPolicy = "deregister"
+	NotReadyCritical    NotReadyPolicy = "critical"
+	NotReadyMaintenance NotReadyPolicy = "maintenance"
+)
+
+// "RegisterSourcePod", "RegisterSourceService", "RegisterSourceEndpoint" and
+// "RegisterSourceEndpointSlice" defines correct values of `register_source` option.
+const (
+	RegisterSourcePod           string = "pod"
+	RegisterSourceService       string = "service"
+	RegisterSourceEndpoint      string = "endpoint"
+	RegisterSourceEndpointSlice string = "endpointslice"
 )
 
 // Config describes the attributes that are uses to create configuration structure
@@ -48,8 +75,23 @@ type ControllerConfig struct {
 	ConsulNodeSelector       string
 	PodLabelSelector         string
 	K8sTag                   string
+	ClusterID                string
+	AdoptLegacy              bool
 	RegisterMode             RegisterMode
-	RegisterSource           string
+	RegisterSources          []string
+	NotReadyPolicy           NotReadyPolicy
+	DrainDelay               time.Duration
+	CleanupFinalizer         bool
+	CleanupFinalizerTimeout  time.Duration
+	RetryInitialInterval     time.Duration
+	RetryMaxInterval         time.Duration
+	RetryMaxAttempts         int
+	RetryConfigMap           string
+	Workers                  int
+	SyncInterval             time.Duration
+	ServiceIDTemplate        *template.Template
+	ServiceNameTemplate      *template.Template
+	LabelRules               []LabelRule
 }
 
 var config = &Config{}
@@ -152,6 +194,20 @@ func (c *Config) fillConfig(data map[string]string) (*Config, error) {
 		c.Controller.K8sTag = "kubernetes"
 	}
 
+	if value, ok := data["cluster_id"]; ok {
+		c.Controller.ClusterID = value
+	}
+
+	if value, ok := data["adopt_legacy"]; ok && value != "" {
+		adopt, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.AdoptLegacy = adopt
+	} else {
+		c.Controller.AdoptLegacy = true
+	}
+
 	if value, ok := data["register_mode"]; ok {
 		switch value {
 		case string(RegisterSingleMode):
@@ -160,9 +216,11 @@ func (c *Config) fillConfig(data map[string]string) (*Config, error) {
 			c.Controller.RegisterMode = RegisterNodeMode
 		case string(RegisterPodMode):
 			c.Controller.RegisterMode = RegisterPodMode
+		case string(RegisterCatalogMode):
+			c.Controller.RegisterMode = RegisterCatalogMode
 		default:
-			glog.Warningf("Wrong value of 'register_mode' option. Permitted values: %s|%s|%s, is %s",
-				RegisterSingleMode, RegisterNodeMode, RegisterPodMode, value)
+			glog.Warningf("Wrong value of 'register_mode' option. Permitted values: %s|%s|%s|%s, is %s",
+				RegisterSingleMode, RegisterNodeMode, RegisterPodMode, RegisterCatalogMode, value)
 
 			c.Controller.RegisterMode = RegisterSingleMode
 		}
@@ -170,11 +228,291 @@ func (c *Config) fillConfig(data map[string]string) (*Config, error) {
 		c.Controller.RegisterMode = RegisterSingleMode
 	}
 
-	if value, ok := data["register_source"]; ok && value != "" {
-		c.Controller.RegisterSource = value
+	if value, ok := data["not_ready_policy"]; ok {
+		switch value {
+		case string(NotReadyDeregister):
+			c.Controller.NotReadyPolicy = NotReadyDeregister
+		case string(NotReadyCritical):
+			c.Controller.NotReadyPolicy = NotReadyCritical
+		case string(NotReadyMaintenance):
+			c.Controller.NotReadyPolicy = NotReadyMaintenance
+		default:
+			glog.Warningf("Wrong value of 'not_ready_policy' option. Permitted values: %s|%s|%s, is %s",
+				NotReadyDeregister, NotReadyCritical, NotReadyMaintenance, value)
+
+			c.Controller.NotReadyPolicy = NotReadyDeregister
+		}
+	} else {
+		c.Controller.NotReadyPolicy = NotReadyDeregister
+	}
+
+	if value, ok := data["drain_delay"]; ok && value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.DrainDelay = delay
+	} else {
+		c.Controller.DrainDelay = 0
+	}
+
+	if value, ok := data["cleanup_finalizer"]; ok && value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.CleanupFinalizer = enabled
+	} else {
+		c.Controller.CleanupFinalizer = false
+	}
+
+	if value, ok := data["cleanup_finalizer_timeout"]; ok && value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.CleanupFinalizerTimeout = timeout
+	} else {
+		c.Controller.CleanupFinalizerTimeout = 5 * time.Minute
+	}
+
+	// Several sources can be given, separated by comma
+	c.Controller.RegisterSources = nil
+	if value, ok := data["register_source"]; ok {
+		seen := make(map[string]bool)
+		for _, source := range strings.Split(value, ",") {
+			source = strings.TrimSpace(source)
+			switch source {
+			case "":
+				continue
+			case RegisterSourcePod, RegisterSourceService, RegisterSourceEndpoint, RegisterSourceEndpointSlice:
+				if !seen[source] {
+					seen[source] = true
+					c.Controller.RegisterSources = append(c.Controller.RegisterSources, source)
+				}
+			default:
+				glog.Warningf("Wrong value of 'register_source' option. Permitted values: %s|%s|%s|%s, is %s",
+					RegisterSourcePod, RegisterSourceService, RegisterSourceEndpoint, RegisterSourceEndpointSlice, source)
+			}
+		}
+	}
+	if len(c.Controller.RegisterSources) == 0 {
+		c.Controller.RegisterSources = []string{RegisterSourcePod}
+	}
+
+	if value, ok := data["retry_initial_interval"]; ok && value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.RetryInitialInterval = interval
+	} else {
+		c.Controller.RetryInitialInterval = 1 * time.Second
+	}
+
+	if value, ok := data["retry_max_interval"]; ok && value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.RetryMaxInterval = interval
+	} else {
+		c.Controller.RetryMaxInterval = 5 * time.Minute
+	}
+
+	if value, ok := data["retry_max_attempts"]; ok && value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.RetryMaxAttempts = attempts
+	} else {
+		c.Controller.RetryMaxAttempts = 0
+	}
+
+	if value, ok := data["retry_configmap"]; ok {
+		c.Controller.RetryConfigMap = value
+	}
+
+	if value, ok := data["workers"]; ok && value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil {
+			return c, err
+		}
+		if workers < 1 {
+			return c, fmt.Errorf("Value of 'workers' option must be greater than 0, is %d", workers)
+		}
+		c.Controller.Workers = workers
 	} else {
-		c.Controller.RegisterSource = "pod"
+		c.Controller.Workers = 4
+	}
+
+	serviceIDTemplate := DefaultServiceIDTemplate
+	if value, ok := data["service_id_template"]; ok && value != "" {
+		serviceIDTemplate = value
+	}
+	tmpl, err := parseServiceIDTemplate(serviceIDTemplate)
+	if err != nil {
+		return c, fmt.Errorf("Can't parse 'service_id_template' option: %s", err)
+	}
+	c.Controller.ServiceIDTemplate = tmpl
+
+	c.Controller.ServiceNameTemplate = nil
+	if value, ok := data["service_name_template"]; ok && value != "" {
+		tmpl, err := parseServiceNameTemplate(value)
+		if err != nil {
+			return c, fmt.Errorf("Can't parse 'service_name_template' option: %s", err)
+		}
+		c.Controller.ServiceNameTemplate = tmpl
+	}
+
+	c.Controller.LabelRules = nil
+	if value, ok := data["label_rules"]; ok && strings.TrimSpace(value) != "" {
+		rules, err := parseLabelRules(value)
+		if err != nil {
+			return c, fmt.Errorf("Can't parse 'label_rules' option: %s", err)
+		}
+		c.Controller.LabelRules = rules
 	}
 
 	return c, nil
 }
+
+// DefaultServiceIDTemplate is the default value of `service_id_template` option.
+// Namespace is a part of ID, so PODs with the same name in different namespaces don't collide.
+// Service is a part of ID, so Services which select the same POD and port don't collide.
+const DefaultServiceIDTemplate = "{{.Namespace}}{{with .Service}}-{{.}}{{end}}-{{.Pod}}{{with .Container}}-{{.}}{{end}}{{with .PortNumber}}-{{.}}{{end}}"
+
+var defaultServiceIDTemplate = template.Must(template.New("service_id").Parse(DefaultServiceIDTemplate))
+
+// ServiceIDData describes values which can be used in `service_id_template` option.
+// "Container" is set only by `pod` source. "Service" is set only by `endpoint` and `endpointslice` sources.
+// "Port" and "PortNumber" are set by `endpoint` and `endpointslice` sources and by `pod` source
+// only if named ports are registered as separate services.
+type ServiceIDData struct {
+	Namespace  string
+	Service    string
+	Pod        string
+	Container  string
+	Port       string
+	PortNumber int32
+	Node       string
+	UID        string
+}
+
+func parseServiceIDTemplate(value string) (*template.Template, error) {
+	tmpl, err := template.New("service_id").Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	// Unknown fields are reported only on execution, so the template is checked at start
+	if err := tmpl.Execute(io.Discard, ServiceIDData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// ServiceID builds ID of Consul service from `service_id_template` option
+func (c *ControllerConfig) ServiceID(data ServiceIDData) string {
+	tmpl := c.ServiceIDTemplate
+	if tmpl == nil {
+		tmpl = defaultServiceIDTemplate
+	}
+
+	var id strings.Builder
+	if err := tmpl.Execute(&id, data); err != nil {
+		glog.Errorf("Can't build service ID of %s/%s, default template is used: %s", data.Namespace, data.Pod, err)
+		id.Reset()
+		defaultServiceIDTemplate.Execute(&id, data) // nolint: errcheck
+	}
+	return id.String()
+}
+
+// defaultCheckTTL is TTL of checks refreshed by synchronization if `sync-interval` flag is not known
+const defaultCheckTTL = 30 * time.Minute
+
+// CheckTTL returns TTL of checks which are refreshed by synchronization, e.g. readiness check of container.
+// TTL is three times `sync-interval` flag, so checks don't expire when a single synchronization is late.
+func (c *ControllerConfig) CheckTTL() string {
+	if c.SyncInterval <= 0 {
+		return defaultCheckTTL.String()
+	}
+	return (3 * c.SyncInterval).String()
+}
+
+// ServiceNameData describes values which can be used in `service_name_template` option.
+// "Name" is the name which is used if the option is not given, "Owner" is the name of controller of object.
+type ServiceNameData struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	Owner       string
+}
+
+// NewServiceNameData returns values of the object for `service_name_template` option
+func NewServiceNameData(name string, objectMeta metav1.ObjectMeta) ServiceNameData {
+	data := ServiceNameData{
+		Name:        name,
+		Namespace:   objectMeta.Namespace,
+		Labels:      objectMeta.Labels,
+		Annotations: objectMeta.Annotations,
+	}
+	if owner := metav1.GetControllerOfNoCopy(&objectMeta); owner != nil {
+		data.Owner = owner.Name
+	}
+	return data
+}
+
+func parseServiceNameTemplate(value string) (*template.Template, error) {
+	// Missing labels and annotations are rendered as empty strings
+	tmpl, err := template.New("service_name").Option("missingkey=zero").Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, ServiceNameData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// ServiceName builds name of Consul service from `service_name_template` option.
+// The name is sanitized, so it's valid DNS label. If the option is not given or the
+// rendered name is empty then "Name" of data is returned.
+func (c *ControllerConfig) ServiceName(data ServiceNameData) string {
+	if c.ServiceNameTemplate == nil {
+		return data.Name
+	}
+
+	var name strings.Builder
+	if err := c.ServiceNameTemplate.Execute(&name, data); err != nil {
+		glog.Errorf("Can't build service name of %s/%s: %s", data.Namespace, data.Name, err)
+		return data.Name
+	}
+	if sanitized := sanitizeServiceName(name.String()); sanitized != "" {
+		return sanitized
+	}
+	return data.Name
+}
+
+// sanitizeServiceName converts name to valid DNS label: lower case alphanumeric characters
+// and '-', which starts and ends with alphanumeric character and is at most 63 characters long
+func sanitizeServiceName(name string) string {
+	var sanitized strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			sanitized.WriteRune(r)
+			dash = false
+		} else if !dash && sanitized.Len() > 0 {
+			sanitized.WriteRune('-')
+			dash = true
+		}
+	}
+
+	result := sanitized.String()
+	if len(result) > 63 {
+		result = result[:63]
+	}
+	return strings.TrimRight(result, "-")
+}
@@ -1,11 +1,13 @@
 package config
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestFillConfigDefaults(t *testing.T) {
@@ -45,7 +47,19 @@ func TestFillConfigDefaults(t *testing.T) {
 	assert.Equal(t, cfg.Controller.ConsulNodeSelector, "consul=enabled", "wrong default value for `consul_node_selector` option")
 	assert.Equal(t, cfg.Controller.PodLabelSelector, "", "wrong default value for `pod_label_selector` option")
 	assert.Equal(t, cfg.Controller.K8sTag, "kubernetes", "wrong default value for `k8s_tag` option")
+	assert.Equal(t, cfg.Controller.ClusterID, "", "wrong default value for `cluster_id` option")
+	assert.Equal(t, cfg.Controller.AdoptLegacy, true, "wrong default value for `adopt_legacy` option")
 	assert.Equal(t, cfg.Controller.RegisterMode, RegisterSingleMode, "wrong default value for `register_mode` option")
+	assert.Equal(t, cfg.Controller.RegisterSources, []string{"pod"}, "wrong default value for `register_source` option")
+	assert.Equal(t, cfg.Controller.NotReadyPolicy, NotReadyDeregister, "wrong default value for `not_ready_policy` option")
+	assert.Equal(t, cfg.Controller.DrainDelay, time.Duration(0), "wrong default value for `drain_delay` option")
+	assert.Equal(t, cfg.Controller.CleanupFinalizer, false, "wrong default value for `cleanup_finalizer` option")
+	assert.Equal(t, cfg.Controller.CleanupFinalizerTimeout, 5*time.Minute, "wrong default value for `cleanup_finalizer_timeout` option")
+	assert.Equal(t, cfg.Controller.RetryInitialInterval, 1*time.Second, "wrong default value for `retry_initial_interval` option")
+	assert.Equal(t, cfg.Controller.RetryMaxInterval, 5*time.Minute, "wrong default value for `retry_max_interval` option")
+	assert.Equal(t, cfg.Controller.RetryMaxAttempts, 0, "wrong default value for `retry_max_attempts` option")
+	assert.Equal(t, cfg.Controller.RetryConfigMap, "", "wrong default value for `retry_configmap` option")
+	assert.Equal(t, cfg.Controller.Workers, 4, "wrong default value for `workers` option")
 }
 
 func TestFillConfig(t *testing.T) {
@@ -68,7 +82,19 @@ func TestFillConfig(t *testing.T) {
 	data["consul_node_selector"] = "selector=true"
 	data["pod_label_selector"] = "app=mycrazyapp"
 	data["k8s_tag"] = "k8s"
+	data["cluster_id"] = "cluster1"
+	data["adopt_legacy"] = "false"
 	data["register_mode"] = "node"
+	data["register_source"] = "service"
+	data["not_ready_policy"] = "maintenance"
+	data["drain_delay"] = "30s"
+	data["cleanup_finalizer"] = "true"
+	data["cleanup_finalizer_timeout"] = "1m"
+	data["retry_initial_interval"] = "2s"
+	data["retry_max_interval"] = "1m"
+	data["retry_max_attempts"] = "5"
+	data["retry_configmap"] = "default/retry"
+	data["workers"] = "8"
 
 	cfg.fillConfig(data)
 
@@ -85,7 +111,19 @@ func TestFillConfig(t *testing.T) {
 	assert.Equal(t, cfg.Controller.ConsulNodeSelector, "selector=true", "they should be equal")
 	assert.Equal(t, cfg.Controller.PodLabelSelector, "app=mycrazyapp", "they should be equal")
 	assert.Equal(t, cfg.Controller.K8sTag, "k8s", "they should be equal")
+	assert.Equal(t, cfg.Controller.ClusterID, "cluster1", "they should be equal")
+	assert.Equal(t, cfg.Controller.AdoptLegacy, false, "they should be equal")
 	assert.Equal(t, cfg.Controller.RegisterMode, RegisterNodeMode, "they should be equal")
+	assert.Equal(t, cfg.Controller.RegisterSources, []string{"service"}, "they should be equal")
+	assert.Equal(t, cfg.Controller.NotReadyPolicy, NotReadyMaintenance, "they should be equal")
+	assert.Equal(t, cfg.Controller.DrainDelay, 30*time.Second, "they should be equal")
+	assert.Equal(t, cfg.Controller.CleanupFinalizer, true, "they should be equal")
+	assert.Equal(t, cfg.Controller.CleanupFinalizerTimeout, time.Minute, "they should be equal")
+	assert.Equal(t, cfg.Controller.RetryInitialInterval, 2*time.Second, "they should be equal")
+	assert.Equal(t, cfg.Controller.RetryMaxInterval, time.Minute, "they should be equal")
+	assert.Equal(t, cfg.Controller.RetryMaxAttempts, 5, "they should be equal")
+	assert.Equal(t, cfg.Controller.RetryConfigMap, "default/retry", "they should be equal")
+	assert.Equal(t, cfg.Controller.Workers, 8, "they should be equal")
 
 	data["register_mode"] = "pod"
 	cfg.fillConfig(data)
@@ -99,7 +137,119 @@ func TestFillConfig(t *testing.T) {
 	cfg.fillConfig(data)
 	assert.Equal(t, cfg.Controller.RegisterMode, RegisterNodeMode, "they should be equal")
 
+	data["register_mode"] = "catalog"
+	cfg.fillConfig(data)
+	assert.Equal(t, cfg.Controller.RegisterMode, RegisterCatalogMode, "they should be equal")
+
+	data["register_source"] = "pod, endpointslice,pod,unknown"
+	cfg.fillConfig(data)
+	assert.Equal(t, cfg.Controller.RegisterSources, []string{"pod", "endpointslice"}, "they should be equal")
+
+	data["register_source"] = "unknown"
+	cfg.fillConfig(data)
+	assert.Equal(t, cfg.Controller.RegisterSources, []string{"pod"}, "they should be equal")
+
+	data["not_ready_policy"] = "critical"
+	cfg.fillConfig(data)
+	assert.Equal(t, cfg.Controller.NotReadyPolicy, NotReadyCritical, "they should be equal")
+
+	data["not_ready_policy"] = "unknown"
+	cfg.fillConfig(data)
+	assert.Equal(t, cfg.Controller.NotReadyPolicy, NotReadyDeregister, "they should be equal")
+
 	data["consul_insecure_skip_verify"] = "not_bool"
 	_, err := cfg.fillConfig(data)
 	assert.Error(t, err, "An error was expected")
 }
+
+func TestServiceID(t *testing.T) {
+	t.Parallel()
+
+	var data = make(map[string]string)
+	cfg := &Config{}
+
+	data["service_id_template"] = "{{.Pod}}-{{.Port}}"
+	_, err := cfg.fillConfig(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "web-0-http", cfg.Controller.ServiceID(ServiceIDData{Namespace: "a", Pod: "web-0", Port: "http", PortNumber: 80}))
+
+	// Default template is namespace-qualified
+	data["service_id_template"] = ""
+	_, err = cfg.fillConfig(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "a-web-0-nginx", cfg.Controller.ServiceID(ServiceIDData{Namespace: "a", Pod: "web-0", Container: "nginx"}))
+	assert.Equal(t, "b-web-0-80", cfg.Controller.ServiceID(ServiceIDData{Namespace: "b", Pod: "web-0", Port: "http", PortNumber: 80}))
+	assert.Equal(t, "b-web-0", (&ControllerConfig{}).ServiceID(ServiceIDData{Namespace: "b", Pod: "web-0"}))
+	// Services which select the same POD and port don't collide
+	assert.Equal(t, "b-web-web-0-80", cfg.Controller.ServiceID(ServiceIDData{Namespace: "b", Service: "web", Pod: "web-0", PortNumber: 80}))
+	assert.Equal(t, "b-admin-web-0-80", cfg.Controller.ServiceID(ServiceIDData{Namespace: "b", Service: "admin", Pod: "web-0", PortNumber: 80}))
+
+	data["service_id_template"] = "{{.Unknown}}"
+	_, err = cfg.fillConfig(data)
+	assert.Error(t, err, "An error was expected")
+
+	data["service_id_template"] = "{{.Pod"
+	_, err = cfg.fillConfig(data)
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestCheckTTL(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "30m0s", (&ControllerConfig{}).CheckTTL())
+	assert.Equal(t, "6m0s", (&ControllerConfig{SyncInterval: 2 * time.Minute}).CheckTTL())
+}
+
+func TestServiceName(t *testing.T) {
+	t.Parallel()
+
+	var data = make(map[string]string)
+	cfg := &Config{}
+	controller := true
+
+	objectMeta := metav1.ObjectMeta{
+		Name:        "web-5d8f7c9b4-abcde",
+		Namespace:   "Prod",
+		Labels:      map[string]string{"app": "Web_API"},
+		Annotations: map[string]string{"team": "core"},
+		OwnerReferences: []metav1.OwnerReference{
+			{Kind: "ReplicaSet", Name: "web-5d8f7c9b4", Controller: &controller},
+		},
+	}
+	nameData := NewServiceNameData("web", objectMeta)
+	assert.Equal(t, "web-5d8f7c9b4", nameData.Owner)
+
+	// Name is not changed without template
+	_, err := cfg.fillConfig(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "web", cfg.Controller.ServiceName(nameData))
+
+	data["service_name_template"] = "{{ .Labels.app }}-{{ .Namespace }}"
+	_, err = cfg.fillConfig(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "web-api-prod", cfg.Controller.ServiceName(nameData))
+
+	data["service_name_template"] = "{{ .Annotations.team }}.{{ .Owner }}"
+	_, err = cfg.fillConfig(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "core-web-5d8f7c9b4", cfg.Controller.ServiceName(nameData))
+
+	// Empty name is replaced by the default one
+	data["service_name_template"] = "{{ .Labels.missing }}"
+	_, err = cfg.fillConfig(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "web", cfg.Controller.ServiceName(nameData))
+
+	data["service_name_template"] = "{{ .Unknown }}"
+	_, err = cfg.fillConfig(data)
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestSanitizeServiceName(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "my-service-1", sanitizeServiceName("My_Service..1"))
+	assert.Equal(t, "web", sanitizeServiceName("--web--"))
+	assert.Equal(t, "", sanitizeServiceName("__"))
+	assert.Len(t, sanitizeServiceName(strings.Repeat("a", 70)), 63)
+}
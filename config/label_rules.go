@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/warjiang/kube-consul-register/utils"
+
+	"sigs.k8s.io/yaml"
+)
+
+// These are valid values of `action` and `target` of label rule.
+// "LabelActionKeep" converts label to tag or meta, "LabelActionDrop" skips label.
+// "LabelTargetTag" converts label to `key:value` tag, "LabelTargetMeta" to `key`=`value` meta.
+const (
+	LabelActionKeep string = "keep"
+	LabelActionDrop string = "drop"
+	LabelTargetTag  string = "tag"
+	LabelTargetMeta string = "meta"
+)
+
+// LabelRule describes how labels of K8S object are converted to tags or meta of Consul service.
+// Rules are given as YAML list in `label_rules` option and the first rule which matches key of label is used.
+type LabelRule struct {
+	// Match is regular expression of label key
+	Match string `json:"match"`
+	// Action is `keep` (default) or `drop`
+	Action string `json:"action,omitempty"`
+	// Rewrite replaces the matched part of label key, it can refer to groups of Match, e.g. `$1`
+	Rewrite string `json:"rewrite,omitempty"`
+	// Target is `tag` (default) or `meta`
+	Target string `json:"target,omitempty"`
+
+	regexp *regexp.Regexp
+}
+
+var invalidMetaKeyChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+func parseLabelRules(value string) ([]LabelRule, error) {
+	var rules []LabelRule
+	if err := yaml.UnmarshalStrict([]byte(value), &rules); err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Action == "" {
+			rule.Action = LabelActionKeep
+		}
+		if rule.Target == "" {
+			rule.Target = LabelTargetTag
+		}
+		if rule.Action != LabelActionKeep && rule.Action != LabelActionDrop {
+			return nil, fmt.Errorf("Wrong action of rule %d: %s. Available actions: %s, %s", i+1, rule.Action, LabelActionKeep, LabelActionDrop)
+		}
+		if rule.Target != LabelTargetTag && rule.Target != LabelTargetMeta {
+			return nil, fmt.Errorf("Wrong target of rule %d: %s. Available targets: %s, %s", i+1, rule.Target, LabelTargetTag, LabelTargetMeta)
+		}
+
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong match of rule %d: %s", i+1, err)
+		}
+		rule.regexp = re
+	}
+	return rules, nil
+}
+
+// ConvertLabels converts labels to tags and meta of Consul service according to `label_rules` option.
+// Labels which don't match any rule are converted to tags. If value of label is equal to "tag" then
+// only key is set as tag. Tags are sorted and deduplicated, so registrations are deterministic.
+func (c *ControllerConfig) ConvertLabels(labels map[string]string) ([]string, map[string]string) {
+	var tags []string
+	meta := make(map[string]string)
+
+	// Labels are sorted, so the result doesn't depend on order when rewritten keys collide
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := labels[key]
+		target := LabelTargetTag
+
+		if rule := c.matchLabelRule(key); rule != nil {
+			if rule.Action == LabelActionDrop {
+				continue
+			}
+			if rule.Rewrite != "" {
+				key = rule.regexp.ReplaceAllString(key, rule.Rewrite)
+			}
+			target = rule.Target
+		}
+		if key == "" {
+			continue
+		}
+
+		if target == LabelTargetMeta {
+			// Consul accepts only alphanumeric characters, '_' and '-' in meta keys
+			meta[invalidMetaKeyChars.ReplaceAllString(key, "_")] = value
+		} else if value == "tag" {
+			tags = append(tags, key)
+		} else {
+			tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+		}
+	}
+	return utils.UniqueSorted(tags), meta
+}
+
+func (c *ControllerConfig) matchLabelRule(key string) *LabelRule {
+	for i := range c.LabelRules {
+		if c.LabelRules[i].regexp.MatchString(key) {
+			return &c.LabelRules[i]
+		}
+	}
+	return nil
+}
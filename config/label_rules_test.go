@@ -0,0 +1,71 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertLabels(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{
+		"app":                       "web",
+		"production":                "tag",
+		"pod-template-hash":         "5d8f7c9b4",
+		"helm.sh/chart":             "web-1.0.0",
+		"app.kubernetes.io/version": "1.0.0",
+		"team":                      "core",
+	}
+
+	// All labels are converted to tags without rules
+	cfg := &ControllerConfig{}
+	tags, meta := cfg.ConvertLabels(labels)
+	assert.Equal(t, []string{"app.kubernetes.io/version:1.0.0", "app:web", "helm.sh/chart:web-1.0.0", "pod-template-hash:5d8f7c9b4", "production", "team:core"}, tags)
+	assert.Empty(t, meta)
+
+	rules, err := parseLabelRules(`
+- match: "^(pod-template-hash|helm\\.sh/.*)$"
+  action: drop
+- match: "^app\\.kubernetes\\.io/(.*)$"
+  rewrite: "k8s-$1"
+  target: meta
+- match: "^team$"
+  target: meta
+- match: "^(app|production)$"
+- match: ".*"
+  action: drop
+`)
+	assert.Nil(t, err)
+	cfg.LabelRules = rules
+
+	tags, meta = cfg.ConvertLabels(labels)
+	assert.Equal(t, []string{"app:web", "production"}, tags)
+	assert.Equal(t, map[string]string{"k8s-version": "1.0.0", "team": "core"}, meta)
+
+	// Keys of meta are sanitized
+	cfg.LabelRules, _ = parseLabelRules(`[{match: "example.com/", target: meta}]`)
+	_, meta = cfg.ConvertLabels(map[string]string{"example.com/owner": "core"})
+	assert.Equal(t, map[string]string{"example_com_owner": "core"}, meta)
+}
+
+func TestParseLabelRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := parseLabelRules(`[{match: "^app$"}]`)
+	assert.Nil(t, err)
+	assert.Equal(t, LabelActionKeep, rules[0].Action)
+	assert.Equal(t, LabelTargetTag, rules[0].Target)
+
+	_, err = parseLabelRules(`[{match: "^app$", action: "skip"}]`)
+	assert.Error(t, err, "An error was expected")
+
+	_, err = parseLabelRules(`[{match: "^app$", target: "label"}]`)
+	assert.Error(t, err, "An error was expected")
+
+	_, err = parseLabelRules(`[{match: "(app"}]`)
+	assert.Error(t, err, "An error was expected")
+
+	_, err = parseLabelRules(`[{regex: "^app$"}]`)
+	assert.Error(t, err, "An error was expected")
+}
@@ -1,37 +1,177 @@
 package consul
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net/http"
-	"net/url"
-	"strings"
+	"time"
 
 	"github.com/warjiang/kube-consul-register/config"
 
 	"github.com/golang/glog"
 	consulapi "github.com/hashicorp/consul/api"
-	cleanhttp "github.com/hashicorp/go-cleanhttp"
 )
 
+// MaintenanceCheckPrefix is a prefix of ID of the check which keeps a service in maintenance mode,
+// it's the same as the one used by Consul Agent.
+const MaintenanceCheckPrefix string = "_service_maintenance:"
+
+// These are node meta keys which are set on the synthetic nodes created in `catalog` mode.
+// "ExternalNodeMeta" marks node as external, so it's not managed by any Consul Agent.
+// "ExternalProbeMeta" asks consul-esm to probe the node and run the checks of its services.
+// "RegisteredByNodeMeta" and "ClusterNodeMeta" mark nodes created by this controller in the given cluster,
+// so external nodes of other tools and clusters are never treated as agents.
+const (
+	ExternalNodeMeta     string = "external-node"
+	ExternalProbeMeta    string = "external-probe"
+	RegisteredByNodeMeta string = "k8s-registered-by"
+	ClusterNodeMeta      string = "k8s-cluster"
+)
+
+// registeredBy is the value of `RegisteredByNodeMeta` node meta
+const registeredBy string = "kube-consul-register"
+
+// NodeAddressFunc returns the address of Kubernetes node with the given name
+type NodeAddressFunc func(node string) (string, error)
+
 // Adapter builds configuration and returns Consul Client
 type Adapter struct {
 	client *consulapi.Client
 	Config *consulapi.Config
+
+	// pool keeps clients of all agents
+	pool *Pool
+
+	// NodeAddress returns the address of synthetic node in `catalog` mode.
+	// Name of node is used as the address if it's not given.
+	NodeAddress NodeAddressFunc
+
+	// mode and node are used in `catalog` mode where services are
+	// registered on the synthetic node instead of the Consul Agent.
+	mode      config.RegisterMode
+	node      string
+	clusterID string
+
+	// agent is URI of agent which is used as the key in the pool
+	agent string
+}
+
+// NewAdapter returns the Adapter with its own pool of clients
+func NewAdapter() *Adapter {
+	return &Adapter{pool: NewPool()}
+}
+
+// New returns the ConsulAdapter. The client of agent is taken from the pool.
+// If the client can't be created, the returned agent fails every call, see AgentErr.
+func (c *Adapter) New(cfg *config.Config, podNodeName string, podIP string) Registry {
+	pool := c.pool
+	if pool == nil {
+		pool = defaultPool
+	}
+
+	address := agentAddress(cfg, podNodeName, podIP)
+	client, consulConfig, err := pool.Get(cfg, address)
+	if err != nil {
+		glog.Errorf("Can't create client of Consul Agent %s: %s", address, err)
+		return &invalidAgent{parent: c, address: address, err: err}
+	}
+
+	return &Adapter{
+		client:      client,
+		Config:      consulConfig,
+		NodeAddress: c.NodeAddress,
+		pool:        pool,
+		mode:        cfg.Controller.RegisterMode,
+		node:        podNodeName,
+		clusterID:   cfg.Controller.ClusterID,
+		agent:       address,
+	}
+}
+
+// invalidAgent is the agent whose client can't be created, e.g. because of wrong TLS files.
+// Every call returns the error, so the agent is skipped instead of stopping the controller.
+type invalidAgent struct {
+	parent  *Adapter
+	address string
+	err     error
+}
+
+// New returns the Registry of agent which is responsible for the given node or pod
+func (a *invalidAgent) New(cfg *config.Config, podNodeName string, podIP string) Registry {
+	return a.parent.New(cfg, podNodeName, podIP)
+}
+
+// Err returns the error of client
+func (a *invalidAgent) Err() error {
+	return a.err
+}
+
+// Register returns the error of client
+func (a *invalidAgent) Register(service *consulapi.AgentServiceRegistration) error {
+	return a.err
+}
+
+// Deregister returns the error of client
+func (a *invalidAgent) Deregister(service *consulapi.AgentServiceRegistration) error {
+	return a.err
+}
+
+// List returns the error of client
+func (a *invalidAgent) List() (map[string]*consulapi.AgentService, error) {
+	return nil, a.err
+}
+
+// Health returns the error of client
+func (a *invalidAgent) Health(serviceID string) (string, error) {
+	return "", a.err
+}
+
+// UpdateTTL returns the error of client
+func (a *invalidAgent) UpdateTTL(checkID string, output string, status string) error {
+	return a.err
+}
+
+// EnableMaintenance returns the error of client
+func (a *invalidAgent) EnableMaintenance(serviceID string, reason string) error {
+	return a.err
+}
+
+// DisableMaintenance returns the error of client
+func (a *invalidAgent) DisableMaintenance(serviceID string) error {
+	return a.err
+}
+
+// Nodes returns the error of client
+func (a *invalidAgent) Nodes() ([]string, error) {
+	return nil, a.err
+}
+
+// Address returns the address of Consul Agent
+func (a *invalidAgent) Address() string {
+	return a.address
+}
+
+// Invalidate does nothing, there is no client in the pool
+func (a *invalidAgent) Invalidate() {}
+
+// NewClient returns the client of Consul which is given in `consul_address` option
+func NewClient(cfg *config.Config) (*consulapi.Client, error) {
+	client, _, err := NewPool().Get(cfg, serverAddress(cfg))
+	return client, err
 }
 
-// New returns the ConsulAdapter.
-func (c *Adapter) New(cfg *config.Config, podNodeName string, podIP string) *Adapter {
+// serverAddress builds URI of Consul which is given in `consul_address` option
+func serverAddress(cfg *config.Config) string {
+	return fmt.Sprintf("%s://%s:%s",
+		cfg.Controller.ConsulScheme, cfg.Controller.ConsulAddress, cfg.Controller.ConsulPort)
+}
+
+// agentAddress builds URI of Consul Agent which is responsible for the given node or pod
+func agentAddress(cfg *config.Config, podNodeName string, podIP string) string {
 	var address string
-	var err error
-	var uri *url.URL
-	var tlsConfig *tls.Config
 
 	//Build URI
 	switch mode := cfg.Controller.RegisterMode; mode {
-	case config.RegisterSingleMode:
-		address = fmt.Sprintf("%s://%s:%s",
-			cfg.Controller.ConsulScheme, cfg.Controller.ConsulAddress, cfg.Controller.ConsulPort)
+	case config.RegisterSingleMode, config.RegisterCatalogMode:
+		address = serverAddress(cfg)
 	case config.RegisterNodeMode:
 		address = fmt.Sprintf("%s://%s:%s",
 			cfg.Controller.ConsulScheme, podNodeName, cfg.Controller.ConsulPort)
@@ -39,75 +179,254 @@ func (c *Adapter) New(cfg *config.Config, podNodeName string, podIP string) *Ada
 		address = fmt.Sprintf("%s://%s:%s",
 			cfg.Controller.ConsulScheme, podIP, cfg.Controller.ConsulPort)
 	}
+	return address
+}
 
-	uri, err = url.Parse(address)
-	if err != nil {
-		glog.Fatalf("bad adapter uri: ")
+// Address returns the address of Consul Agent
+func (c *Adapter) Address() string {
+	return c.Config.Address
+}
+
+// Invalidate removes the client of agent from the pool
+func (c *Adapter) Invalidate() {
+	if c.pool != nil {
+		c.pool.Invalidate(c.agent)
 	}
+}
 
-	switch uri.Scheme {
-	case "consul-unix":
-		cfg.Consul.Address = strings.TrimPrefix(uri.String(), "consul-")
+// Register registers new service in Consul
+func (c *Adapter) Register(service *consulapi.AgentServiceRegistration) error {
+	glog.V(1).Infof("Registering service %s with ID: %s", service.Name, service.ID)
+	service = withChecksHash(service)
+	if c.mode == config.RegisterCatalogMode {
+		_, err := c.client.Catalog().Register(c.catalogRegistration(service), nil)
+		return err
+	}
+	return c.client.Agent().ServiceRegister(service)
+}
+
+// Deregister deregisters a service in Consul
+func (c *Adapter) Deregister(service *consulapi.AgentServiceRegistration) error {
+	glog.V(1).Infof("Deregistering service with ID: %s", service.ID)
+	if c.mode == config.RegisterCatalogMode {
+		_, err := c.client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:      c.node,
+			ServiceID: service.ID,
+		}, nil)
+		return err
+	}
+	return c.client.Agent().ServiceDeregister(service.ID)
+}
 
-	case "https":
-		tlsConfigDesc := &consulapi.TLSConfig{
-			Address:            uri.Host,
-			CAFile:             cfg.Controller.ConsulCAFile,
-			CertFile:           cfg.Controller.ConsulCertFile,
-			KeyFile:            cfg.Controller.ConsulKeyFile,
-			InsecureSkipVerify: cfg.Controller.ConsulInsecureSkipVerify,
+// List returns all services from a Consul Agent
+func (c *Adapter) List() (map[string]*consulapi.AgentService, error) {
+	glog.V(1).Info("Getting Consul services")
+	if c.mode == config.RegisterCatalogMode {
+		node, _, err := c.client.Catalog().Node(c.node, nil)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			return make(map[string]*consulapi.AgentService), nil
 		}
-		tlsConfig, err = consulapi.SetupTLSConfig(tlsConfigDesc)
+		return node.Services, nil
+	}
+	return c.client.Agent().Services()
+}
+
+// Health returns the aggregated status of service checks
+func (c *Adapter) Health(serviceID string) (string, error) {
+	if c.mode == config.RegisterCatalogMode {
+		checks, _, err := c.client.Health().Node(c.node, nil)
 		if err != nil {
-			glog.Fatalf("Cannot set up Consul TLSConfig: %s", err)
+			return "", err
 		}
-		cfg.Consul.Scheme = uri.Scheme
-		transport := cleanhttp.DefaultPooledTransport()
-		transport.TLSClientConfig = tlsConfig
-		cfg.Consul.HttpClient = &http.Client{
-			Transport: transport,
+		var serviceChecks consulapi.HealthChecks
+		for _, check := range checks {
+			if check.ServiceID == serviceID {
+				serviceChecks = append(serviceChecks, check)
+			}
 		}
-		cfg.Consul.Address = uri.Host
+		return serviceChecks.AggregatedStatus(), nil
+	}
+	status, _, err := c.client.Agent().AgentHealthServiceByID(serviceID)
+	return status, err
+}
 
-	default:
-		cfg.Consul.HttpClient = &http.Client{}
-		cfg.Consul.Address = uri.Host
+// UpdateTTL sets the status of TTL check. In `catalog` mode the check
+// of the synthetic node is registered again with the new status.
+func (c *Adapter) UpdateTTL(checkID string, output string, status string) error {
+	if c.mode == config.RegisterCatalogMode {
+		checks, _, err := c.client.Health().Node(c.node, nil)
+		if err != nil {
+			return err
+		}
+		for _, check := range checks {
+			if check.CheckID != checkID {
+				continue
+			}
+			check.Status = status
+			check.Output = output
+			_, err := c.client.Catalog().Register(&consulapi.CatalogRegistration{
+				Node:           c.node,
+				Address:        c.node,
+				Checks:         consulapi.HealthChecks{check},
+				SkipNodeUpdate: true,
+			}, nil)
+			return err
+		}
+		return fmt.Errorf("Unknown check ID: %s", checkID)
 	}
+	return c.client.Agent().UpdateTTL(checkID, output, status)
+}
 
-	// Add Token
-	if cfg.Controller.ConsulToken != "" {
-		cfg.Consul.Token = cfg.Controller.ConsulToken
+// EnableMaintenance puts a service into maintenance mode. In `catalog` mode
+// the critical maintenance check is registered on the synthetic node.
+func (c *Adapter) EnableMaintenance(serviceID string, reason string) error {
+	glog.V(1).Infof("Enabling maintenance of service with ID: %s", serviceID)
+	if c.mode == config.RegisterCatalogMode {
+		_, err := c.client.Catalog().Register(&consulapi.CatalogRegistration{
+			Node:    c.node,
+			Address: c.node,
+			Checks: consulapi.HealthChecks{{
+				Node:      c.node,
+				CheckID:   MaintenanceCheckPrefix + serviceID,
+				Name:      "Service Maintenance Mode",
+				Notes:     reason,
+				Status:    consulapi.HealthCritical,
+				ServiceID: serviceID,
+			}},
+			SkipNodeUpdate: true,
+		}, nil)
+		return err
 	}
+	return c.client.Agent().EnableServiceMaintenance(serviceID, reason)
+}
 
-	//Timeout
-	cfg.Consul.HttpClient.Timeout = cfg.Controller.ConsulTimeout
+// DisableMaintenance takes a service out of maintenance mode
+func (c *Adapter) DisableMaintenance(serviceID string) error {
+	glog.V(1).Infof("Disabling maintenance of service with ID: %s", serviceID)
+	if c.mode == config.RegisterCatalogMode {
+		_, err := c.client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:    c.node,
+			CheckID: MaintenanceCheckPrefix + serviceID,
+		}, nil)
+		return err
+	}
+	return c.client.Agent().DisableServiceMaintenance(serviceID)
+}
 
-	client, err := consulapi.NewClient(cfg.Consul)
+// Nodes returns names of external nodes from the Consul catalog which have been created by this controller
+// in the same cluster
+func (c *Adapter) Nodes() ([]string, error) {
+	glog.V(1).Info("Getting Consul external nodes")
+	nodes, _, err := c.client.Catalog().Nodes(&consulapi.QueryOptions{
+		NodeMeta: map[string]string{ExternalNodeMeta: "true", RegisteredByNodeMeta: registeredBy},
+	})
 	if err != nil {
-		glog.Fatalf("consul: %s", uri.Scheme)
+		return nil, err
 	}
 
-	//Store config
-	c.Config = cfg.Consul
-
-	c.client = client
-	return c
+	var names []string
+	for _, node := range nodes {
+		// Cluster is compared here, as nodes of cluster without ID don't have the meta
+		if node.Meta[ClusterNodeMeta] != c.clusterID {
+			continue
+		}
+		names = append(names, node.Node)
+	}
+	return names, nil
 }
 
-// Register registers new service in Consul
-func (c *Adapter) Register(service *consulapi.AgentServiceRegistration) error {
-	glog.V(1).Infof("Registering service %s with ID: %s", service.Name, service.ID)
-	return c.client.Agent().ServiceRegister(service)
+// nodeAddress returns the address of synthetic node, it's the name of node if the address is unknown
+func (c *Adapter) nodeAddress() string {
+	if c.NodeAddress == nil {
+		return c.node
+	}
+	address, err := c.NodeAddress(c.node)
+	if err != nil || address == "" {
+		glog.Warningf("Can't get address of node %s, its name is used instead: %v", c.node, err)
+		return c.node
+	}
+	return address
 }
 
-// Deregister deregisters a service in Consul
-func (c *Adapter) Deregister(service *consulapi.AgentServiceRegistration) error {
-	glog.V(1).Infof("Deregistering service with ID: %s", service.ID)
-	return c.client.Agent().ServiceDeregister(service.ID)
+// catalogRegistration converts service to the catalog registration of the synthetic node
+func (c *Adapter) catalogRegistration(service *consulapi.AgentServiceRegistration) *consulapi.CatalogRegistration {
+	registration := &consulapi.CatalogRegistration{
+		Node:    c.node,
+		Address: c.nodeAddress(),
+		NodeMeta: map[string]string{
+			ExternalNodeMeta:     "true",
+			ExternalProbeMeta:    "true",
+			RegisteredByNodeMeta: registeredBy,
+		},
+		Service: agentService(service),
+	}
+	if c.clusterID != "" {
+		registration.NodeMeta[ClusterNodeMeta] = c.clusterID
+	}
+
+	var checks consulapi.AgentServiceChecks
+	if service.Check != nil {
+		checks = append(checks, service.Check)
+	}
+	checks = append(checks, service.Checks...)
+
+	for i, check := range checks {
+		// Skip checks without definition, e.g. converted from exec probes.
+		// TTL checks are kept, their status is updated by UpdateTTL.
+		if check.HTTP == "" && check.TCP == "" && check.TTL == "" {
+			continue
+		}
+
+		checkID := check.CheckID
+		if checkID == "" {
+			checkID = fmt.Sprintf("service:%s", service.ID)
+			if len(checks) > 1 {
+				checkID = fmt.Sprintf("%s:%d", checkID, i+1)
+			}
+		}
+		name := check.Name
+		if name == "" {
+			name = fmt.Sprintf("Service '%s' check", service.Name)
+		}
+		status := check.Status
+		if status == "" {
+			status = consulapi.HealthCritical
+		}
+		interval, _ := time.ParseDuration(check.Interval)
+		timeout, _ := time.ParseDuration(check.Timeout)
+
+		registration.Checks = append(registration.Checks, &consulapi.HealthCheck{
+			Node:        c.node,
+			CheckID:     checkID,
+			Name:        name,
+			Status:      status,
+			ServiceID:   service.ID,
+			ServiceName: service.Name,
+			Definition: consulapi.HealthCheckDefinition{
+				HTTP:             check.HTTP,
+				Header:           check.Header,
+				Method:           check.Method,
+				TLSSkipVerify:    check.TLSSkipVerify,
+				TCP:              check.TCP,
+				IntervalDuration: interval,
+				TimeoutDuration:  timeout,
+			},
+		})
+	}
+	return registration
 }
 
-// Services returns all services from a Consul Agent
-func (c *Adapter) Services() (map[string]*consulapi.AgentService, error) {
-	glog.V(1).Info("Getting Consul services")
-	return c.client.Agent().Services()
+// agentService converts service registration to the service which is returned by Consul
+func agentService(service *consulapi.AgentServiceRegistration) *consulapi.AgentService {
+	return &consulapi.AgentService{
+		ID:      service.ID,
+		Service: service.Name,
+		Tags:    service.Tags,
+		Meta:    service.Meta,
+		Port:    service.Port,
+		Address: service.Address,
+	}
 }
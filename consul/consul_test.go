@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -25,46 +26,121 @@ func TestNew(t *testing.T) {
 		Consul: consulapi.DefaultConfig(),
 	}
 
-	consulInstance := Adapter{}
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent := NewAdapter().New(cfg, "pod_name", "127.0.0.1").(*Adapter)
 
-	assert.Equal(t, cfg.Consul.Address, "localhost:8500", "wrong URI")
-	assert.Equal(t, cfg.Consul.Scheme, "http", "wrong scheme")
-	assert.Equal(t, cfg.Consul.Token, "token", "wrong token")
-	assert.Equal(t, cfg.Consul.HttpClient.Timeout, time.Duration(0), "wrong timeout")
+	assert.Equal(t, consulAgent.Config.Address, "localhost:8500", "wrong URI")
+	assert.Equal(t, consulAgent.Config.Scheme, "http", "wrong scheme")
+	assert.Equal(t, consulAgent.Config.Token, "token", "wrong token")
+	assert.Equal(t, consulAgent.Config.HttpClient.Timeout, time.Duration(0), "wrong timeout")
+
+	// Shared configuration is not modified
+	assert.Equal(t, consulapi.DefaultConfig().Address, cfg.Consul.Address, "shared configuration was modified")
+	assert.Equal(t, "", cfg.Consul.Token, "shared configuration was modified")
 
 	// Tests Consul Timeout
 	cfg.Controller.ConsulTimeout = time.Duration(1 * time.Second)
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = NewAdapter().New(cfg, "pod_name", "127.0.0.1").(*Adapter)
 
-	assert.Equal(t, cfg.Consul.HttpClient.Timeout, time.Duration(1*time.Second), "wrong timeout")
+	assert.Equal(t, consulAgent.Config.HttpClient.Timeout, time.Duration(1*time.Second), "wrong timeout")
 
 	// Tests RegisterNodeMode
 	cfg.Controller.RegisterMode = config.RegisterNodeMode
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = NewAdapter().New(cfg, "pod_name", "127.0.0.1").(*Adapter)
 
-	assert.Equal(t, "pod_name:8500", cfg.Consul.Address, "wrong URI")
+	assert.Equal(t, "pod_name:8500", consulAgent.Config.Address, "wrong URI")
 
 	// Tests RegisterPodMode
 	cfg.Controller.RegisterMode = config.RegisterPodMode
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = NewAdapter().New(cfg, "pod_name", "127.0.0.1").(*Adapter)
 
-	assert.Equal(t, "127.0.0.1:8500", cfg.Consul.Address, "wrong URI")
+	assert.Equal(t, "127.0.0.1:8500", consulAgent.Config.Address, "wrong URI")
 
 	// Tests https scheme
 	cfg.Controller.ConsulScheme = "https"
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = NewAdapter().New(cfg, "pod_name", "127.0.0.1").(*Adapter)
 
-	assert.Equal(t, "https", cfg.Consul.Scheme, "wrong scheme")
+	assert.Equal(t, "https", consulAgent.Config.Scheme, "wrong scheme")
 
 	// Tests consul-unix scheme
 	cfg.Controller.ConsulScheme = "consul-unix"
 	cfg.Controller.RegisterMode = config.RegisterSingleMode
 	cfg.Controller.ConsulPort = "8500"
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = NewAdapter().New(cfg, "pod_name", "127.0.0.1").(*Adapter)
+
+	assert.Equal(t, "localhost:8500", consulAgent.Config.Address, "wrong URI")
+
+}
+
+func TestPool(t *testing.T) {
+	t.Parallel()
 
-	assert.Equal(t, "localhost:8500", cfg.Consul.Address, "wrong URI")
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulPort:   "8500",
+			ConsulScheme: "http",
+			RegisterMode: config.RegisterNodeMode,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+
+	consulInstance := NewAdapter()
+
+	// Clients are reused for the same agent
+	node1 := consulInstance.New(cfg, "node1", "").(*Adapter)
+	assert.Same(t, node1.client, consulInstance.New(cfg, "node1", "").(*Adapter).client)
+
+	// Agents share the transport
+	node2 := consulInstance.New(cfg, "node2", "").(*Adapter)
+	assert.NotSame(t, node1.client, node2.client)
+	assert.Same(t, node1.Config.HttpClient.Transport, node2.Config.HttpClient.Transport)
+
+	// Concurrent calls return the same client
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "node3:8500", consulInstance.New(cfg, "node3", "").Address())
+		}()
+	}
+	wg.Wait()
+
+	// Client of disappeared agent is invalidated
+	InvalidateAgents(map[string]Registry{"node1": node1, "node2": node2}, map[string]Registry{"node2": node2})
+	assert.NotSame(t, node1.client, consulInstance.New(cfg, "node1", "").(*Adapter).client)
+	assert.Same(t, node2.client, consulInstance.New(cfg, "node2", "").(*Adapter).client)
+}
+
+func TestInvalidAgent(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulPort:   "8500",
+			ConsulScheme: "https",
+			ConsulCAFile: "/nonexistent/ca.pem",
+			RegisterMode: config.RegisterNodeMode,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
 
+	// Agent whose client can't be created fails every call instead of stopping the controller
+	agent := NewRetry(NewAdapter(), cfg, nil).New(cfg, "node1", "")
+	assert.Error(t, AgentErr(agent))
+	assert.Equal(t, "https://node1:8500", agent.Address())
+	assert.Error(t, agent.Register(&consulapi.AgentServiceRegistration{ID: "service1"}))
+	_, err := agent.List()
+	assert.Error(t, err, "An error was expected")
+	_, err = Nodes(agent)
+	assert.Error(t, err, "An error was expected")
+
+	// Invalid agents are skipped, the others are kept
+	valid := NewMemory().New(cfg, "node2", "")
+	assert.Nil(t, AgentErr(valid))
+	agents := map[string]Registry{"node1": agent, "node2": valid}
+	SkipInvalidAgents(agents)
+	assert.Len(t, agents, 1)
+	assert.Contains(t, agents, "node2")
 }
 
 func TestConsulAdapterMethods(t *testing.T) {
@@ -81,8 +157,7 @@ func TestConsulAdapterMethods(t *testing.T) {
 		Consul: consulapi.DefaultConfig(),
 	}
 
-	consulInstance := Adapter{}
-	consulAgent := consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent := NewAdapter().New(cfg, "pod_name", "127.0.0.1")
 
 	err = consulAgent.Register(&consulapi.AgentServiceRegistration{})
 	assert.NotNil(t, err, "An error was expected")
@@ -90,7 +165,65 @@ func TestConsulAdapterMethods(t *testing.T) {
 	err = consulAgent.Deregister(&consulapi.AgentServiceRegistration{})
 	assert.NotNil(t, err, "An error was expected")
 
-	_, err = consulAgent.Services()
+	_, err = consulAgent.List()
+	assert.NotNil(t, err, "An error was expected")
+
+	_, err = consulAgent.Health("service_id")
 	assert.NotNil(t, err, "An error was expected")
 
 }
+
+func TestCatalogRegistration(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress: "localhost",
+			ConsulPort:    "8500",
+			ConsulScheme:  "http",
+			RegisterMode:  config.RegisterCatalogMode,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+
+	consulAgent := NewAdapter().New(cfg, "nodename", "127.0.0.1").(*Adapter)
+	assert.Equal(t, "localhost:8500", consulAgent.Address(), "wrong URI")
+
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "podname-containername",
+		Name:    "servicename",
+		Tags:    []string{"kubernetes"},
+		Port:    8080,
+		Address: "10.0.0.1",
+		Checks: consulapi.AgentServiceChecks{
+			{Name: "Liveness Probe", Status: "passing", Interval: "10s", Timeout: "1s", HTTP: "http://10.0.0.1:8080/ping"},
+			{},
+		},
+	}
+
+	registration := consulAgent.catalogRegistration(service)
+	assert.Equal(t, "nodename", registration.Node)
+	assert.Equal(t, "nodename", registration.Address)
+	assert.Equal(t, "true", registration.NodeMeta[ExternalNodeMeta])
+	assert.Equal(t, "true", registration.NodeMeta[ExternalProbeMeta])
+	assert.Equal(t, "kube-consul-register", registration.NodeMeta[RegisteredByNodeMeta])
+	assert.NotContains(t, registration.NodeMeta, ClusterNodeMeta)
+	assert.Equal(t, "podname-containername", registration.Service.ID)
+	assert.Equal(t, "servicename", registration.Service.Service)
+	assert.Equal(t, 8080, registration.Service.Port)
+	assert.Len(t, registration.Checks, 1)
+	assert.Equal(t, "service:podname-containername:1", registration.Checks[0].CheckID)
+	assert.Equal(t, "passing", registration.Checks[0].Status)
+	assert.Equal(t, 10*time.Second, registration.Checks[0].Definition.IntervalDuration)
+	assert.Equal(t, "http://10.0.0.1:8080/ping", registration.Checks[0].Definition.HTTP)
+
+	// Synthetic node gets the address of Kubernetes node and ID of cluster
+	cfg.Controller.ClusterID = "prod"
+	adapter := NewAdapter()
+	adapter.NodeAddress = func(node string) (string, error) {
+		return "192.168.0.1", nil
+	}
+	registration = adapter.New(cfg, "nodename", "127.0.0.1").(*Adapter).catalogRegistration(service)
+	assert.Equal(t, "192.168.0.1", registration.Address)
+	assert.Equal(t, "prod", registration.NodeMeta[ClusterNodeMeta])
+}
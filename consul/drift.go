@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/warjiang/kube-consul-register/metrics"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ChecksHashMeta is a service meta key which keeps the hash of service checks.
+// Checks aren't returned together with services, so the hash is compared instead.
+// The hash reflects the last registration, checks changed directly on the agent aren't detected.
+const ChecksHashMeta string = "k8s-checks-hash"
+
+// These are fields of service which are compared to detect drift
+const (
+	DriftName    string = "name"
+	DriftTags    string = "tags"
+	DriftMeta    string = "meta"
+	DriftPort    string = "port"
+	DriftAddress string = "address"
+	DriftChecks  string = "checks"
+)
+
+// Drift returns fields of the registered service which differ from the desired registration
+func Drift(desired *consulapi.AgentServiceRegistration, actual *consulapi.AgentService) []string {
+	var fields []string
+
+	if desired.Name != actual.Service {
+		fields = append(fields, DriftName)
+	}
+	if !equalTags(desired.Tags, actual.Tags) {
+		fields = append(fields, DriftTags)
+	}
+	if !equalMeta(desired.Meta, actual.Meta) {
+		fields = append(fields, DriftMeta)
+	}
+	if desired.Port != actual.Port {
+		fields = append(fields, DriftPort)
+	}
+	if desired.Address != actual.Address {
+		fields = append(fields, DriftAddress)
+	}
+	if checksHash(desired) != actual.Meta[ChecksHashMeta] {
+		fields = append(fields, DriftChecks)
+	}
+	return fields
+}
+
+// CheckDrift compares the registered service with the desired registration
+// and counts every drifted field. It returns true if the service has to be registered again.
+func CheckDrift(desired *consulapi.AgentServiceRegistration, actual *consulapi.AgentService) bool {
+	fields := Drift(desired, actual)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, field := range fields {
+		metrics.DriftDetected.WithLabelValues(field).Inc()
+	}
+	glog.Infof("Service %s differs from its desired registration, drifted fields: %s", desired.ID, strings.Join(fields, ", "))
+	return true
+}
+
+// withChecksHash returns the copy of service whose meta keeps the hash of its checks
+func withChecksHash(service *consulapi.AgentServiceRegistration) *consulapi.AgentServiceRegistration {
+	hash := checksHash(service)
+	if hash == "" {
+		return service
+	}
+
+	registration := *service
+	registration.Meta = make(map[string]string, len(service.Meta)+1)
+	for key, value := range service.Meta {
+		registration.Meta[key] = value
+	}
+	registration.Meta[ChecksHashMeta] = hash
+	return &registration
+}
+
+// checksHash returns the hash of checks definition, status of checks is ignored
+func checksHash(service *consulapi.AgentServiceRegistration) string {
+	var checks consulapi.AgentServiceChecks
+	if service.Check != nil {
+		checks = append(checks, service.Check)
+	}
+	checks = append(checks, service.Checks...)
+	if len(checks) == 0 {
+		return ""
+	}
+
+	definitions := make([]consulapi.AgentServiceCheck, 0, len(checks))
+	for _, check := range checks {
+		definition := *check
+		definition.Status = ""
+		definitions = append(definitions, definition)
+	}
+	data, err := json.Marshal(definitions)
+	if err != nil {
+		return ""
+	}
+	hash := fnv.New64a()
+	hash.Write(data)
+	return fmt.Sprintf("%x", hash.Sum64())
+}
+
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equalMeta compares meta of services, the hash of checks is compared separately
+func equalMeta(desired, actual map[string]string) bool {
+	count := 0
+	for key, value := range actual {
+		if key == ChecksHashMeta {
+			continue
+		}
+		if desiredValue, ok := desired[key]; !ok || desiredValue != value {
+			return false
+		}
+		count++
+	}
+	return count == len(desired)
+}
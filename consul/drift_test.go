@@ -0,0 +1,59 @@
+package consul
+
+import (
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrift(t *testing.T) {
+	t.Parallel()
+
+	desired := &consulapi.AgentServiceRegistration{
+		ID:      "default-web-0",
+		Name:    "web",
+		Tags:    []string{"kubernetes", "app:web"},
+		Meta:    map[string]string{"k8s-source": "pod"},
+		Port:    80,
+		Address: "10.0.0.1",
+		Check: &consulapi.AgentServiceCheck{
+			HTTP:     "http://10.0.0.1:80/",
+			Interval: "10s",
+			Status:   consulapi.HealthPassing,
+		},
+	}
+
+	registry := NewMemory()
+	err := registry.Register(desired)
+	assert.Nil(t, err)
+	services, _ := registry.List()
+	actual := services["default-web-0"]
+	assert.NotEmpty(t, actual.Meta[ChecksHashMeta])
+	assert.NotContains(t, desired.Meta, ChecksHashMeta)
+	assert.Empty(t, Drift(desired, actual))
+
+	// Order of tags and status of checks are ignored
+	reordered := *desired
+	reordered.Tags = []string{"app:web", "kubernetes"}
+	reordered.Check = &consulapi.AgentServiceCheck{HTTP: "http://10.0.0.1:80/", Interval: "10s"}
+	assert.Empty(t, Drift(&reordered, actual))
+
+	changed := *desired
+	changed.Name = "api"
+	changed.Tags = []string{"kubernetes"}
+	changed.Meta = map[string]string{"k8s-source": "pod", "team": "core"}
+	changed.Port = 8080
+	changed.Address = "10.0.0.2"
+	changed.Check = &consulapi.AgentServiceCheck{HTTP: "http://10.0.0.1:80/health", Interval: "10s"}
+	assert.Equal(t, []string{DriftName, DriftTags, DriftMeta, DriftPort, DriftAddress, DriftChecks}, Drift(&changed, actual))
+	assert.True(t, CheckDrift(&changed, actual))
+
+	// Service without checks has no hash
+	desired.Check = nil
+	err = registry.Register(desired)
+	assert.Nil(t, err)
+	services, _ = registry.List()
+	assert.NotContains(t, services["default-web-0"].Meta, ChecksHashMeta)
+	assert.False(t, CheckDrift(desired, services["default-web-0"]))
+}
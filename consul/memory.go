@@ -0,0 +1,173 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/warjiang/kube-consul-register/config"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Memory is an in-memory Registry. Services of all agents are kept in the shared store,
+// so it can be used instead of Consul e.g. in tests.
+type Memory struct {
+	store   *memoryStore
+	address string
+}
+
+type memoryStore struct {
+	mutex       sync.Mutex
+	services    map[string]map[string]*consulapi.AgentServiceRegistration
+	maintenance map[string]map[string]string
+}
+
+// NewMemory returns the empty in-memory Registry
+func NewMemory() *Memory {
+	return &Memory{
+		store: &memoryStore{
+			services:    make(map[string]map[string]*consulapi.AgentServiceRegistration),
+			maintenance: make(map[string]map[string]string),
+		},
+	}
+}
+
+// New returns the Registry of agent which is responsible for the given node or pod
+func (m *Memory) New(cfg *config.Config, podNodeName string, podIP string) Registry {
+	address := agentAddress(cfg, podNodeName, podIP)
+	// In `catalog` mode all services are kept by servers, so synthetic node identifies the agent
+	if cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		address = podNodeName
+	}
+	return &Memory{
+		store:   m.store,
+		address: address,
+	}
+}
+
+// Register registers new service
+func (m *Memory) Register(service *consulapi.AgentServiceRegistration) error {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	if _, ok := m.store.services[m.address]; !ok {
+		m.store.services[m.address] = make(map[string]*consulapi.AgentServiceRegistration)
+	}
+	m.store.services[m.address][service.ID] = withChecksHash(service)
+	return nil
+}
+
+// Deregister deregisters a service
+func (m *Memory) Deregister(service *consulapi.AgentServiceRegistration) error {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	delete(m.store.services[m.address], service.ID)
+	if len(m.store.services[m.address]) == 0 {
+		delete(m.store.services, m.address)
+	}
+	delete(m.store.maintenance[m.address], service.ID)
+	return nil
+}
+
+// List returns all services of agent
+func (m *Memory) List() (map[string]*consulapi.AgentService, error) {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	services := make(map[string]*consulapi.AgentService)
+	for id, service := range m.store.services[m.address] {
+		services[id] = agentService(service)
+	}
+	return services, nil
+}
+
+// Health returns the aggregated status of service checks. Checks are not run,
+// so the status is taken from the initial status of checks.
+func (m *Memory) Health(serviceID string) (string, error) {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	service, ok := m.store.services[m.address][serviceID]
+	if !ok {
+		return consulapi.HealthCritical, nil
+	}
+	// Service in maintenance mode is critical
+	if _, ok := m.store.maintenance[m.address][serviceID]; ok {
+		return consulapi.HealthCritical, nil
+	}
+
+	var checks consulapi.HealthChecks
+	for _, check := range append(consulapi.AgentServiceChecks{service.Check}, service.Checks...) {
+		if check == nil || check.Status == "" {
+			continue
+		}
+		checks = append(checks, &consulapi.HealthCheck{Status: check.Status})
+	}
+	return checks.AggregatedStatus(), nil
+}
+
+// UpdateTTL sets the status of check with the given ID
+func (m *Memory) UpdateTTL(checkID string, output string, status string) error {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	for _, service := range m.store.services[m.address] {
+		for _, check := range append(consulapi.AgentServiceChecks{service.Check}, service.Checks...) {
+			if check != nil && check.CheckID == checkID {
+				check.Status = status
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Unknown check ID: %s", checkID)
+}
+
+// EnableMaintenance puts a service into maintenance mode
+func (m *Memory) EnableMaintenance(serviceID string, reason string) error {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	if _, ok := m.store.services[m.address][serviceID]; !ok {
+		return fmt.Errorf("Unknown service ID: %s", serviceID)
+	}
+	if _, ok := m.store.maintenance[m.address]; !ok {
+		m.store.maintenance[m.address] = make(map[string]string)
+	}
+	m.store.maintenance[m.address][serviceID] = reason
+	return nil
+}
+
+// DisableMaintenance takes a service out of maintenance mode
+func (m *Memory) DisableMaintenance(serviceID string) error {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	if _, ok := m.store.services[m.address][serviceID]; !ok {
+		return fmt.Errorf("Unknown service ID: %s", serviceID)
+	}
+	delete(m.store.maintenance[m.address], serviceID)
+	return nil
+}
+
+// Nodes returns addresses of all agents which have at least one service
+func (m *Memory) Nodes() ([]string, error) {
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	var nodes []string
+	for address := range m.store.services {
+		nodes = append(nodes, address)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// Address returns the address of agent
+func (m *Memory) Address() string {
+	return m.address
+}
+
+// Invalidate does nothing, there aren't resources kept for agent
+func (m *Memory) Invalidate() {}
@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/warjiang/kube-consul-register/config"
+)
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulScheme: "http",
+			ConsulPort:   "8500",
+			RegisterMode: config.RegisterNodeMode,
+		},
+	}
+
+	memory := NewMemory()
+	agent1 := memory.New(cfg, "node1", "")
+	agent2 := memory.New(cfg, "node2", "")
+
+	err := agent1.Register(&consulapi.AgentServiceRegistration{ID: "service1", Name: "service"})
+	assert.Nil(t, err)
+	err = agent2.Register(&consulapi.AgentServiceRegistration{
+		ID:    "service2",
+		Name:  "service",
+		Check: &consulapi.AgentServiceCheck{CheckID: "service:service2", TTL: "10m", Status: consulapi.HealthWarning},
+	})
+	assert.Nil(t, err)
+
+	services, _ := agent1.List()
+	assert.Len(t, services, 1)
+	assert.Equal(t, "service", services["service1"].Service)
+
+	// Agents share the store
+	services, _ = memory.New(cfg, "node2", "").List()
+	assert.Contains(t, services, "service2")
+
+	nodes, _ := memory.Nodes()
+	assert.Equal(t, []string{"http://node1:8500", "http://node2:8500"}, nodes)
+
+	status, _ := agent1.Health("service1")
+	assert.Equal(t, consulapi.HealthPassing, status)
+	status, _ = agent2.Health("service2")
+	assert.Equal(t, consulapi.HealthWarning, status)
+	status, _ = agent2.Health("service1")
+	assert.Equal(t, consulapi.HealthCritical, status)
+
+	err = UpdateTTL(agent2, "service:service2", "", consulapi.HealthPassing)
+	assert.Nil(t, err)
+	status, _ = agent2.Health("service2")
+	assert.Equal(t, consulapi.HealthPassing, status)
+	assert.Error(t, UpdateTTL(agent1, "service:service2", "", consulapi.HealthPassing))
+
+	// Service in maintenance mode is critical
+	err = EnableMaintenance(agent2, "service2", "not ready")
+	assert.Nil(t, err)
+	status, _ = agent2.Health("service2")
+	assert.Equal(t, consulapi.HealthCritical, status)
+	err = DisableMaintenance(agent2, "service2")
+	assert.Nil(t, err)
+	status, _ = agent2.Health("service2")
+	assert.Equal(t, consulapi.HealthPassing, status)
+	assert.Error(t, EnableMaintenance(agent1, "service2", ""))
+
+	err = agent1.Deregister(&consulapi.AgentServiceRegistration{ID: "service1"})
+	assert.Nil(t, err)
+	services, _ = agent1.List()
+	assert.Len(t, services, 0)
+}
+
+// slowRegistry delays listing of services
+type slowRegistry struct {
+	Registry
+	delay time.Duration
+}
+
+func (s *slowRegistry) List() (map[string]*consulapi.AgentService, error) {
+	time.Sleep(s.delay)
+	return s.Registry.List()
+}
+
+func TestListAgents(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{Controller: &config.ControllerConfig{RegisterMode: config.RegisterPodMode}}
+	memory := NewMemory()
+	agent1 := memory.New(cfg, "", "10.0.0.1")
+	agent2 := memory.New(cfg, "", "10.0.0.2")
+	assert.Nil(t, agent1.Register(&consulapi.AgentServiceRegistration{ID: "service1"}))
+	assert.Nil(t, agent2.Register(&consulapi.AgentServiceRegistration{ID: "service2"}))
+
+	// Agents are listed concurrently, so slow agents don't add up
+	start := time.Now()
+	listed := ListAgents(map[string]Registry{
+		"agent1": &slowRegistry{Registry: agent1, delay: 200 * time.Millisecond},
+		"agent2": &slowRegistry{Registry: agent2, delay: 200 * time.Millisecond},
+	})
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+
+	assert.Nil(t, listed["agent1"].Err)
+	assert.Contains(t, listed["agent1"].Services, "service1")
+	assert.Nil(t, listed["agent2"].Err)
+	assert.Contains(t, listed["agent2"].Services, "service2")
+	assert.Nil(t, ListErr(listed))
+
+	// Failure of any agent is reported
+	listed["agent2"] = AgentServices{Err: fmt.Errorf("connection refused")}
+	assert.EqualError(t, ListErr(listed), "Can't list services of 1 agent(s): agent2: connection refused")
+}
+
+func TestOptionalFeatures(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{Controller: &config.ControllerConfig{RegisterMode: config.RegisterSingleMode}}
+	agent := NewMemory().New(cfg, "", "")
+	assert.Nil(t, agent.Register(&consulapi.AgentServiceRegistration{ID: "service1"}))
+
+	// Features are reached through Retry which wraps the registry
+	retry := NewRetry(NewMemory(), cfg, nil).New(cfg, "", "")
+	assert.Nil(t, retry.Register(&consulapi.AgentServiceRegistration{ID: "service1"}))
+	assert.Nil(t, EnableMaintenance(retry, "service1", "not ready"))
+	status, err := retry.Health("service1")
+	assert.Nil(t, err)
+	assert.Equal(t, consulapi.HealthCritical, status)
+
+	// Registry which implements only the core interface reports unsupported features
+	core := &slowRegistry{Registry: agent}
+	assert.Error(t, UpdateTTL(core, "service:service1", "", consulapi.HealthPassing))
+	assert.Error(t, EnableMaintenance(core, "service1", ""))
+	assert.Error(t, DisableMaintenance(core, "service1"))
+	_, err = Nodes(core)
+	assert.Error(t, err, "An error was expected")
+}
@@ -0,0 +1,152 @@
+package consul
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/warjiang/kube-consul-register/config"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+)
+
+// defaultPool is used by Adapter which has been created without NewAdapter
+var defaultPool = NewPool()
+
+// Pool keeps Consul clients by agent address, so clients and their connections
+// are reused between events. It's safe for concurrent use.
+type Pool struct {
+	mutex     sync.Mutex
+	clients   map[string]*pooledClient
+	transport *http.Transport
+}
+
+type pooledClient struct {
+	client *consulapi.Client
+	config *consulapi.Config
+}
+
+// NewPool returns the empty Pool
+func NewPool() *Pool {
+	return &Pool{
+		clients: make(map[string]*pooledClient),
+	}
+}
+
+// Get returns the client of agent with the given address. The client is created
+// only if there isn't client for this address in the pool.
+func (p *Pool) Get(cfg *config.Config, address string) (*consulapi.Client, *consulapi.Config, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if pooled, ok := p.clients[address]; ok {
+		return pooled.client, pooled.config, nil
+	}
+
+	consulConfig, err := p.newConfig(cfg, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := consulapi.NewClient(consulConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	glog.V(2).Infof("New Consul client for agent %s", address)
+	p.clients[address] = &pooledClient{client: client, config: consulConfig}
+	return client, consulConfig, nil
+}
+
+// Invalidate removes the client of agent with the given address from the pool
+// and closes its idle connections.
+func (p *Pool) Invalidate(address string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pooled, ok := p.clients[address]
+	if !ok {
+		return
+	}
+	glog.V(2).Infof("Invalidate Consul client for agent %s", address)
+	delete(p.clients, address)
+	pooled.config.HttpClient.CloseIdleConnections()
+}
+
+// newConfig builds configuration of the client. The shared `cfg.Consul` is copied
+// and never modified.
+func (p *Pool) newConfig(cfg *config.Config, address string) (*consulapi.Config, error) {
+	uri, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("bad adapter uri: %s", err)
+	}
+
+	var consulConfig consulapi.Config
+	if cfg.Consul != nil {
+		consulConfig = *cfg.Consul
+	} else {
+		consulConfig = *consulapi.DefaultConfig()
+	}
+
+	switch uri.Scheme {
+	case "consul-unix":
+		// Transport for unix socket is set by Consul client
+		consulConfig.Address = strings.TrimPrefix(uri.String(), "consul-")
+		consulConfig.HttpClient = &http.Client{}
+
+	case "https":
+		transport, err := p.pooledTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		consulConfig.Scheme = uri.Scheme
+		consulConfig.HttpClient = &http.Client{Transport: transport}
+		consulConfig.Address = uri.Host
+
+	default:
+		transport, err := p.pooledTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		consulConfig.HttpClient = &http.Client{Transport: transport}
+		consulConfig.Address = uri.Host
+	}
+
+	// Add Token
+	if cfg.Controller.ConsulToken != "" {
+		consulConfig.Token = cfg.Controller.ConsulToken
+	}
+
+	//Timeout
+	consulConfig.HttpClient.Timeout = cfg.Controller.ConsulTimeout
+
+	return &consulConfig, nil
+}
+
+// pooledTransport returns the transport which is shared by all clients of the pool.
+// TLS server name isn't set, so it's taken from the address of each agent.
+func (p *Pool) pooledTransport(cfg *config.Config) (*http.Transport, error) {
+	if p.transport != nil {
+		return p.transport, nil
+	}
+
+	transport := cleanhttp.DefaultPooledTransport()
+	if cfg.Controller.ConsulScheme == "https" {
+		tlsConfig, err := consulapi.SetupTLSConfig(&consulapi.TLSConfig{
+			CAFile:             cfg.Controller.ConsulCAFile,
+			CertFile:           cfg.Controller.ConsulCertFile,
+			KeyFile:            cfg.Controller.ConsulKeyFile,
+			InsecureSkipVerify: cfg.Controller.ConsulInsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot set up Consul TLSConfig: %s", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	p.transport = transport
+	return transport, nil
+}
@@ -0,0 +1,173 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/warjiang/kube-consul-register/config"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Registry has methods to keep services in the service registry.
+// Adapter is the implementation which works with Consul. Optional features of registry
+// are described by TTLUpdater, Maintainer and NodeLister interfaces.
+type Registry interface {
+	// New returns the Registry of agent which is responsible for the given node or pod
+	New(cfg *config.Config, podNodeName string, podIP string) Registry
+	// Register registers new service
+	Register(service *consulapi.AgentServiceRegistration) error
+	// Deregister deregisters a service
+	Deregister(service *consulapi.AgentServiceRegistration) error
+	// List returns all services of agent
+	List() (map[string]*consulapi.AgentService, error)
+	// Health returns the aggregated status of service checks
+	Health(serviceID string) (string, error)
+	// Address returns the address of agent
+	Address() string
+	// Invalidate releases resources kept for agent, it's called when agent disappears
+	Invalidate()
+}
+
+// TTLUpdater is implemented by Registry which keeps TTL checks
+type TTLUpdater interface {
+	// UpdateTTL sets the status of TTL check
+	UpdateTTL(checkID string, output string, status string) error
+}
+
+// Maintainer is implemented by Registry which supports maintenance mode of services
+type Maintainer interface {
+	// EnableMaintenance puts a service into maintenance mode
+	EnableMaintenance(serviceID string, reason string) error
+	// DisableMaintenance takes a service out of maintenance mode
+	DisableMaintenance(serviceID string) error
+}
+
+// NodeLister is implemented by Registry which keeps external nodes, it's used in `catalog` mode
+type NodeLister interface {
+	// Nodes returns names of external nodes
+	Nodes() ([]string, error)
+}
+
+// unsupported returns the error of Registry which doesn't implement the optional feature
+func unsupported(registry Registry, feature string) error {
+	return fmt.Errorf("registry %s doesn't support %s", registry.Address(), feature)
+}
+
+// UpdateTTL sets the status of TTL check if Registry is TTLUpdater
+func UpdateTTL(registry Registry, checkID string, output string, status string) error {
+	updater, ok := registry.(TTLUpdater)
+	if !ok {
+		return unsupported(registry, "TTL checks")
+	}
+	return updater.UpdateTTL(checkID, output, status)
+}
+
+// EnableMaintenance puts a service into maintenance mode if Registry is Maintainer
+func EnableMaintenance(registry Registry, serviceID string, reason string) error {
+	maintainer, ok := registry.(Maintainer)
+	if !ok {
+		return unsupported(registry, "maintenance mode")
+	}
+	return maintainer.EnableMaintenance(serviceID, reason)
+}
+
+// DisableMaintenance takes a service out of maintenance mode if Registry is Maintainer
+func DisableMaintenance(registry Registry, serviceID string) error {
+	maintainer, ok := registry.(Maintainer)
+	if !ok {
+		return unsupported(registry, "maintenance mode")
+	}
+	return maintainer.DisableMaintenance(serviceID)
+}
+
+// Nodes returns names of external nodes if Registry is NodeLister
+func Nodes(registry Registry) ([]string, error) {
+	lister, ok := registry.(NodeLister)
+	if !ok {
+		return nil, unsupported(registry, "external nodes")
+	}
+	return lister.Nodes()
+}
+
+// AgentErr returns the error of agent whose client can't be created, nil is returned for valid agent
+func AgentErr(registry Registry) error {
+	if agent, ok := registry.(interface{ Err() error }); ok {
+		return agent.Err()
+	}
+	return nil
+}
+
+// SkipInvalidAgents removes agents whose client can't be created, so one misconfigured agent
+// doesn't stop listing and cleaning of the others
+func SkipInvalidAgents(agents map[string]Registry) {
+	for agentID, agent := range agents {
+		if err := AgentErr(agent); err != nil {
+			glog.Errorf("Skipping Consul Agent %s: %s", agentID, err)
+			delete(agents, agentID)
+		}
+	}
+}
+
+// InvalidateAgents invalidates agents from the previous list whose address is
+// not used by any agent from the current list.
+func InvalidateAgents(previous map[string]Registry, current map[string]Registry) {
+	addresses := make(map[string]bool)
+	for _, agent := range current {
+		addresses[agent.Address()] = true
+	}
+
+	for _, agent := range previous {
+		if _, ok := addresses[agent.Address()]; !ok {
+			agent.Invalidate()
+			addresses[agent.Address()] = true
+		}
+	}
+}
+
+// AgentServices is the result of listing services of one agent
+type AgentServices struct {
+	Services map[string]*consulapi.AgentService
+	Err      error
+}
+
+// ListAgents lists services of all agents concurrently, so one slow agent delays
+// the result only by its own timeout instead of delaying every agent after it
+func ListAgents(agents map[string]Registry) map[string]AgentServices {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	result := make(map[string]AgentServices, len(agents))
+
+	for agentID, agent := range agents {
+		wg.Add(1)
+		go func(agentID string, agent Registry) {
+			defer wg.Done()
+			services, err := agent.List()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			result[agentID] = AgentServices{Services: services, Err: err}
+		}(agentID, agent)
+	}
+	wg.Wait()
+	return result
+}
+
+// ListErr returns an error if services of any agent couldn't be listed. Callers which mustn't act
+// on services of a part of agents, e.g. before the finalizer is removed, use it to check the result of ListAgents.
+func ListErr(listed map[string]AgentServices) error {
+	var failed []string
+	for agentID, agentServices := range listed {
+		if agentServices.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", agentID, agentServices.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("Can't list services of %d agent(s): %s", len(failed), strings.Join(failed, ", "))
+}
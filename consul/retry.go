@@ -0,0 +1,402 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/warjiang/kube-consul-register/config"
+	"github.com/warjiang/kube-consul-register/metrics"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// These are types of operations which are retried.
+// "RegisterOperation" is a registration of service.
+// "DeregisterOperation" is a deregistration of service.
+const (
+	RegisterOperation   string = "register"
+	DeregisterOperation string = "deregister"
+)
+
+// ErrQueued is wrapped by the error of failed registration or deregistration which has been queued for retry.
+// Callers shouldn't retry the operation themselves, but it hasn't been done yet.
+var ErrQueued = errors.New("operation has been queued for retry")
+
+// Failures counts failed operations on services. Operations queued for retry are counted also separately,
+// so callers know whether they have to retry them themselves.
+type Failures struct {
+	Count  int
+	Queued int
+}
+
+// Add counts the error of operation, nil error is skipped
+func (f *Failures) Add(err error) {
+	if err == nil {
+		return
+	}
+	f.Count++
+	if errors.Is(err, ErrQueued) {
+		f.Queued++
+	}
+}
+
+// Merge counts failures of other operations
+func (f *Failures) Merge(other Failures) {
+	f.Count += other.Count
+	f.Queued += other.Queued
+}
+
+// Err returns the error with the given message if any operation has failed. The error wraps ErrQueued
+// if every failed operation has been queued for retry.
+func (f Failures) Err(format string, args ...interface{}) error {
+	if f.Count == 0 {
+		return nil
+	}
+	err := fmt.Errorf(format, args...)
+	if f.Queued == f.Count {
+		return fmt.Errorf("%w, %w", err, ErrQueued)
+	}
+	return err
+}
+
+// retryTick is a period of time between checks of the queue
+var retryTick = time.Second
+
+// persistTick is a period of time between saves of the changed queue to the store
+var persistTick = 10 * time.Second
+
+// Operation describes the failed write which waits for retry
+type Operation struct {
+	Type        string                              `json:"type"`
+	Agent       string                              `json:"agent"`
+	Node        string                              `json:"node"`
+	IP          string                              `json:"ip"`
+	Service     *consulapi.AgentServiceRegistration `json:"service"`
+	Attempts    int                                 `json:"attempts"`
+	NextAttempt time.Time                           `json:"next_attempt"`
+}
+
+func (o *Operation) key() string {
+	return fmt.Sprintf("%s/%s", o.Agent, o.Service.ID)
+}
+
+// RetryStore persists the queue of operations, so retries survive restart of controller
+type RetryStore interface {
+	Load() ([]*Operation, error)
+	Save(operations []*Operation) error
+}
+
+// Retry is a Registry which queues failed registrations and deregistrations per agent
+// and retries them with capped exponential backoff and jitter.
+type Retry struct {
+	registry Registry
+	queue    *retryQueue
+
+	// node and ip identify agent, so it can be created again after restart
+	node string
+	ip   string
+}
+
+type retryQueue struct {
+	mutex      sync.Mutex
+	registry   Registry
+	cfg        *config.Config
+	store      RetryStore
+	operations map[string]*Operation
+	dirty      bool
+}
+
+// NewRetry returns the Retry which wraps the given Registry. Store is optional.
+func NewRetry(registry Registry, cfg *config.Config, store RetryStore) *Retry {
+	return &Retry{
+		registry: registry,
+		queue: &retryQueue{
+			registry:   registry,
+			cfg:        cfg,
+			store:      store,
+			operations: make(map[string]*Operation),
+		},
+	}
+}
+
+// New returns the Registry of agent which is responsible for the given node or pod
+func (r *Retry) New(cfg *config.Config, podNodeName string, podIP string) Registry {
+	return &Retry{
+		registry: r.registry.New(cfg, podNodeName, podIP),
+		queue:    r.queue,
+		node:     podNodeName,
+		ip:       podIP,
+	}
+}
+
+// Register registers new service, failed registration is queued for retry and its error wraps ErrQueued
+func (r *Retry) Register(service *consulapi.AgentServiceRegistration) error {
+	return r.do(RegisterOperation, service, r.registry.Register)
+}
+
+// Deregister deregisters a service, failed deregistration is queued for retry and its error wraps ErrQueued
+func (r *Retry) Deregister(service *consulapi.AgentServiceRegistration) error {
+	return r.do(DeregisterOperation, service, r.registry.Deregister)
+}
+
+func (r *Retry) do(operationType string, service *consulapi.AgentServiceRegistration, fn func(*consulapi.AgentServiceRegistration) error) error {
+	operation := &Operation{
+		Type:    operationType,
+		Agent:   r.registry.Address(),
+		Node:    r.node,
+		IP:      r.ip,
+		Service: service,
+	}
+
+	err := fn(service)
+	if err != nil {
+		r.queue.add(operation, err)
+		return fmt.Errorf("%w: %w", ErrQueued, err)
+	}
+	// The latest operation supersedes the queued one
+	r.queue.remove(operation.key())
+	return nil
+}
+
+// List returns all services of agent
+func (r *Retry) List() (map[string]*consulapi.AgentService, error) {
+	return r.registry.List()
+}
+
+// Health returns the aggregated status of service checks
+func (r *Retry) Health(serviceID string) (string, error) {
+	return r.registry.Health(serviceID)
+}
+
+// UpdateTTL sets the status of TTL check, it's not retried as the next update supersedes it
+func (r *Retry) UpdateTTL(checkID string, output string, status string) error {
+	return UpdateTTL(r.registry, checkID, output, status)
+}
+
+// EnableMaintenance puts a service into maintenance mode, it's not retried as the next update supersedes it
+func (r *Retry) EnableMaintenance(serviceID string, reason string) error {
+	return EnableMaintenance(r.registry, serviceID, reason)
+}
+
+// DisableMaintenance takes a service out of maintenance mode
+func (r *Retry) DisableMaintenance(serviceID string) error {
+	return DisableMaintenance(r.registry, serviceID)
+}
+
+// Nodes returns names of external nodes
+func (r *Retry) Nodes() ([]string, error) {
+	return Nodes(r.registry)
+}
+
+// Err returns the error of agent whose client can't be created
+func (r *Retry) Err() error {
+	return AgentErr(r.registry)
+}
+
+// Address returns the address of agent
+func (r *Retry) Address() string {
+	return r.registry.Address()
+}
+
+// Invalidate drops queued operations of agent and releases its resources
+func (r *Retry) Invalidate() {
+	r.queue.drop(r.registry.Address())
+	r.registry.Invalidate()
+}
+
+// Run loads persisted operations and retries queued operations until stop is closed.
+// Changes of the queue are persisted every persistTick and on stop.
+func (r *Retry) Run(stop <-chan struct{}) {
+	r.queue.load()
+
+	ticker := time.NewTicker(retryTick)
+	defer ticker.Stop()
+	persistTicker := time.NewTicker(persistTick)
+	defer persistTicker.Stop()
+	for {
+		select {
+		case <-stop:
+			r.queue.persist()
+			return
+		case <-ticker.C:
+			r.queue.retry(time.Now())
+		case <-persistTicker.C:
+			r.queue.persist()
+		}
+	}
+}
+
+func (q *retryQueue) add(operation *Operation, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	operation.NextAttempt = time.Now().Add(q.backoff(0))
+	glog.Warningf("Queue %s of service %s on agent %s for retry: %s", operation.Type, operation.Service.ID, operation.Agent, err)
+	queued, ok := q.operations[operation.key()]
+	q.operations[operation.key()] = operation
+	// Store is written only when the set of operations changes, not on every failure of the same operation
+	if !ok || queued.Type != operation.Type {
+		q.changed()
+	}
+}
+
+func (q *retryQueue) remove(key string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.operations[key]; !ok {
+		return
+	}
+	delete(q.operations, key)
+	q.changed()
+}
+
+func (q *retryQueue) drop(agent string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var dropped bool
+	for key, operation := range q.operations {
+		if operation.Agent == agent {
+			glog.Warningf("Drop %s of service %s, agent %s has disappeared", operation.Type, operation.Service.ID, operation.Agent)
+			delete(q.operations, key)
+			dropped = true
+		}
+	}
+	if dropped {
+		q.changed()
+	}
+}
+
+// retry performs operations whose time has come
+func (q *retryQueue) retry(now time.Time) {
+	var due []*Operation
+
+	q.mutex.Lock()
+	for _, operation := range q.operations {
+		if !operation.NextAttempt.After(now) {
+			due = append(due, operation)
+		}
+	}
+	q.mutex.Unlock()
+
+	for _, operation := range due {
+		agent := q.registry.New(q.cfg, operation.Node, operation.IP)
+
+		var err error
+		if operation.Type == RegisterOperation {
+			err = agent.Register(operation.Service)
+		} else {
+			err = agent.Deregister(operation.Service)
+		}
+
+		q.mutex.Lock()
+		// Skip result if operation has been superseded in the meantime
+		if q.operations[operation.key()] != operation {
+			q.mutex.Unlock()
+			continue
+		}
+
+		operation.Attempts++
+		if err != nil {
+			metrics.RetryAttempts.WithLabelValues(operation.Type, "failure", operation.Agent).Inc()
+			if q.cfg.Controller.RetryMaxAttempts > 0 && operation.Attempts >= q.cfg.Controller.RetryMaxAttempts {
+				glog.Errorf("Giving up %s of service %s after %d attempts: %s", operation.Type, operation.Service.ID, operation.Attempts, err)
+				delete(q.operations, operation.key())
+				q.changed()
+			} else {
+				glog.Warningf("Retry of %s of service %s failed, attempt %d: %s", operation.Type, operation.Service.ID, operation.Attempts, err)
+				operation.NextAttempt = now.Add(q.backoff(operation.Attempts))
+			}
+		} else {
+			metrics.RetryAttempts.WithLabelValues(operation.Type, "success", operation.Agent).Inc()
+			glog.Infof("Retry of %s of service %s succeeded, attempt %d", operation.Type, operation.Service.ID, operation.Attempts)
+			delete(q.operations, operation.key())
+			q.changed()
+		}
+		q.mutex.Unlock()
+	}
+}
+
+// backoff returns delay before the next attempt. The delay is doubled
+// with every attempt up to `retry_max_interval`, half of delay is random.
+func (q *retryQueue) backoff(attempts int) time.Duration {
+	delay := q.cfg.Controller.RetryMaxInterval
+	if attempts < 32 && q.cfg.Controller.RetryInitialInterval<<uint(attempts) < delay {
+		delay = q.cfg.Controller.RetryInitialInterval << uint(attempts)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// changed updates metrics and marks the queue to persist when operations are added or removed.
+// Attempts aren't persisted on every failure, so they may be lower after restart.
+// It has to be called with locked mutex.
+func (q *retryQueue) changed() {
+	depth := make(map[string]float64)
+	for _, operation := range q.operations {
+		depth[operation.Agent]++
+	}
+
+	metrics.RetryQueueDepth.Reset()
+	for agent, value := range depth {
+		metrics.RetryQueueDepth.WithLabelValues(agent).Set(value)
+	}
+	q.dirty = true
+}
+
+// persist saves the queue if it has been changed since the last save
+func (q *retryQueue) persist() {
+	if q.store == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	if !q.dirty {
+		q.mutex.Unlock()
+		return
+	}
+	var operations []*Operation
+	for _, operation := range q.operations {
+		copied := *operation
+		operations = append(operations, &copied)
+	}
+	q.dirty = false
+	q.mutex.Unlock()
+
+	if err := q.store.Save(operations); err != nil {
+		glog.Errorf("Can't persist retry queue: %s", err)
+		q.mutex.Lock()
+		q.dirty = true
+		q.mutex.Unlock()
+	}
+}
+
+func (q *retryQueue) load() {
+	if q.store == nil {
+		return
+	}
+
+	operations, err := q.store.Load()
+	if err != nil {
+		glog.Errorf("Can't load retry queue: %s", err)
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, operation := range operations {
+		if _, ok := q.operations[operation.key()]; ok {
+			continue
+		}
+		q.operations[operation.key()] = operation
+	}
+	glog.Infof("Loaded %d operations to retry", len(operations))
+	q.changed()
+}
@@ -0,0 +1,78 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// retryStoreKey is a key of ConfigMap data with queued operations
+const retryStoreKey string = "operations"
+
+// ConfigMapStore persists queued operations in ConfigMap
+type ConfigMapStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapStore returns the ConfigMapStore
+func NewConfigMapStore(clientset kubernetes.Interface, namespace string, name string) *ConfigMapStore {
+	return &ConfigMapStore{
+		clientset: clientset,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Load returns operations from ConfigMap, lack of ConfigMap means empty queue
+func (s *ConfigMapStore) Load() ([]*Operation, error) {
+	var operations []*Operation
+
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return operations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := configMap.Data[retryStoreKey]; ok && value != "" {
+		if err := json.Unmarshal([]byte(value), &operations); err != nil {
+			return nil, err
+		}
+	}
+	return operations, nil
+}
+
+// Save writes operations to ConfigMap, ConfigMap is created if it doesn't exist
+func (s *ConfigMapStore) Save(operations []*Operation) error {
+	data, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace},
+			Data:       map[string]string{retryStoreKey: string(data)},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[retryStoreKey] = string(data)
+	_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
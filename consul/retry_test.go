@@ -0,0 +1,219 @@
+package consul
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/warjiang/kube-consul-register/config"
+)
+
+// failingRegistry fails every write while fail is set
+type failingRegistry struct {
+	*Memory
+	fail *bool
+}
+
+func (f *failingRegistry) New(cfg *config.Config, podNodeName string, podIP string) Registry {
+	return &failingRegistry{Memory: f.Memory.New(cfg, podNodeName, podIP).(*Memory), fail: f.fail}
+}
+
+func (f *failingRegistry) Register(service *consulapi.AgentServiceRegistration) error {
+	if *f.fail {
+		return fmt.Errorf("connection refused")
+	}
+	return f.Memory.Register(service)
+}
+
+func (f *failingRegistry) Deregister(service *consulapi.AgentServiceRegistration) error {
+	if *f.fail {
+		return fmt.Errorf("connection refused")
+	}
+	return f.Memory.Deregister(service)
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulScheme:         "http",
+			ConsulPort:           "8500",
+			RegisterMode:         config.RegisterNodeMode,
+			RetryInitialInterval: time.Second,
+			RetryMaxInterval:     time.Minute,
+		},
+	}
+
+	fail := true
+	retry := NewRetry(&failingRegistry{Memory: NewMemory(), fail: &fail}, cfg, nil)
+	agent := retry.New(cfg, "node1", "")
+
+	service := &consulapi.AgentServiceRegistration{ID: "service1", Name: "service"}
+	assert.ErrorIs(t, agent.Register(service), ErrQueued)
+	assert.Len(t, retry.queue.operations, 1)
+
+	// Failed retry is kept in the queue
+	retry.queue.retry(time.Now().Add(time.Hour))
+	assert.Len(t, retry.queue.operations, 1)
+	for _, operation := range retry.queue.operations {
+		assert.Equal(t, 1, operation.Attempts)
+		assert.Equal(t, "node1", operation.Node)
+	}
+
+	// Successful retry removes operation from the queue
+	fail = false
+	retry.queue.retry(time.Now().Add(2 * time.Hour))
+	assert.Len(t, retry.queue.operations, 0)
+	services, _ := agent.List()
+	assert.Contains(t, services, "service1")
+
+	// The latest operation supersedes the queued one
+	fail = true
+	assert.Error(t, agent.Deregister(service))
+	assert.Len(t, retry.queue.operations, 1)
+	fail = false
+	assert.Nil(t, agent.Register(service))
+	assert.Len(t, retry.queue.operations, 0)
+
+	// Operations of disappeared agent are dropped
+	fail = true
+	assert.Error(t, agent.Deregister(service))
+	agent.Invalidate()
+	assert.Len(t, retry.queue.operations, 0)
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			RegisterMode:         config.RegisterSingleMode,
+			RetryInitialInterval: time.Second,
+			RetryMaxInterval:     time.Minute,
+			RetryMaxAttempts:     2,
+		},
+	}
+
+	fail := true
+	retry := NewRetry(&failingRegistry{Memory: NewMemory(), fail: &fail}, cfg, nil)
+	assert.Error(t, retry.New(cfg, "", "").Register(&consulapi.AgentServiceRegistration{ID: "service1"}))
+
+	retry.queue.retry(time.Now().Add(time.Hour))
+	assert.Len(t, retry.queue.operations, 1)
+	retry.queue.retry(time.Now().Add(2 * time.Hour))
+	assert.Len(t, retry.queue.operations, 0)
+}
+
+// countingStore counts saves of the queue
+type countingStore struct {
+	saves int
+}
+
+func (c *countingStore) Load() ([]*Operation, error) {
+	return nil, nil
+}
+
+func (c *countingStore) Save(operations []*Operation) error {
+	c.saves++
+	return nil
+}
+
+func TestRetryPersist(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			RegisterMode:         config.RegisterSingleMode,
+			RetryInitialInterval: time.Second,
+			RetryMaxInterval:     time.Minute,
+		},
+	}
+
+	fail := true
+	store := &countingStore{}
+	retry := NewRetry(&failingRegistry{Memory: NewMemory(), fail: &fail}, cfg, store)
+	agent := retry.New(cfg, "", "")
+	service := &consulapi.AgentServiceRegistration{ID: "service1"}
+
+	assert.ErrorIs(t, agent.Register(service), ErrQueued)
+	retry.queue.persist()
+	assert.Equal(t, 1, store.saves)
+
+	// Failures of queued operation don't rewrite the store
+	assert.ErrorIs(t, agent.Register(service), ErrQueued)
+	retry.queue.retry(time.Now().Add(time.Hour))
+	retry.queue.persist()
+	assert.Equal(t, 1, store.saves)
+
+	// Operation superseded by another type is saved
+	assert.ErrorIs(t, agent.Deregister(service), ErrQueued)
+	retry.queue.persist()
+	assert.Equal(t, 2, store.saves)
+
+	// Removal of operation is saved
+	fail = false
+	retry.queue.retry(time.Now().Add(2 * time.Hour))
+	retry.queue.persist()
+	assert.Equal(t, 3, store.saves)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+
+	queue := &retryQueue{cfg: &config.Config{
+		Controller: &config.ControllerConfig{
+			RetryInitialInterval: time.Second,
+			RetryMaxInterval:     time.Minute,
+		},
+	}}
+
+	for attempts, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		delay := queue.backoff(attempts)
+		assert.True(t, delay >= max/2 && delay <= max, "delay %s out of range for attempt %d", delay, attempts)
+	}
+
+	// Delay is capped
+	delay := queue.backoff(100)
+	assert.True(t, delay >= 30*time.Second && delay <= time.Minute, "delay %s isn't capped", delay)
+}
+
+func TestConfigMapStore(t *testing.T) {
+	t.Parallel()
+
+	store := NewConfigMapStore(fake.NewSimpleClientset(), "default", "retry")
+
+	operations, err := store.Load()
+	assert.Nil(t, err)
+	assert.Len(t, operations, 0)
+
+	err = store.Save([]*Operation{{
+		Type:     DeregisterOperation,
+		Agent:    "node1:8500",
+		Node:     "node1",
+		Service:  &consulapi.AgentServiceRegistration{ID: "service1"},
+		Attempts: 3,
+	}})
+	assert.Nil(t, err)
+
+	// Second save updates existing ConfigMap
+	err = store.Save([]*Operation{{
+		Type:     RegisterOperation,
+		Agent:    "node1:8500",
+		Node:     "node1",
+		Service:  &consulapi.AgentServiceRegistration{ID: "service2"},
+		Attempts: 1,
+	}})
+	assert.Nil(t, err)
+
+	operations, err = store.Load()
+	assert.Nil(t, err)
+	assert.Len(t, operations, 1)
+	assert.Equal(t, RegisterOperation, operations[0].Type)
+	assert.Equal(t, "service2", operations[0].Service.ID)
+	assert.Equal(t, 1, operations[0].Attempts)
+}
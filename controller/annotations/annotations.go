@@ -0,0 +1,116 @@
+package annotations
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// These are annotations names which have the same meaning for every register source.
+// "ServiceNameAnnotation" is a name of service in Consul.
+// "ServiceTagsAnnotation" is a list of tags (separated by comma).
+// "ServiceMetaPrefixAnnotation" is a prefix of annotations which are added to service meta.
+// "ServiceHealth*Annotation" describe the health check of service.
+const (
+	ServiceNameAnnotation            string = "consul.register/service.name"
+	ServiceTagsAnnotation            string = "consul.register/service.tags"
+	ServiceMetaPrefixAnnotation      string = "consul.register/service.meta."
+	ServiceHealthPrefixAnnotation    string = "consul.register/service.health."
+	ServiceHealthIntervalAnnotation  string = "consul.register/service.health.interval"
+	ServiceHealthTimeoutAnnotation   string = "consul.register/service.health.timeout"
+	ServiceHealthCheckPathAnnotation string = "consul.register/service.health.path"
+	ServiceHealthHostAnnotation      string = "consul.register/service.health.host"
+	ServiceHealthPortAnnotation      string = "consul.register/service.health.port"
+	ServiceHealthTTLAnnotation       string = "consul.register/service.health.ttl"
+	ServiceHealthTCPAnnotation       string = "consul.register/service.health.tcp"
+)
+
+// Name returns the name of service which is given in `service.name` annotation
+func Name(annotations map[string]string) (string, bool) {
+	value, ok := annotations[ServiceNameAnnotation]
+	return value, ok && value != ""
+}
+
+// Tags returns tags which are given in `service.tags` annotation,
+// e.g. "tag1,tag2,tag3" results in ["tag1","tag2","tag3"]
+func Tags(annotations map[string]string) []string {
+	value, ok := annotations[ServiceTagsAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Meta returns meta which is given in `service.meta.<key>` annotations
+func Meta(annotations map[string]string) map[string]string {
+	meta := make(map[string]string)
+	for key, value := range annotations {
+		if strings.HasPrefix(key, ServiceMetaPrefixAnnotation) {
+			meta[strings.TrimPrefix(key, ServiceMetaPrefixAnnotation)] = value
+		}
+	}
+	return meta
+}
+
+// HasHealthCheck checks whether any `service.health.*` annotation is given
+func HasHealthCheck(annotations map[string]string) bool {
+	for key := range annotations {
+		if strings.HasPrefix(key, ServiceHealthPrefixAnnotation) {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthCheck returns the check of service which is described by `service.health.*` annotations.
+// HTTP check of `/` path on the address and port of service is returned if type of check is not given.
+func HealthCheck(annotations map[string]string, address string, port int32) (*consulapi.AgentServiceCheck, error) {
+	check := &consulapi.AgentServiceCheck{}
+	check.Interval = "10s"
+	check.Timeout = "90s"
+	if value, ok := annotations[ServiceHealthIntervalAnnotation]; ok {
+		check.Interval = fmt.Sprintf("%ss", value)
+	}
+	if value, ok := annotations[ServiceHealthTimeoutAnnotation]; ok {
+		check.Timeout = fmt.Sprintf("%ss", value)
+	}
+
+	healthHost := address
+	if value, ok := annotations[ServiceHealthHostAnnotation]; ok {
+		healthHost = value
+	}
+
+	healthPort := port
+	if value, ok := annotations[ServiceHealthPortAnnotation]; ok {
+		annotationPort, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Can't convert value of %s annotation: %s", ServiceHealthPortAnnotation, err)
+		}
+		healthPort = int32(annotationPort)
+	}
+
+	healthPath := "/"
+	if value, ok := annotations[ServiceHealthCheckPathAnnotation]; ok {
+		healthPath = value
+		check.HTTP = fmt.Sprintf("%s://%s:%d%s", "http", healthHost, healthPort, healthPath)
+	} else if value, ok := annotations[ServiceHealthTTLAnnotation]; ok {
+		check.TTL = value
+		// TTL check is updated by application, so interval and timeout are not used
+		check.Interval = ""
+		check.Timeout = ""
+	} else if value, ok := annotations[ServiceHealthTCPAnnotation]; ok && value != "" {
+		check.TCP = fmt.Sprintf("%s:%d", healthHost, healthPort)
+	} else {
+		check.HTTP = fmt.Sprintf("%s://%s:%d%s", "http", healthHost, healthPort, healthPath)
+	}
+	return check, nil
+}
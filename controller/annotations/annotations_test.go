@@ -0,0 +1,57 @@
+package annotations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotations(t *testing.T) {
+	t.Parallel()
+
+	annotations := map[string]string{
+		"consul.register/service.name":     "servicename",
+		"consul.register/service.tags":     "tag1, tag2,,tag3",
+		"consul.register/service.meta.abc": "123",
+	}
+
+	name, ok := Name(annotations)
+	assert.True(t, ok)
+	assert.Equal(t, "servicename", name)
+	_, ok = Name(nil)
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"tag1", "tag2", "tag3"}, Tags(annotations))
+	assert.Nil(t, Tags(nil))
+	assert.Equal(t, map[string]string{"abc": "123"}, Meta(annotations))
+	assert.False(t, HasHealthCheck(annotations))
+}
+
+func TestHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	check, err := HealthCheck(nil, "10.0.0.1", 80)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://10.0.0.1:80/", check.HTTP)
+	assert.Equal(t, "10s", check.Interval)
+
+	annotations := map[string]string{
+		"consul.register/service.health.path":     "/ping",
+		"consul.register/service.health.port":     "8080",
+		"consul.register/service.health.interval": "5",
+	}
+	assert.True(t, HasHealthCheck(annotations))
+	check, _ = HealthCheck(annotations, "10.0.0.1", 80)
+	assert.Equal(t, "http://10.0.0.1:8080/ping", check.HTTP)
+	assert.Equal(t, "5s", check.Interval)
+
+	check, _ = HealthCheck(map[string]string{"consul.register/service.health.tcp": "true"}, "10.0.0.1", 80)
+	assert.Equal(t, "10.0.0.1:80", check.TCP)
+
+	check, _ = HealthCheck(map[string]string{"consul.register/service.health.ttl": "30s"}, "10.0.0.1", 80)
+	assert.Equal(t, "30s", check.TTL)
+	assert.Equal(t, "", check.Interval)
+
+	_, err = HealthCheck(map[string]string{"consul.register/service.health.port": "http"}, "10.0.0.1", 80)
+	assert.Error(t, err, "An error was expected")
+}
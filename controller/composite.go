@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"errors"
+	"sync"
+)
+
+// Composite runs several controllers as one FactoryAdapter.
+// Every controller cleans only services registered by its own source.
+type Composite []FactoryAdapter
+
+// Watch watches events of all controllers
+func (c Composite) Watch() {
+	var wg sync.WaitGroup
+	for _, ctr := range c {
+		wg.Add(1)
+		go func(ctr FactoryAdapter) {
+			defer wg.Done()
+			ctr.Watch()
+		}(ctr)
+	}
+	wg.Wait()
+}
+
+// Sync synchronizes services of all controllers, an error of one controller doesn't stop the others
+func (c Composite) Sync() error {
+	var errs []error
+	for _, ctr := range c {
+		if err := ctr.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Clean cleans services of all controllers, an error of one controller doesn't stop the others
+func (c Composite) Clean() error {
+	var errs []error
+	for _, ctr := range c {
+		if err := ctr.Clean(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeController struct {
+	watched, synced, cleaned bool
+	err                      error
+}
+
+func (f *fakeController) Watch() {
+	f.watched = true
+}
+
+func (f *fakeController) Sync() error {
+	f.synced = true
+	return f.err
+}
+
+func (f *fakeController) Clean() error {
+	f.cleaned = true
+	return f.err
+}
+
+func TestComposite(t *testing.T) {
+	t.Parallel()
+
+	failing := &fakeController{err: fmt.Errorf("failure")}
+	working := &fakeController{}
+	composite := Composite{failing, working}
+
+	composite.Watch()
+	assert.True(t, failing.watched)
+	assert.True(t, working.watched)
+
+	// An error of one controller doesn't stop the others
+	assert.EqualError(t, composite.Sync(), "failure")
+	assert.True(t, working.synced)
+
+	assert.EqualError(t, composite.Clean(), "failure")
+	assert.True(t, working.cleaned)
+
+	assert.Nil(t, Composite{working}.Sync())
+}
@@ -4,24 +4,38 @@ import (
 	"github.com/warjiang/kube-consul-register/config"
 	"github.com/warjiang/kube-consul-register/consul"
 	"github.com/warjiang/kube-consul-register/controller/endpoints"
+	"github.com/warjiang/kube-consul-register/controller/endpointslices"
 	"github.com/warjiang/kube-consul-register/controller/pods"
 	"github.com/warjiang/kube-consul-register/controller/services"
 
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 )
 
 // Factory has a method to return a FactoryAdapter
 type Factory struct{}
 
-// New creates an instance of controller
-func (f *Factory) New(clientset *kubernetes.Clientset, consulInstance consul.Adapter, cfg *config.Config, namespace string) FactoryAdapter {
+// New creates an instance of controller. The informerFactory has to be started after
+// the controller is created, so informers used by the controller are started too.
+// If several sources are given in `register_source` option, the composite of controllers is returned.
+func (f *Factory) New(clientset kubernetes.Interface, informerFactory kubeinformers.SharedInformerFactory, consulInstance consul.Registry, cfg *config.Config, namespace string) FactoryAdapter {
+	var controllers Composite
 
-	switch source := cfg.Controller.RegisterSource; source {
-	case "service":
-		return services.New(clientset, consulInstance, cfg, namespace)
-	case "endpoint":
-		return endpoints.New(clientset, consulInstance, cfg, namespace)
-	default:
-		return pods.New(clientset, consulInstance, cfg, namespace)
+	for _, source := range cfg.Controller.RegisterSources {
+		switch source {
+		case config.RegisterSourceService:
+			controllers = append(controllers, services.New(clientset, informerFactory, consulInstance, cfg, namespace))
+		case config.RegisterSourceEndpoint:
+			controllers = append(controllers, endpoints.New(clientset, informerFactory, consulInstance, cfg, namespace))
+		case config.RegisterSourceEndpointSlice:
+			controllers = append(controllers, endpointslices.New(clientset, informerFactory, consulInstance, cfg, namespace))
+		default:
+			controllers = append(controllers, pods.New(clientset, informerFactory, consulInstance, cfg, namespace))
+		}
 	}
+
+	if len(controllers) == 1 {
+		return controllers[0]
+	}
+	return controllers
 }
@@ -1,24 +1,29 @@
 package endpoints
 
 import (
-	"context"
 	"fmt"
 	"k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"strconv"
 	"sync"
-	"time"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/warjiang/kube-consul-register/config"
 	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/annotations"
+	"github.com/warjiang/kube-consul-register/controller/events"
+	"github.com/warjiang/kube-consul-register/controller/finalizer"
+	"github.com/warjiang/kube-consul-register/controller/informers"
+	"github.com/warjiang/kube-consul-register/controller/queue"
 	"github.com/warjiang/kube-consul-register/metrics"
 	"github.com/warjiang/kube-consul-register/utils"
 
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 
 	consulapi "github.com/hashicorp/consul/api"
@@ -30,67 +35,113 @@ const (
 	ConsulRegisterEnabledAnnotation string = "consul.register/enabled"
 )
 
+// addedEndpoints is shared by all workers of the queue
 var (
-	addedEndpoints = make(map[types.UID]bool)
+	addedEndpoints sync.Map
 
-	consulAgents map[string]*consul.Adapter
+	consulAgents map[string]consul.Registry
 )
 
 // Controller describes the attributes that are uses by Controller
 type Controller struct {
-	clientset      *kubernetes.Clientset
-	consulInstance consul.Adapter
+	clientset      kubernetes.Interface
+	consulInstance consul.Registry
 	cfg            *config.Config
 	namespace      string
 	mutex          *sync.Mutex
+
+	queue             *queue.Queue
+	endpointsInformer cache.SharedIndexInformer
+	endpointsLister   corelisters.EndpointsLister
+	podLister         corelisters.PodLister
+	// nodeLister is set only in `node` mode
+	nodeLister corelisters.NodeLister
+	// deleted keeps the last known state of deleted endpoints until they are reconciled,
+	// reconciled keeps the last reconciled state of endpoints which is compared with the current one.
+	deleted    sync.Map
+	reconciled sync.Map
+	// recorder records events about registration of endpoints
+	recorder *events.Recorder
 }
 
-// New creates an instance of controller
-func New(clientset *kubernetes.Clientset, consulInstance consul.Adapter, cfg *config.Config, namespace string) FactoryAdapter {
-	return &Controller{
-		clientset:      clientset,
-		consulInstance: consulInstance,
-		cfg:            cfg,
-		namespace:      namespace,
-		mutex:          &sync.Mutex{}}
+// New creates an instance of controller. Informers are taken from the informerFactory,
+// which has to be started and synced before the controller is used.
+func New(clientset kubernetes.Interface, informerFactory kubeinformers.SharedInformerFactory, consulInstance consul.Registry, cfg *config.Config, namespace string) FactoryAdapter {
+	endpointsInformer := informers.Endpoints(informerFactory)
+
+	c := &Controller{
+		clientset:         clientset,
+		consulInstance:    consulInstance,
+		cfg:               cfg,
+		namespace:         namespace,
+		mutex:             &sync.Mutex{},
+		endpointsInformer: endpointsInformer.Informer(),
+		endpointsLister:   endpointsInformer.Lister(),
+		podLister:         informers.Pods(informerFactory).Lister(),
+		recorder:          events.NewRecorder(clientset)}
+	if cfg.Controller.RegisterMode == config.RegisterNodeMode {
+		c.nodeLister = informers.Nodes(informerFactory).Lister()
+	}
+	c.queue = queue.New("endpoints", c.reconcile)
+	return c
 }
 
-func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
-	ctx := context.TODO()
-	consulAgents = make(map[string]*consul.Adapter)
+func (c *Controller) cacheConsulAgent() (map[string]consul.Registry, error) {
+	agents := make(map[string]consul.Registry)
 	//Cache Consul's Agents
 	if c.cfg.Controller.RegisterMode == config.RegisterSingleMode {
 		consulAgent := c.consulInstance.New(c.cfg, "", "")
-		consulAgents[c.cfg.Controller.ConsulAddress] = consulAgent
+		agents[c.cfg.Controller.ConsulAddress] = consulAgent
 
 	} else if c.cfg.Controller.RegisterMode == config.RegisterNodeMode {
-		nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
-			LabelSelector: c.cfg.Controller.ConsulNodeSelector,
-		})
+		selector, err := labels.Parse(c.cfg.Controller.ConsulNodeSelector)
+		if err != nil {
+			return agents, err
+		}
+		nodes, err := c.nodeLister.List(selector)
 		if err != nil {
-			return consulAgents, err
+			return agents, err
 		}
 
-		for _, node := range nodes.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
-			consulAgents[node.ObjectMeta.Name] = consulAgent
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+			agents[node.ObjectMeta.Name] = consulAgent
 		}
 	} else if c.cfg.Controller.RegisterMode == config.RegisterPodMode {
-		pods, err := c.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
-			LabelSelector: c.cfg.Controller.PodLabelSelector,
-		})
+		selector, err := labels.Parse(c.cfg.Controller.PodLabelSelector)
 		if err != nil {
-			return consulAgents, err
+			return agents, err
 		}
-		for _, pod := range pods.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, "", pod.Status.HostIP)
-			consulAgents[pod.Status.HostIP] = consulAgent
+		pods, err := c.podLister.List(selector)
+		if err != nil {
+			return agents, err
+		}
+		for _, pod := range pods {
+			consulAgent := c.consulInstance.New(c.cfg, "", pod.Status.HostIP)
+			agents[pod.Status.HostIP] = consulAgent
+		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		// Every synthetic node in the catalog is treated as separate agent
+		nodes, err := consul.Nodes(c.consulInstance.New(c.cfg, "", ""))
+		if err != nil {
+			return agents, err
+		}
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, node, "")
+			agents[node] = consulAgent
 		}
 	}
 
-	return consulAgents, nil
+	consul.SkipInvalidAgents(agents)
+
+	// Drop clients of agents which have disappeared. The lock is held only while
+	// the cached agents are swapped, so listing of agents doesn't block each other.
+	c.mutex.Lock()
+	consul.InvalidateAgents(consulAgents, agents)
+	consulAgents = agents
+	c.mutex.Unlock()
+
+	return agents, nil
 }
 
 // Clean checks Consul services and remove them if service does not appear in K8S cluster
@@ -98,42 +149,87 @@ func (c *Controller) Clean() error {
 	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("clean"))
 	defer timer.ObserveDuration()
 
-	var err error
-
-	c.mutex.Lock()
-
-	consulAgents, err = c.cacheConsulAgent()
+	agents, err := c.cacheConsulAgent()
 	if err != nil {
-		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
 	}
 	// Get list of added Consul' services
-	addedConsulServices, registeredEndpoints, err := c.getAddedConsulServices()
+	listedAgents := consul.ListAgents(agents)
+	addedConsulServices, registeredEndpoints, _, err := c.getAddedConsulServices(listedAgents)
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 
-	endpoints, err := c.clientset.CoreV1().Endpoints("").List(context.TODO(), metav1.ListOptions{})
+	endpoints, err := c.endpointsLister.Endpoints(c.namespace).List(labels.Everything())
 	if err != nil {
 		return err
 	}
 
-	for _, endpoint := range endpoints.Items {
-		if !isRegisterEnabled(&endpoint) {
+	var currentServices = make(map[string]bool)
+	for _, endpoint := range endpoints {
+		// Deleted endpoints aren't registered again, they're reconciled only to remove their finalizer
+		if endpoint.ObjectMeta.DeletionTimestamp != nil {
+			if finalizer.Has(endpoint) {
+				c.queue.Add(endpoint)
+			}
+			continue
+		}
+		if !isRegisterEnabled(endpoint) {
 			continue
 		}
 
 		for _, subset := range endpoint.Subsets {
 			for _, address := range subset.Addresses {
-				addedEndpoints[address.TargetRef.UID] = true
+				addedEndpoints.Store(address.TargetRef.UID, true)
+				for _, port := range subset.Ports {
+					currentServices[c.serviceID(endpoint, address, port)] = true
+				}
 			}
 		}
 	}
 
+	// Remove services of existing endpoints which have been registered with other ID,
+	// e.g. before `service_id_template` option has been changed
+	for uid, services := range registeredEndpoints {
+		if _, ok := addedEndpoints.Load(types.UID(uid)); !ok {
+			continue
+		}
+		for _, serviceID := range services {
+			if _, ok := currentServices[serviceID]; ok {
+				continue
+			}
+			service := &consulapi.AgentServiceRegistration{ID: serviceID}
+			if err := agents[addedConsulServices[serviceID]].Deregister(service); err != nil {
+				glog.Errorf("Can't deregister service: %s", err)
+				continue
+			}
+			glog.Infof("Service's been deregistered, ID: %s", service.ID)
+			delete(addedConsulServices, service.ID)
+		}
+	}
+
+	// Remove services of existing endpoints which have been registered by older versions with `<pod>-<port>` ID.
+	// Such services aren't owned unless `adopt_legacy` option is on, but UID of their POD is unique.
+	for uid, services := range c.getLegacyConsulServices(listedAgents) {
+		if _, ok := addedEndpoints.Load(types.UID(uid)); !ok {
+			continue
+		}
+		for serviceID, consulAgentID := range services {
+			if _, ok := currentServices[serviceID]; ok {
+				continue
+			}
+			service := &consulapi.AgentServiceRegistration{ID: serviceID}
+			if err := agents[consulAgentID].Deregister(service); err != nil {
+				glog.Errorf("Can't deregister service: %s", err)
+				continue
+			}
+			glog.Infof("Service with legacy ID's been deregistered, ID: %s", service.ID)
+		}
+	}
+
 	// Remove useless services
 	for uid, services := range registeredEndpoints {
-		if _, ok := addedEndpoints[types.UID(uid)]; !ok {
+		if _, ok := addedEndpoints.Load(types.UID(uid)); !ok {
 			for _, serviceID := range services {
 				glog.Infof("Deletion of endpoint with UID %s (POD: %s)", uid, serviceID)
 				// check if there consul agent instance
@@ -142,7 +238,7 @@ func (c *Controller) Clean() error {
 					continue
 				}
 				service := &consulapi.AgentServiceRegistration{ID: serviceID}
-				err := consulAgents[addedConsulServices[serviceID]].Deregister(service)
+				err := agents[addedConsulServices[serviceID]].Deregister(service)
 				if err != nil {
 					glog.Errorf("Can't deregister service: %s", err)
 					continue
@@ -152,11 +248,10 @@ func (c *Controller) Clean() error {
 				delete(addedConsulServices, service.ID)
 
 			}
-			delete(addedEndpoints, types.UID(uid))
+			addedEndpoints.Delete(types.UID(uid))
 		}
 	}
 
-	c.mutex.Unlock()
 	return nil
 }
 
@@ -165,108 +260,196 @@ func (c *Controller) Sync() error {
 	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("sync"))
 	defer timer.ObserveDuration()
 
-	var err error
-
-	c.mutex.Lock()
-
-	consulAgents, err = c.cacheConsulAgent()
+	agents, err := c.cacheConsulAgent()
 	if err != nil {
-		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
 	}
-	glog.V(2).Infof("Agents: %#v", consulAgents)
+	glog.V(2).Infof("Agents: %#v", agents)
 
 	// Get list of added Consul' services
-	addedConsulServices, _, err := c.getAddedConsulServices()
+	addedConsulServices, _, consulServices, err := c.getAddedConsulServices(consul.ListAgents(agents))
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
-	endpoints, err := c.clientset.CoreV1().Endpoints("").List(context.TODO(), metav1.ListOptions{})
+	endpoints, err := c.endpointsLister.Endpoints(c.namespace).List(labels.Everything())
 	if err != nil {
 		return err
 	}
 
-	for _, endpoint := range endpoints.Items {
-		if !isRegisterEnabled(&endpoint) {
+	for _, endpoint := range endpoints {
+		// Deleted endpoints aren't registered again, they're reconciled only to remove their finalizer
+		if endpoint.ObjectMeta.DeletionTimestamp != nil {
+			if finalizer.Has(endpoint) {
+				c.queue.Add(endpoint)
+			}
+			continue
+		}
+		if !isRegisterEnabled(endpoint) {
+			// Finalizer of disabled object is stripped in reconcile
+			if finalizer.Has(endpoint) {
+				c.queue.Add(endpoint)
+			}
 			continue
 		}
 
-		if err := c.eventUpdateFunc(&endpoint, &endpoint); err != nil {
-			glog.Errorf("Failed to sync endpoint %s: %s", endpoint.GetName(), err)
+		// If service does not appears in Consul's services or differs
+		// from the desired one then it's registered again
+		for _, subset := range endpoint.Subsets {
+			for _, address := range subset.Addresses {
+				for _, port := range subset.Ports {
+					actual, ok := consulServices[c.serviceID(endpoint, address, port)]
+					if !ok {
+						addedEndpoints.Delete(address.TargetRef.UID)
+						continue
+					}
+					desired, err := c.createConsulService(endpoint, address, port)
+					if err == nil && consul.CheckDrift(desired, actual) {
+						addedEndpoints.Delete(address.TargetRef.UID)
+					}
+				}
+			}
 		}
+		c.queue.Add(endpoint)
 	}
 
-	c.mutex.Unlock()
 	return nil
 }
 
 // Watch watches events in K8S cluster
 func (c *Controller) Watch() {
-	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "endpoints", c.namespace,
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1.Endpoints{},
-		time.Second*0,
-		cache.ResourceEventHandlerFuncs{
-			DeleteFunc: func(obj interface{}) {
-				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("delete"))
-				defer timer.ObserveDuration()
-
-				if !isRegisterEnabled(obj) {
-					return
-				}
-
-				c.mutex.Lock()
-				glog.Info("Endpoint deletion")
-				if err := c.eventDeleteFunc(obj); err != nil {
-					glog.Errorf("Failed to delete endpoints: %s", err)
-				}
-				c.mutex.Unlock()
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("update"))
-				defer timer.ObserveDuration()
-
-				if !isRegisterEnabled(newObj) {
-					return
-				}
+	c.endpointsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if _, ok := obj.(*v1.Endpoints); !ok || !isRegisterEnabled(obj) {
+				return
+			}
 
-				c.mutex.Lock()
-				glog.Info("Endpoint updation")
-				if err := c.eventUpdateFunc(oldObj, newObj); err != nil {
-					glog.Errorf("Failed to update endpoints: %s", err)
-				}
-				c.mutex.Unlock()
+			glog.Info("Endpoint deletion")
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil {
+				glog.Errorf("Failed to delete endpoints: %s", err)
+				return
+			}
+			c.deleted.Store(key, obj)
+			c.queue.AddKey(key)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Endpoints whose registration has been turned off are reconciled as well
+			if !isRegisterEnabled(newObj) && !isRegisterEnabled(oldObj) {
+				return
+			}
 
-			},
+			glog.Info("Endpoint updation")
+			c.queue.Add(newObj)
 		},
-	)
+	})
 
 	stop := make(chan struct{})
-	controller.Run(stop)
+	c.queue.Run(c.cfg.Controller.Workers, stop)
+}
+
+// reconcile deregisters deleted endpoints and applies changes of existing endpoints with the given key
+func (c *Controller) reconcile(key string) error {
+	if endpoint, ok := c.deleted.Load(key); ok {
+		if err := c.eventDeleteFunc(endpoint); err != nil {
+			return err
+		}
+		c.deleted.CompareAndDelete(key, endpoint)
+		c.reconciled.Delete(key)
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	obj, err := c.endpointsLister.Endpoints(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Endpoints which are being deleted are kept by the cleanup finalizer until their services are deregistered
+	if obj.ObjectMeta.DeletionTimestamp != nil {
+		if err := c.releaseEndpoints(obj); err != nil {
+			return err
+		}
+		c.reconciled.Delete(key)
+		return nil
+	}
+
+	// Addresses which have disappeared since the last reconciliation are deregistered
+	oldObj, ok := c.reconciled.Load(key)
+	if !isRegisterEnabled(obj) {
+		if ok {
+			if err := c.eventDisableFunc(oldObj); err != nil {
+				return err
+			}
+			c.reconciled.Delete(key)
+		}
+		return c.updateFinalizer(obj)
+	}
+	if !ok {
+		oldObj = obj
+	}
+	if err := c.eventUpdateFunc(oldObj, obj); err != nil {
+		return err
+	}
+	c.reconciled.Store(key, obj)
+	return c.updateFinalizer(obj)
+}
+
+// getLegacyConsulServices returns services with `k8s_tag` but without `k8s-cluster` meta which aren't owned
+// by this cluster, they are mapped by UID of their POD to service ID and Consul Agent
+func (c *Controller) getLegacyConsulServices(listedAgents map[string]consul.AgentServices) map[string]map[string]string {
+	legacyServices := make(map[string]map[string]string)
+	for consulAgentID, listed := range listedAgents {
+		for _, service := range listed.Services {
+			if _, ok := service.Meta[utils.K8sClusterMeta]; ok || !utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) ||
+				utils.CheckK8sCluster(service.Meta, c.cfg.Controller.ClusterID, c.cfg.Controller.AdoptLegacy) ||
+				!utils.CheckK8sSource(service.Meta, config.RegisterSourceEndpoint, c.cfg.Controller.RegisterSources) {
+				continue
+			}
+			uid := utils.GetConsulServiceUID(service.Meta, service.Tags)
+			if uid == "" {
+				continue
+			}
+			if _, ok := legacyServices[uid]; !ok {
+				legacyServices[uid] = make(map[string]string)
+			}
+			legacyServices[uid][service.ID] = consulAgentID
+		}
+	}
+	return legacyServices
 }
 
-// getAddedConsulServices returns the list of added Consul Services
-func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]string, error) {
+// getAddedConsulServices returns the list of added Consul Services, agents which can't be listed are skipped
+func (c *Controller) getAddedConsulServices(listedAgents map[string]consul.AgentServices) (map[string]string, map[string][]string, map[string]*consulapi.AgentService, error) {
 	var addedServices = make(map[string]string)
 	var registeredConsulServices = make(map[string][]string)
+	var consulServices = make(map[string]*consulapi.AgentService)
 
 	// Make list of Consul's services
-	for consulAgentID, consulAgent := range consulAgents {
-		services, err := consulAgent.Services()
+	for consulAgentID, listed := range listedAgents {
+		services, err := listed.Services, listed.Err
 		if err != nil {
 			glog.Errorf("Can't get services from Consul Agent, register mode=%s: %s", c.cfg.Controller.RegisterMode, err)
 		} else {
 			glog.V(3).Infof("agent: %#v, services: %#v", consulAgentID, services)
 			for _, service := range services {
-				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) {
+				// Services of other clusters and sources are skipped
+				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) &&
+					utils.CheckK8sCluster(service.Meta, c.cfg.Controller.ClusterID, c.cfg.Controller.AdoptLegacy) &&
+					utils.CheckK8sSource(service.Meta, config.RegisterSourceEndpoint, c.cfg.Controller.RegisterSources) {
 					addedServices[service.ID] = consulAgentID
+					consulServices[service.ID] = service
 
-					uid := utils.GetConsulServiceTag(service.Tags, "uid")
+					uid := utils.GetConsulServiceUID(service.Meta, service.Tags)
 					if value, ok := registeredConsulServices[uid]; ok {
 						registeredConsulServices[uid] = append(value, service.ID)
 					} else {
@@ -276,24 +459,41 @@ func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]s
 			}
 		}
 	}
-	return addedServices, registeredConsulServices, nil
+	return addedServices, registeredConsulServices, consulServices, nil
 }
 
-func (c *Controller) deleteEndpoint(nodeName, podIP, serviceID string) {
+func (c *Controller) deleteEndpoint(endpoint *v1.Endpoints, nodeName, podIP, serviceID string) error {
 	consulAgent := c.consulInstance.New(c.cfg, nodeName, podIP)
 	service := &consulapi.AgentServiceRegistration{ID: serviceID}
 	err := consulAgent.Deregister(service)
 	if err != nil {
 		glog.Errorf("Can't deregister service: %s", err)
-		metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-	} else {
-		metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-		glog.Infof("Service's been deregistered, ID: %s", service.ID)
-		glog.V(2).Infof("%#v", service)
+		metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+		c.recorder.ConsulFailed(endpoint, "deregister", serviceID, consulAgent.Address(), err)
+		return err
 	}
+	metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+	c.recorder.Deregistered(endpoint, serviceID, consulAgent.Address())
+	glog.Infof("Service's been deregistered, ID: %s", service.ID)
+	glog.V(2).Infof("%#v", service)
+	return nil
 }
 
 func (c *Controller) eventDeleteFunc(obj interface{}) error {
+	return c.deregisterEndpoints(obj, "delete")
+}
+
+// eventDisableFunc deregisters services of endpoints whose registration has been turned off
+func (c *Controller) eventDisableFunc(obj interface{}) error {
+	glog.Infof("Endpoints %s in %s namespace are disabled, deregistering their services", obj.(*v1.Endpoints).ObjectMeta.Name, obj.(*v1.Endpoints).ObjectMeta.Namespace)
+	return c.deregisterEndpoints(obj, "disable")
+}
+
+// deregisterEndpoints deregisters services of all addresses of endpoints,
+// the operation is used as the label of metrics
+func (c *Controller) deregisterEndpoints(obj interface{}, operation string) error {
+	var failed consul.Failures
+
 	for _, subset := range obj.(*v1.Endpoints).Subsets {
 		for _, address := range subset.Addresses {
 			glog.Infof("Deletion of endpoint with UID %s (POD: %s)", address.TargetRef.UID, address.TargetRef.Name)
@@ -305,18 +505,25 @@ func (c *Controller) eventDeleteFunc(obj interface{}) error {
 			}
 			ports := subset.Ports
 			for _, port := range ports {
-				serviceID := fmt.Sprintf("%s-%d", address.TargetRef.Name, port.Port)
-				c.deleteEndpoint(pod.Spec.NodeName, pod.Status.PodIP, serviceID)
+				serviceID := c.serviceID(obj.(*v1.Endpoints), address, port)
+				if err := c.deleteEndpoint(obj.(*v1.Endpoints), pod.Spec.NodeName, pod.Status.PodIP, serviceID); err != nil {
+					failed.Add(err)
+				}
 			}
-			delete(addedEndpoints, address.TargetRef.UID)
+			addedEndpoints.Delete(address.TargetRef.UID)
 		}
 	}
-	metrics.PodSuccess.WithLabelValues("delete").Inc()
+	if failed.Count > 0 {
+		metrics.SourceFailure.WithLabelValues(config.RegisterSourceEndpoint, operation).Inc()
+		return failed.Err("Can't deregister %d service(s) of endpoint %s", failed.Count, obj.(*v1.Endpoints).ObjectMeta.Name)
+	}
+	metrics.SourceSuccess.WithLabelValues(config.RegisterSourceEndpoint, operation).Inc()
 	return nil
 }
 
 func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) error {
 	var addedAddresses = make(map[types.UID]bool)
+	var failed consul.Failures
 
 	// Check if any address has been deleted
 	for _, subsetNew := range newObj.(*v1.Endpoints).Subsets {
@@ -337,8 +544,10 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 				}
 				ports := subsetOld.Ports
 				for _, port := range ports {
-					serviceID := fmt.Sprintf("%s-%d", addressOld.TargetRef.Name, port.Port)
-					c.deleteEndpoint(pod.Spec.NodeName, pod.Status.PodIP, serviceID)
+					serviceID := c.serviceID(oldObj.(*v1.Endpoints), addressOld, port)
+					if err := c.deleteEndpoint(oldObj.(*v1.Endpoints), pod.Spec.NodeName, pod.Status.PodIP, serviceID); err != nil {
+						failed.Add(err)
+					}
 				}
 				delete(addedAddresses, addressOld.TargetRef.UID)
 			}
@@ -348,7 +557,7 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 	// Register new endpoint
 	for _, subset := range newObj.(*v1.Endpoints).Subsets {
 		for _, address := range subset.Addresses {
-			if _, ok := addedEndpoints[address.TargetRef.UID]; !ok {
+			if _, ok := addedEndpoints.Load(address.TargetRef.UID); !ok {
 				// Get NodeName of endpoint
 				pod, err := c.getPod(address.TargetRef.Namespace, address.TargetRef.Name)
 				if err != nil {
@@ -362,7 +571,8 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 					service, err := c.createConsulService(newObj.(*v1.Endpoints), address, port)
 					if err != nil {
 						glog.Errorf("Can't convert endpoint to Consul's service: %s", err)
-						metrics.PodFailure.WithLabelValues("update").Inc()
+						metrics.SourceFailure.WithLabelValues(config.RegisterSourceEndpoint, "update").Inc()
+						c.recorder.ConversionFailed(newObj.(*v1.Endpoints), err)
 						continue
 					}
 					// Consul Agent
@@ -370,24 +580,30 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 					err = consulAgent.Register(service)
 					if err != nil {
 						glog.Errorf("Can't register service: %s", err)
-						metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+						metrics.ConsulFailure.WithLabelValues("register", consulAgent.Address()).Inc()
+						c.recorder.ConsulFailed(newObj.(*v1.Endpoints), "register", service.ID, consulAgent.Address(), err)
+						failed.Add(err)
 					} else {
 						glog.Infof("Service's been registered, Name: %s, ID: %s", service.Name, service.ID)
 						glog.V(2).Infof("%#v", service)
-						addedEndpoints[address.TargetRef.UID] = true
-						metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+						addedEndpoints.Store(address.TargetRef.UID, true)
+						metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Address()).Inc()
+						c.recorder.Registered(newObj.(*v1.Endpoints), service.ID, consulAgent.Address())
 					}
 				}
 			}
 		}
 	}
 
-	metrics.PodSuccess.WithLabelValues("update").Inc()
+	if failed.Count > 0 {
+		return failed.Err("Can't register or deregister %d service(s) of endpoint %s", failed.Count, newObj.(*v1.Endpoints).ObjectMeta.Name)
+	}
+	metrics.SourceSuccess.WithLabelValues(config.RegisterSourceEndpoint, "update").Inc()
 	return nil
 }
 
 func (c *Controller) getPod(namespace string, podName string) (*v1.Pod, error) {
-	pod, err := c.clientset.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
+	pod, err := c.podLister.Pods(namespace).Get(podName)
 	if err != nil {
 		return nil, err
 	}
@@ -395,36 +611,54 @@ func (c *Controller) getPod(namespace string, podName string) (*v1.Pod, error) {
 	return pod, nil
 }
 
+// serviceID returns ID of Consul service of the address and port of endpoint
+func (c *Controller) serviceID(endpoint *v1.Endpoints, address v1.EndpointAddress, port v1.EndpointPort) string {
+	data := config.ServiceIDData{
+		Namespace:  endpoint.ObjectMeta.Namespace,
+		Service:    endpoint.ObjectMeta.Name,
+		Pod:        address.TargetRef.Name,
+		Port:       port.Name,
+		PortNumber: port.Port,
+		UID:        string(address.TargetRef.UID),
+	}
+	if address.NodeName != nil {
+		data.Node = *address.NodeName
+	}
+	return c.cfg.Controller.ServiceID(data)
+}
+
 func (c *Controller) createConsulService(endpoint *v1.Endpoints, address v1.EndpointAddress, port v1.EndpointPort) (*consulapi.AgentServiceRegistration, error) {
 	service := &consulapi.AgentServiceRegistration{}
 
-	service.ID = fmt.Sprintf("%s-%d", address.TargetRef.Name, port.Port)
-	service.Name = endpoint.ObjectMeta.Name
+	service.ID = c.serviceID(endpoint, address, port)
+	service.Name = c.cfg.Controller.ServiceName(config.NewServiceNameData(endpoint.ObjectMeta.Name, endpoint.ObjectMeta))
+	if serviceName, ok := annotations.Name(endpoint.ObjectMeta.Annotations); ok {
+		service.Name = serviceName
+	}
 
 	//Add K8sTag from configuration
 	service.Tags = []string{c.cfg.Controller.K8sTag}
-	service.Tags = append(service.Tags, fmt.Sprintf("uid:%s", address.TargetRef.UID))
-	service.Tags = append(service.Tags, labelsToTags(endpoint.ObjectMeta.Labels)...)
+	service.Tags = append(service.Tags, annotations.Tags(endpoint.ObjectMeta.Annotations)...)
+	labelTags, labelMeta := c.cfg.Controller.ConvertLabels(endpoint.ObjectMeta.Labels)
+	service.Tags = utils.UniqueSorted(append(service.Tags, labelTags...))
+	service.Meta = labelMeta
+	for key, value := range annotations.Meta(endpoint.ObjectMeta.Annotations) {
+		service.Meta[key] = value
+	}
+	utils.SetOwnerMeta(service.Meta, c.cfg.Controller.ClusterID, config.RegisterSourceEndpoint, endpoint.ObjectMeta.Namespace, string(address.TargetRef.UID))
 
 	service.Port = int(port.Port)
 	service.Address = address.IP
 
-	return service, nil
-}
-
-func labelsToTags(labels map[string]string) []string {
-	var tags []string
-
-	for key, value := range labels {
-		// if value is equal to "tag" then set only key as tag
-		if value == "tag" {
-			tags = append(tags, key)
-		} else {
-			tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+	if annotations.HasHealthCheck(endpoint.ObjectMeta.Annotations) {
+		check, err := annotations.HealthCheck(endpoint.ObjectMeta.Annotations, address.IP, port.Port)
+		if err != nil {
+			return nil, err
 		}
+		service.Check = check
 	}
-	return tags
 
+	return service, nil
 }
 
 func isRegisterEnabled(obj interface{}) bool {
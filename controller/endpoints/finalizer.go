@@ -0,0 +1,115 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/finalizer"
+	"github.com/warjiang/kube-consul-register/metrics"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// patchEndpoints applies the merge patch to endpoints
+func (c *Controller) patchEndpoints(namespace string, name string, data []byte) error {
+	_, err := c.clientset.CoreV1().Endpoints(namespace).Patch(context.TODO(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+// updateFinalizer puts the cleanup finalizer on registered endpoints if `cleanup_finalizer` option is enabled.
+// The finalizer is removed from endpoints whose registration has been turned off.
+func (c *Controller) updateFinalizer(endpoint *v1.Endpoints) error {
+	if c.cfg.Controller.CleanupFinalizer && isRegisterEnabled(endpoint) {
+		if !isRegistered(endpoint) {
+			return nil
+		}
+		return finalizer.Add(endpoint, c.patchEndpoints)
+	}
+	return finalizer.Remove(endpoint, c.patchEndpoints)
+}
+
+// isRegistered returns true if any address of endpoints has been added to Consul
+func isRegistered(endpoint *v1.Endpoints) bool {
+	for _, subset := range endpoint.Subsets {
+		for _, address := range subset.Addresses {
+			if address.TargetRef == nil {
+				continue
+			}
+			if _, ok := addedEndpoints.Load(address.TargetRef.UID); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// releaseEndpoints deregisters services of deleted endpoints which are left in Consul and removes the cleanup finalizer.
+// If services can't be deregistered until `cleanup_finalizer_timeout` the finalizer is removed anyway.
+func (c *Controller) releaseEndpoints(endpoint *v1.Endpoints) error {
+	if !finalizer.Has(endpoint) {
+		return nil
+	}
+
+	if err := c.deregisterAddresses(endpoint); err != nil {
+		if !finalizer.Expired(endpoint, c.cfg.Controller.CleanupFinalizerTimeout) {
+			return err
+		}
+		glog.Warningf("Services of endpoints %s/%s can't be deregistered in %s, removing finalizer %s: %s",
+			endpoint.ObjectMeta.Namespace, endpoint.ObjectMeta.Name, c.cfg.Controller.CleanupFinalizerTimeout, finalizer.Name, err)
+	}
+	return finalizer.Remove(endpoint, c.patchEndpoints)
+}
+
+// deregisterAddresses deregisters services of all addresses of endpoints which are registered in Consul.
+// Unlike deregisterEndpoints it doesn't need PODs of addresses, which may be already deleted.
+func (c *Controller) deregisterAddresses(endpoint *v1.Endpoints) error {
+	agents, err := c.cacheConsulAgent()
+	if err != nil {
+		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
+	}
+	// Services of agent which can't be listed would be left in Consul
+	listedAgents := consul.ListAgents(agents)
+	if err := consul.ListErr(listedAgents); err != nil {
+		return err
+	}
+	addedConsulServices, _, _, err := c.getAddedConsulServices(listedAgents)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, subset := range endpoint.Subsets {
+		for _, address := range subset.Addresses {
+			if address.TargetRef == nil {
+				continue
+			}
+			for _, port := range subset.Ports {
+				serviceID := c.serviceID(endpoint, address, port)
+				consulAgentID, ok := addedConsulServices[serviceID]
+				if !ok {
+					continue
+				}
+				consulAgent := agents[consulAgentID]
+				if err := consulAgent.Deregister(&consulapi.AgentServiceRegistration{ID: serviceID}); err != nil {
+					glog.Errorf("Can't deregister service: %s", err)
+					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+					c.recorder.ConsulFailed(endpoint, "deregister", serviceID, consulAgent.Address(), err)
+					failed++
+					continue
+				}
+				metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+				c.recorder.Deregistered(endpoint, serviceID, consulAgent.Address())
+				glog.Infof("Service's been deregistered, ID: %s", serviceID)
+			}
+			addedEndpoints.Delete(address.TargetRef.UID)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Can't deregister %d service(s) of endpoint %s", failed, endpoint.ObjectMeta.Name)
+	}
+	return nil
+}
@@ -0,0 +1,643 @@
+package endpointslices
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/warjiang/kube-consul-register/config"
+	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/annotations"
+	"github.com/warjiang/kube-consul-register/controller/informers"
+	"github.com/warjiang/kube-consul-register/controller/queue"
+	"github.com/warjiang/kube-consul-register/metrics"
+	"github.com/warjiang/kube-consul-register/utils"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// These are valid annotations names which are take into account.
+// "ConsulRegisterEnabledAnnotation" is a name of annotation key for `enabled` option.
+// EndpointSlices are managed by Kubernetes, so annotations are taken from their Service.
+const (
+	ConsulRegisterEnabledAnnotation string = "consul.register/enabled"
+)
+
+// addedServices keeps the check status of registered services, it's shared by all workers of the queue
+var (
+	addedServices sync.Map
+
+	consulAgents map[string]consul.Registry
+)
+
+// endpoint describes Consul service of one address and port of EndpointSlice
+type endpoint struct {
+	service  *consulapi.AgentServiceRegistration
+	status   string
+	output   string
+	nodeName string
+	address  string
+}
+
+// Controller describes the attributes that are uses by Controller
+type Controller struct {
+	clientset      kubernetes.Interface
+	consulInstance consul.Registry
+	cfg            *config.Config
+	namespace      string
+	mutex          *sync.Mutex
+
+	queue           *queue.Queue
+	sliceInformer   cache.SharedIndexInformer
+	sliceLister     discoverylisters.EndpointSliceLister
+	serviceInformer cache.SharedIndexInformer
+	serviceLister   corelisters.ServiceLister
+	// nodeLister is set only in `node` mode, podLister only in `pod` mode
+	nodeLister corelisters.NodeLister
+	podLister  corelisters.PodLister
+	// reconciled keeps services of EndpointSlices from the last reconciliation
+	reconciled sync.Map
+}
+
+// New creates an instance of controller. Informers are taken from the informerFactory,
+// which has to be started and synced before the controller is used.
+func New(clientset kubernetes.Interface, informerFactory kubeinformers.SharedInformerFactory, consulInstance consul.Registry, cfg *config.Config, namespace string) FactoryAdapter {
+	sliceInformer := informers.EndpointSlices(informerFactory)
+	serviceInformer := informers.Services(informerFactory)
+
+	c := &Controller{
+		clientset:       clientset,
+		consulInstance:  consulInstance,
+		cfg:             cfg,
+		namespace:       namespace,
+		mutex:           &sync.Mutex{},
+		sliceInformer:   sliceInformer.Informer(),
+		sliceLister:     sliceInformer.Lister(),
+		serviceInformer: serviceInformer.Informer(),
+		serviceLister:   serviceInformer.Lister()}
+	switch cfg.Controller.RegisterMode {
+	case config.RegisterNodeMode:
+		c.nodeLister = informers.Nodes(informerFactory).Lister()
+	case config.RegisterPodMode:
+		c.podLister = informers.Pods(informerFactory).Lister()
+	}
+	c.queue = queue.New("endpointslices", c.reconcile)
+	return c
+}
+
+func (c *Controller) cacheConsulAgent() (map[string]consul.Registry, error) {
+	agents := make(map[string]consul.Registry)
+	//Cache Consul's Agents
+	if c.cfg.Controller.RegisterMode == config.RegisterSingleMode {
+		consulAgent := c.consulInstance.New(c.cfg, "", "")
+		agents[c.cfg.Controller.ConsulAddress] = consulAgent
+
+	} else if c.cfg.Controller.RegisterMode == config.RegisterNodeMode {
+		selector, err := labels.Parse(c.cfg.Controller.ConsulNodeSelector)
+		if err != nil {
+			return agents, err
+		}
+		nodes, err := c.nodeLister.List(selector)
+		if err != nil {
+			return agents, err
+		}
+
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+			agents[node.ObjectMeta.Name] = consulAgent
+		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterPodMode {
+		selector, err := labels.Parse(c.cfg.Controller.PodLabelSelector)
+		if err != nil {
+			return agents, err
+		}
+		pods, err := c.podLister.List(selector)
+		if err != nil {
+			return agents, err
+		}
+		for _, pod := range pods {
+			consulAgent := c.consulInstance.New(c.cfg, "", pod.Status.HostIP)
+			agents[pod.Status.HostIP] = consulAgent
+		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		// Every synthetic node in the catalog is treated as separate agent
+		nodes, err := consul.Nodes(c.consulInstance.New(c.cfg, "", ""))
+		if err != nil {
+			return agents, err
+		}
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, node, "")
+			agents[node] = consulAgent
+		}
+	}
+
+	consul.SkipInvalidAgents(agents)
+
+	// Drop clients of agents which have disappeared. The lock is held only while
+	// the cached agents are swapped, so listing of agents doesn't block each other.
+	c.mutex.Lock()
+	consul.InvalidateAgents(consulAgents, agents)
+	consulAgents = agents
+	c.mutex.Unlock()
+
+	return agents, nil
+}
+
+// Clean checks Consul services and remove them if service does not appear in K8S cluster
+func (c *Controller) Clean() error {
+	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("clean"))
+	defer timer.ObserveDuration()
+
+	agents, err := c.cacheConsulAgent()
+	if err != nil {
+		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
+	}
+
+	// Get list of added Consul' services
+	addedConsulServices, _, err := c.getAddedConsulServices(agents)
+	if err != nil {
+		return err
+	}
+
+	slices, err := c.sliceLister.EndpointSlices(c.namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var currentServices = make(map[string]bool)
+	for _, slice := range slices {
+		svc, ok := c.getService(slice)
+		if !ok {
+			continue
+		}
+		endpoints, err := c.endpoints(slice, svc)
+		if err != nil {
+			// Services of EndpointSlice which can't be converted are kept
+			glog.Errorf("Can't convert EndpointSlice %s/%s to Consul's services: %s", slice.ObjectMeta.Namespace, slice.ObjectMeta.Name, err)
+			for _, ep := range slice.Endpoints {
+				if len(ep.Addresses) == 0 {
+					continue
+				}
+				for _, port := range slice.Ports {
+					if port.Port != nil {
+						currentServices[c.serviceID(slice, ep, ep.Addresses[0], port)] = true
+					}
+				}
+			}
+			continue
+		}
+		for serviceID := range endpoints {
+			currentServices[serviceID] = true
+		}
+	}
+
+	// Remove services of endpoints which don't exist or don't serve anymore
+	for serviceID, consulAgentID := range addedConsulServices {
+		if _, ok := currentServices[serviceID]; ok {
+			continue
+		}
+		consulAgent := agents[consulAgentID]
+		service := &consulapi.AgentServiceRegistration{ID: serviceID}
+		if err := consulAgent.Deregister(service); err != nil {
+			glog.Errorf("Can't deregister service: %s", err)
+			metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+			continue
+		}
+		addedServices.Delete(serviceID)
+		glog.Infof("Service's been deregistered, ID: %s", service.ID)
+		metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+	}
+	return nil
+}
+
+// Sync synchronizes services between Consul and K8S cluster.
+// Every EndpointSlice is reconciled, so TTL of checks is refreshed as well.
+func (c *Controller) Sync() error {
+	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("sync"))
+	defer timer.ObserveDuration()
+
+	agents, err := c.cacheConsulAgent()
+	if err != nil {
+		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
+	}
+	glog.V(2).Infof("Agents: %#v", agents)
+
+	// Get list of added Consul' services
+	addedConsulServices, consulServices, err := c.getAddedConsulServices(agents)
+	if err != nil {
+		return err
+	}
+	glog.V(3).Infof("Added services: %#v", addedConsulServices)
+
+	slices, err := c.sliceLister.EndpointSlices(c.namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, slice := range slices {
+		svc, ok := c.getService(slice)
+		if !ok {
+			continue
+		}
+		// If service does not appears in Consul's services or differs
+		// from the desired one then it's registered again
+		endpoints, err := c.endpoints(slice, svc)
+		if err != nil {
+			glog.Errorf("Can't convert EndpointSlice %s/%s to Consul's services: %s", slice.ObjectMeta.Namespace, slice.ObjectMeta.Name, err)
+		}
+		for serviceID, ep := range endpoints {
+			if actual, ok := consulServices[serviceID]; !ok || consul.CheckDrift(ep.service, actual) {
+				addedServices.Delete(serviceID)
+			}
+		}
+		c.queue.Add(slice)
+	}
+	return nil
+}
+
+// Watch watches events in K8S cluster
+func (c *Controller) Watch() {
+	c.sliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.queue.Add(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			c.queue.Add(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			// Services of deleted EndpointSlice are known from the last reconciliation
+			c.queue.Add(obj)
+		},
+	})
+
+	// Annotations and labels are taken from Service, so its EndpointSlices are reconciled on change
+	c.serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.addServiceSlices(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			c.addServiceSlices(newObj)
+		},
+	})
+
+	stop := make(chan struct{})
+	c.queue.Run(c.cfg.Controller.Workers, stop)
+}
+
+// addServiceSlices adds all EndpointSlices of the service to the queue
+func (c *Controller) addServiceSlices(obj interface{}) {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		return
+	}
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svc.ObjectMeta.Name})
+	slices, err := c.sliceLister.EndpointSlices(svc.ObjectMeta.Namespace).List(selector)
+	if err != nil {
+		glog.Errorf("Can't list EndpointSlices of service %s: %s", svc.ObjectMeta.Name, err)
+		return
+	}
+	for _, slice := range slices {
+		c.queue.Add(slice)
+	}
+}
+
+// reconcile registers services of serving endpoints of EndpointSlice with the given key
+// and deregisters services of endpoints which have disappeared since the last reconciliation
+func (c *Controller) reconcile(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	desired := make(map[string]*endpoint)
+	enabled := false
+	slice, err := c.sliceLister.EndpointSlices(namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if exists {
+		if svc, ok := c.getService(slice); ok {
+			desired, err = c.endpoints(slice, svc)
+			if err != nil {
+				// Registered services are kept until annotations of Service are fixed
+				metrics.SourceFailure.WithLabelValues(config.RegisterSourceEndpointSlice, "update").Inc()
+				return fmt.Errorf("Can't convert EndpointSlice %s to Consul's services: %s", key, err)
+			}
+			enabled = true
+		}
+	}
+
+	var previous map[string]*endpoint
+	if value, ok := c.reconciled.Load(key); ok {
+		previous = value.(map[string]*endpoint)
+	}
+
+	// Registration of existing EndpointSlice has been turned off on its Service
+	operation := "update"
+	if exists && !enabled && len(previous) > 0 {
+		operation = "disable"
+		glog.Infof("EndpointSlice %s is disabled, deregistering its services", key)
+	}
+
+	var failed consul.Failures
+	current := make(map[string]*endpoint)
+	for serviceID, ep := range previous {
+		if _, ok := desired[serviceID]; ok {
+			continue
+		}
+		// Endpoint could have been moved to another EndpointSlice
+		if c.isReconciledInOtherSlice(key, serviceID) {
+			continue
+		}
+		if err := c.deregister(ep); err != nil {
+			// Deregistration is retried on the next reconciliation
+			current[serviceID] = ep
+			failed.Add(err)
+		}
+	}
+	for serviceID, ep := range desired {
+		current[serviceID] = ep
+		if err := c.register(ep); err != nil {
+			failed.Add(err)
+		}
+	}
+
+	if len(current) == 0 {
+		c.reconciled.Delete(key)
+	} else {
+		c.reconciled.Store(key, current)
+	}
+
+	if failed.Count > 0 {
+		metrics.SourceFailure.WithLabelValues(config.RegisterSourceEndpointSlice, operation).Inc()
+		return failed.Err("Can't register or deregister %d service(s) of EndpointSlice %s", failed.Count, key)
+	}
+	metrics.SourceSuccess.WithLabelValues(config.RegisterSourceEndpointSlice, operation).Inc()
+	return nil
+}
+
+func (c *Controller) isReconciledInOtherSlice(key string, serviceID string) bool {
+	found := false
+	c.reconciled.Range(func(otherKey, value interface{}) bool {
+		if otherKey.(string) == key {
+			return true
+		}
+		_, found = value.(map[string]*endpoint)[serviceID]
+		return !found
+	})
+	return found
+}
+
+// register registers service of endpoint, status of already registered service is updated
+func (c *Controller) register(ep *endpoint) error {
+	consulAgent := c.consulInstance.New(c.cfg, ep.nodeName, ep.address)
+
+	if status, ok := addedServices.Load(ep.service.ID); ok {
+		err := consul.UpdateTTL(consulAgent, ep.service.Check.CheckID, ep.output, ep.status)
+		if err == nil {
+			if status.(string) != ep.status {
+				glog.Infof("Status of service %s has been changed to %s: %s", ep.service.ID, ep.status, ep.output)
+			}
+			addedServices.Store(ep.service.ID, ep.status)
+			return nil
+		}
+		// Check can be missing e.g. after restart of agent, so service is registered again
+		glog.Warningf("Can't update check of service %s: %s", ep.service.ID, err)
+	}
+
+	err := consulAgent.Register(ep.service)
+	if err != nil {
+		glog.Errorf("Can't register service: %s", err)
+		metrics.ConsulFailure.WithLabelValues("register", consulAgent.Address()).Inc()
+		return err
+	}
+	glog.Infof("Service's been registered, Name: %s, ID: %s, Status: %s", ep.service.Name, ep.service.ID, ep.status)
+	glog.V(2).Infof("%#v", ep.service)
+	addedServices.Store(ep.service.ID, ep.status)
+	metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Address()).Inc()
+	return nil
+}
+
+// deregister deregisters service of endpoint
+func (c *Controller) deregister(ep *endpoint) error {
+	consulAgent := c.consulInstance.New(c.cfg, ep.nodeName, ep.address)
+	err := consulAgent.Deregister(ep.service)
+	if err != nil {
+		glog.Errorf("Can't deregister service: %s", err)
+		metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+		return err
+	}
+	glog.Infof("Service's been deregistered, ID: %s", ep.service.ID)
+	addedServices.Delete(ep.service.ID)
+	metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+	return nil
+}
+
+// getAddedConsulServices returns the list of added Consul Services
+func (c *Controller) getAddedConsulServices(agents map[string]consul.Registry) (map[string]string, map[string]*consulapi.AgentService, error) {
+	var addedConsulServices = make(map[string]string)
+	var consulServices = make(map[string]*consulapi.AgentService)
+
+	// Make list of Consul's services
+	for consulAgentID, listed := range consul.ListAgents(agents) {
+		services, err := listed.Services, listed.Err
+		if err != nil {
+			glog.Errorf("Can't get services from Consul Agent, register mode=%s: %s", c.cfg.Controller.RegisterMode, err)
+		} else {
+			glog.V(3).Infof("agent: %#v, services: %#v", consulAgentID, services)
+			for _, service := range services {
+				// Services of other clusters and sources are skipped
+				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) &&
+					utils.CheckK8sCluster(service.Meta, c.cfg.Controller.ClusterID, c.cfg.Controller.AdoptLegacy) &&
+					utils.CheckK8sSource(service.Meta, config.RegisterSourceEndpointSlice, c.cfg.Controller.RegisterSources) {
+					addedConsulServices[service.ID] = consulAgentID
+					consulServices[service.ID] = service
+				}
+			}
+		}
+	}
+	return addedConsulServices, consulServices, nil
+}
+
+// getService returns the Service of EndpointSlice if it's enabled to register
+func (c *Controller) getService(slice *discoveryv1.EndpointSlice) (*v1.Service, bool) {
+	serviceName, ok := slice.ObjectMeta.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil, false
+	}
+	svc, err := c.serviceLister.Services(slice.ObjectMeta.Namespace).Get(serviceName)
+	if err != nil {
+		glog.V(1).Infof("Can't get service %s of EndpointSlice %s: %s", serviceName, slice.ObjectMeta.Name, err)
+		return nil, false
+	}
+	if !isRegisterEnabled(svc) {
+		return nil, false
+	}
+	return svc, true
+}
+
+// endpoints returns services of serving endpoints of EndpointSlice
+func (c *Controller) endpoints(slice *discoveryv1.EndpointSlice, svc *v1.Service) (map[string]*endpoint, error) {
+	result := make(map[string]*endpoint)
+
+	for _, ep := range slice.Endpoints {
+		if len(ep.Addresses) == 0 {
+			continue
+		}
+		status, output, ok := conditionStatus(ep.Conditions)
+		if !ok {
+			continue
+		}
+
+		// All addresses of endpoint are the same, so the first one is used
+		address := ep.Addresses[0]
+		var nodeName string
+		if ep.NodeName != nil {
+			nodeName = *ep.NodeName
+		}
+
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			service, err := c.createConsulService(slice, svc, ep, address, port, status)
+			if err != nil {
+				return nil, err
+			}
+			result[service.ID] = &endpoint{
+				service:  service,
+				status:   status,
+				output:   output,
+				nodeName: nodeName,
+				address:  address,
+			}
+		}
+	}
+	return result, nil
+}
+
+// conditionStatus returns the check status of endpoint and false if endpoint doesn't serve.
+// Conditions which are not set are interpreted as ready and not terminating.
+func conditionStatus(conditions discoveryv1.EndpointConditions) (string, string, bool) {
+	ready := conditions.Ready == nil || *conditions.Ready
+	serving := ready
+	if conditions.Serving != nil {
+		serving = *conditions.Serving
+	}
+	terminating := conditions.Terminating != nil && *conditions.Terminating
+
+	switch {
+	case terminating && serving:
+		return consulapi.HealthWarning, "Endpoint is terminating", true
+	case ready && !terminating:
+		return consulapi.HealthPassing, "Endpoint is ready", true
+	default:
+		return "", "", false
+	}
+}
+
+// serviceID returns ID of Consul service of the address and port of endpoint.
+// Endpoints without reference to POD are identified by address.
+func (c *Controller) serviceID(slice *discoveryv1.EndpointSlice, ep discoveryv1.Endpoint, address string, port discoveryv1.EndpointPort) string {
+	data := config.ServiceIDData{
+		Namespace:  slice.ObjectMeta.Namespace,
+		Service:    slice.ObjectMeta.Labels[discoveryv1.LabelServiceName],
+		Pod:        address,
+		PortNumber: *port.Port,
+	}
+	if ep.TargetRef != nil {
+		data.Pod = ep.TargetRef.Name
+		data.UID = string(ep.TargetRef.UID)
+	}
+	if port.Name != nil {
+		data.Port = *port.Name
+	}
+	if ep.NodeName != nil {
+		data.Node = *ep.NodeName
+	}
+	return c.cfg.Controller.ServiceID(data)
+}
+
+func (c *Controller) createConsulService(slice *discoveryv1.EndpointSlice, svc *v1.Service, ep discoveryv1.Endpoint, address string, port discoveryv1.EndpointPort, status string) (*consulapi.AgentServiceRegistration, error) {
+	service := &consulapi.AgentServiceRegistration{}
+
+	service.ID = c.serviceID(slice, ep, address, port)
+	service.Name = c.cfg.Controller.ServiceName(config.NewServiceNameData(svc.ObjectMeta.Name, svc.ObjectMeta))
+	if serviceName, ok := annotations.Name(svc.ObjectMeta.Annotations); ok {
+		service.Name = serviceName
+	}
+
+	//Add K8sTag from configuration
+	service.Tags = []string{c.cfg.Controller.K8sTag}
+	if ep.NodeName != nil {
+		service.Tags = append(service.Tags, fmt.Sprintf("node:%s", *ep.NodeName))
+	}
+	if ep.Zone != nil {
+		service.Tags = append(service.Tags, fmt.Sprintf("zone:%s", *ep.Zone))
+	}
+	service.Tags = append(service.Tags, annotations.Tags(svc.ObjectMeta.Annotations)...)
+	labelTags, labelMeta := c.cfg.Controller.ConvertLabels(svc.ObjectMeta.Labels)
+	service.Tags = utils.UniqueSorted(append(service.Tags, labelTags...))
+	var uid string
+	if ep.TargetRef != nil {
+		uid = string(ep.TargetRef.UID)
+	}
+	service.Meta = labelMeta
+	for key, value := range annotations.Meta(svc.ObjectMeta.Annotations) {
+		service.Meta[key] = value
+	}
+	utils.SetOwnerMeta(service.Meta, c.cfg.Controller.ClusterID, config.RegisterSourceEndpointSlice, svc.ObjectMeta.Namespace, uid)
+
+	service.Port = int(*port.Port)
+	service.Address = address
+
+	// Status of check reflects conditions of endpoint. The check is refreshed on every reconciliation
+	// of EndpointSlice, at least on every synchronization.
+	service.Check = &consulapi.AgentServiceCheck{
+		CheckID: fmt.Sprintf("service:%s", service.ID),
+		Name:    "Endpoint conditions",
+		TTL:     c.cfg.Controller.CheckTTL(),
+		Status:  status,
+	}
+	if annotations.HasHealthCheck(svc.ObjectMeta.Annotations) {
+		check, err := annotations.HealthCheck(svc.ObjectMeta.Annotations, address, *port.Port)
+		if err != nil {
+			return nil, err
+		}
+		service.Checks = consulapi.AgentServiceChecks{check}
+	}
+
+	return service, nil
+}
+
+func isRegisterEnabled(svc *v1.Service) bool {
+	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterEnabledAnnotation]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterEnabledAnnotation, err)
+			return false
+		}
+
+		if !enabled {
+			glog.Infof("Service %s in %s namespace is disabled by annotation. Value: %s", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace, value)
+			return false
+		}
+	} else {
+		glog.V(1).Infof("Service %s in %s namespace will not be registered in Consul. Lack of annotation %s", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace, ConsulRegisterEnabledAnnotation)
+		return false
+	}
+	return true
+}
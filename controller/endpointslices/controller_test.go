@@ -0,0 +1,183 @@
+package endpointslices
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/warjiang/kube-consul-register/config"
+	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/informers"
+)
+
+func TestConditionStatus(t *testing.T) {
+	t.Parallel()
+
+	yes, no := true, false
+
+	status, _, ok := conditionStatus(discoveryv1.EndpointConditions{})
+	assert.True(t, ok)
+	assert.Equal(t, consulapi.HealthPassing, status)
+
+	status, _, ok = conditionStatus(discoveryv1.EndpointConditions{Ready: &yes, Serving: &yes, Terminating: &no})
+	assert.True(t, ok)
+	assert.Equal(t, consulapi.HealthPassing, status)
+
+	status, _, ok = conditionStatus(discoveryv1.EndpointConditions{Ready: &no, Serving: &yes, Terminating: &yes})
+	assert.True(t, ok)
+	assert.Equal(t, consulapi.HealthWarning, status)
+
+	_, _, ok = conditionStatus(discoveryv1.EndpointConditions{Ready: &no, Serving: &no, Terminating: &yes})
+	assert.False(t, ok)
+
+	_, _, ok = conditionStatus(discoveryv1.EndpointConditions{Ready: &no})
+	assert.False(t, ok)
+}
+
+func TestInvalidHealthPort(t *testing.T) {
+	t.Parallel()
+
+	port := int32(8080)
+	objService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"consul.register/enabled":             "true",
+				"consul.register/service.health.port": "http",
+			},
+		},
+	}
+	objSlice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+		Ports:     []discoveryv1.EndpointPort{{Port: &port}},
+	}
+
+	c := &Controller{cfg: &config.Config{Controller: &config.ControllerConfig{}}}
+	_, err := c.endpoints(objSlice, objService)
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+
+	yes, no := true, false
+	nodeName := "nodename"
+	port := int32(8080)
+
+	objService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+	}
+	objSlice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses:  []string{"10.0.0.1"},
+				Conditions: discoveryv1.EndpointConditions{Ready: &yes},
+				TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: "web-1", UID: "11111111-89ab-cdef-0123-456789abcdef"},
+				NodeName:   &nodeName,
+			},
+			{
+				Addresses:  []string{"10.0.0.2"},
+				Conditions: discoveryv1.EndpointConditions{Ready: &no, Serving: &yes, Terminating: &yes},
+				TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: "web-2", UID: "22222222-89ab-cdef-0123-456789abcdef"},
+				NodeName:   &nodeName,
+			},
+		},
+		Ports: []discoveryv1.EndpointPort{{Port: &port}},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:   "localhost",
+			ConsulPort:      "8500",
+			ConsulScheme:    "http",
+			K8sTag:          "kubernetes",
+			RegisterMode:    config.RegisterSingleMode,
+			RegisterSources: []string{config.RegisterSourceEndpointSlice},
+			Workers:         2,
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(objService, objSlice)
+	informerFactory := informers.NewFactory(clientset, "")
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+	ctr := New(clientset, informerFactory, registry, cfg, "")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+	go ctr.Watch()
+
+	health := func(serviceID string) func() string {
+		return func() string {
+			services, _ := agent.List()
+			if _, ok := services[serviceID]; !ok {
+				return ""
+			}
+			status, _ := agent.Health(serviceID)
+			return status
+		}
+	}
+
+	// Ready endpoint is passing, terminating but still serving endpoint is warning
+	assert.Eventually(t, func() bool { return health("default-web-web-1-8080")() == consulapi.HealthPassing }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return health("default-web-web-2-8080")() == consulapi.HealthWarning }, 5*time.Second, 10*time.Millisecond)
+
+	services, _ := agent.List()
+	assert.Equal(t, "web", services["default-web-web-1-8080"].Service)
+	assert.Equal(t, "10.0.0.1", services["default-web-web-1-8080"].Address)
+	assert.Equal(t, 8080, services["default-web-web-1-8080"].Port)
+	assert.Contains(t, services["default-web-web-1-8080"].Tags, "kubernetes")
+	assert.Contains(t, services["default-web-web-1-8080"].Tags, "app:web")
+	assert.Contains(t, services["default-web-web-1-8080"].Tags, "node:nodename")
+	assert.Equal(t, config.RegisterSourceEndpointSlice, services["default-web-web-1-8080"].Meta["k8s-source"])
+
+	// Endpoint stops serving, so its service is deregistered
+	objSlice = objSlice.DeepCopy()
+	objSlice.Endpoints[1].Conditions.Serving = &no
+	_, err := clientset.DiscoveryV1().EndpointSlices("default").Update(context.TODO(), objSlice, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return health("default-web-web-2-8080")() == "" }, 5*time.Second, 10*time.Millisecond)
+
+	// Missing service is registered again by Sync and services of existing endpoints are kept by Clean
+	err = agent.Deregister(&consulapi.AgentServiceRegistration{ID: "default-web-web-1-8080"})
+	assert.Nil(t, err)
+	err = ctr.Sync()
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return health("default-web-web-1-8080")() == consulapi.HealthPassing }, 5*time.Second, 10*time.Millisecond)
+	err = ctr.Clean()
+	assert.Nil(t, err)
+	assert.Equal(t, consulapi.HealthPassing, health("default-web-web-1-8080")())
+
+	// Service is disabled by annotation, so services of its endpoints are deregistered
+	objService = objService.DeepCopy()
+	objService.Annotations["consul.register/enabled"] = "false"
+	_, err = clientset.CoreV1().Services("default").Update(context.TODO(), objService, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return health("default-web-web-1-8080")() == "" }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,8 @@
+package endpointslices
+
+// FactoryAdapter has a method to work with Controller resources.
+type FactoryAdapter interface {
+	Watch()
+	Sync() error
+	Clean() error
+}
@@ -0,0 +1,86 @@
+package events
+
+import (
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Component is the source of recorded events
+const Component string = "kube-consul-register"
+
+// These are reasons of recorded events.
+// "ReasonRegistered" and "ReasonDeregistered" are recorded for every service of the object.
+// "ReasonConversionFailed" is recorded when the object can't be converted to Consul's service.
+// "ReasonConsulFailed" is recorded when Consul Agent returns an error.
+const (
+	ReasonRegistered       string = "ConsulRegistered"
+	ReasonDeregistered     string = "ConsulDeregistered"
+	ReasonConversionFailed string = "ConsulConversionFailed"
+	ReasonConsulFailed     string = "ConsulFailed"
+)
+
+// spamBurst and spamQPS limit events of the same object, so periodic synchronization
+// which fails again and again doesn't flood the API server
+const (
+	spamBurst = 10
+	spamQPS   = 1. / 60.
+)
+
+// Recorder records events about registration of objects in Consul.
+// Methods of nil Recorder do nothing.
+type Recorder struct {
+	recorder record.EventRecorder
+}
+
+// NewRecorder returns the Recorder which sends events to the API server with rate limiting per object
+func NewRecorder(clientset kubernetes.Interface) *Recorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: spamBurst,
+		QPS:       spamQPS,
+	})
+	broadcaster.StartLogging(glog.V(3).Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return WithEventRecorder(broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: Component}))
+}
+
+// WithEventRecorder returns the Recorder which uses the given EventRecorder
+func WithEventRecorder(recorder record.EventRecorder) *Recorder {
+	return &Recorder{recorder: recorder}
+}
+
+// Registered records that service of object has been registered in Consul Agent
+func (r *Recorder) Registered(obj runtime.Object, serviceID string, agent string) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(obj, v1.EventTypeNormal, ReasonRegistered, "Service %s has been registered in Consul Agent %s", serviceID, agent)
+}
+
+// Deregistered records that service of object has been deregistered from Consul Agent
+func (r *Recorder) Deregistered(obj runtime.Object, serviceID string, agent string) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(obj, v1.EventTypeNormal, ReasonDeregistered, "Service %s has been deregistered from Consul Agent %s", serviceID, agent)
+}
+
+// ConversionFailed records that object can't be converted to Consul's service
+func (r *Recorder) ConversionFailed(obj runtime.Object, err error) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(obj, v1.EventTypeWarning, ReasonConversionFailed, "Can't convert to Consul's service: %s", err)
+}
+
+// ConsulFailed records that the operation on service of object has failed in Consul Agent
+func (r *Recorder) ConsulFailed(obj runtime.Object, operation string, serviceID string, agent string, err error) {
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(obj, v1.EventTypeWarning, ReasonConsulFailed, "Can't %s service %s in Consul Agent %s: %s", operation, serviceID, agent, err)
+}
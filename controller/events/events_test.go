@@ -0,0 +1,35 @@
+package events
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	fake := record.NewFakeRecorder(10)
+	recorder := WithEventRecorder(fake)
+	pod := &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web"}
+
+	recorder.Registered(pod, "default-web-app", "10.0.0.1")
+	assert.Equal(t, "Normal ConsulRegistered Service default-web-app has been registered in Consul Agent 10.0.0.1", <-fake.Events)
+
+	recorder.Deregistered(pod, "default-web-app", "10.0.0.1")
+	assert.Equal(t, "Normal ConsulDeregistered Service default-web-app has been deregistered from Consul Agent 10.0.0.1", <-fake.Events)
+
+	recorder.ConversionFailed(pod, errors.New("Port's equal to 0"))
+	assert.Equal(t, "Warning ConsulConversionFailed Can't convert to Consul's service: Port's equal to 0", <-fake.Events)
+
+	recorder.ConsulFailed(pod, "register", "default-web-app", "10.0.0.1", errors.New("timeout"))
+	assert.Equal(t, "Warning ConsulFailed Can't register service default-web-app in Consul Agent 10.0.0.1: timeout", <-fake.Events)
+
+	// Nil recorder records nothing
+	var nilRecorder *Recorder
+	nilRecorder.Registered(pod, "default-web-app", "10.0.0.1")
+	assert.Len(t, fake.Events, 0)
+}
@@ -0,0 +1,72 @@
+package finalizer
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Name is the finalizer which is put on registered objects, so they aren't removed
+// before their services are deregistered from Consul.
+const Name string = "consul.register/cleanup"
+
+// PatchFunc applies the merge patch to the object with the given namespace and name
+type PatchFunc func(namespace string, name string, data []byte) error
+
+// Has returns true if object has the finalizer
+func Has(obj metav1.Object) bool {
+	for _, finalizer := range obj.GetFinalizers() {
+		if finalizer == Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add puts the finalizer on object unless it's already there
+func Add(obj metav1.Object, patch PatchFunc) error {
+	if Has(obj) {
+		return nil
+	}
+	glog.V(1).Infof("Adding finalizer %s to %s/%s", Name, obj.GetNamespace(), obj.GetName())
+	return apply(obj, append(append([]string{}, obj.GetFinalizers()...), Name), patch)
+}
+
+// Remove removes the finalizer from object if it's there
+func Remove(obj metav1.Object, patch PatchFunc) error {
+	if !Has(obj) {
+		return nil
+	}
+	finalizers := []string{}
+	for _, finalizer := range obj.GetFinalizers() {
+		if finalizer != Name {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	glog.V(1).Infof("Removing finalizer %s from %s/%s", Name, obj.GetNamespace(), obj.GetName())
+	return apply(obj, finalizers, patch)
+}
+
+// Expired returns true if object has been deleted longer than timeout ago.
+// The finalizer of such object is removed even if its services can't be deregistered.
+func Expired(obj metav1.Object, timeout time.Duration) bool {
+	deleted := obj.GetDeletionTimestamp()
+	return deleted != nil && time.Since(deleted.Time) > timeout
+}
+
+// apply sets finalizers of object. The patch contains resourceVersion, so it fails
+// if object has been changed in the meantime and it's retried with the new version.
+func apply(obj metav1.Object, finalizers []string, patch PatchFunc) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": obj.GetResourceVersion(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return patch(obj.GetNamespace(), obj.GetName(), data)
+}
@@ -0,0 +1,53 @@
+package finalizer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFinalizer(t *testing.T) {
+	t.Parallel()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "web-0",
+			Namespace:  "default",
+			Finalizers: []string{"other"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(pod)
+	patch := func(namespace string, name string, data []byte) error {
+		_, err := clientset.CoreV1().Pods(namespace).Patch(context.TODO(), name, types.MergePatchType, data, metav1.PatchOptions{})
+		return err
+	}
+	get := func() *v1.Pod {
+		pod, _ := clientset.CoreV1().Pods("default").Get(context.TODO(), "web-0", metav1.GetOptions{})
+		return pod
+	}
+
+	assert.False(t, Has(pod))
+	assert.Nil(t, Add(pod, patch))
+	assert.Equal(t, []string{"other", Name}, get().ObjectMeta.Finalizers)
+	assert.True(t, Has(get()))
+
+	// Finalizer is added only once
+	assert.Nil(t, Add(get(), patch))
+	assert.Equal(t, []string{"other", Name}, get().ObjectMeta.Finalizers)
+
+	assert.Nil(t, Remove(get(), patch))
+	assert.Equal(t, []string{"other"}, get().ObjectMeta.Finalizers)
+	assert.Nil(t, Remove(get(), patch))
+
+	assert.False(t, Expired(pod, time.Minute))
+	deleted := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	pod.ObjectMeta.DeletionTimestamp = &deleted
+	assert.True(t, Expired(pod, time.Minute))
+	assert.False(t, Expired(pod, time.Hour))
+}
@@ -0,0 +1,152 @@
+package informers
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	kubeinformers "k8s.io/client-go/informers"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	batchinformers "k8s.io/client-go/informers/batch/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	discoveryinformers "k8s.io/client-go/informers/discovery/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NewFactory returns the factory of shared informers which is used by all controllers.
+// Informers are created by controllers, so they have to be taken before the factory is started.
+func NewFactory(clientset kubernetes.Interface, namespace string) kubeinformers.SharedInformerFactory {
+	return kubeinformers.NewSharedInformerFactoryWithOptions(clientset, 0, kubeinformers.WithNamespace(namespace))
+}
+
+// Pods returns the informer of pods which keeps only fields read by controllers
+func Pods(factory kubeinformers.SharedInformerFactory) coreinformers.PodInformer {
+	informer := factory.Core().V1().Pods()
+	setTransform(informer.Informer(), trimPod)
+	return informer
+}
+
+// Nodes returns the informer of nodes
+func Nodes(factory kubeinformers.SharedInformerFactory) coreinformers.NodeInformer {
+	informer := factory.Core().V1().Nodes()
+	setTransform(informer.Informer(), trimMeta)
+	return informer
+}
+
+// NodeInternalIP returns the function which looks up InternalIP of node in the lister
+func NodeInternalIP(lister corelisters.NodeLister) func(name string) (string, error) {
+	return func(name string) (string, error) {
+		node, err := lister.Get(name)
+		if err != nil {
+			return "", err
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type == v1.NodeInternalIP {
+				return address.Address, nil
+			}
+		}
+		return "", fmt.Errorf("node %s has no InternalIP", name)
+	}
+}
+
+// Services returns the informer of services
+func Services(factory kubeinformers.SharedInformerFactory) coreinformers.ServiceInformer {
+	informer := factory.Core().V1().Services()
+	setTransform(informer.Informer(), trimMeta)
+	return informer
+}
+
+// Endpoints returns the informer of endpoints
+func Endpoints(factory kubeinformers.SharedInformerFactory) coreinformers.EndpointsInformer {
+	informer := factory.Core().V1().Endpoints()
+	setTransform(informer.Informer(), trimMeta)
+	return informer
+}
+
+// EndpointSlices returns the informer of endpoint slices
+func EndpointSlices(factory kubeinformers.SharedInformerFactory) discoveryinformers.EndpointSliceInformer {
+	informer := factory.Discovery().V1().EndpointSlices()
+	setTransform(informer.Informer(), trimMeta)
+	return informer
+}
+
+// ReplicaSets returns the informer of replica sets which keeps only metadata,
+// it's used to find Deployment of pods
+func ReplicaSets(factory kubeinformers.SharedInformerFactory) appsinformers.ReplicaSetInformer {
+	informer := factory.Apps().V1().ReplicaSets()
+	setTransform(informer.Informer(), trimOwner)
+	return informer
+}
+
+// Jobs returns the informer of jobs which keeps only metadata, it's used to find CronJob of pods
+func Jobs(factory kubeinformers.SharedInformerFactory) batchinformers.JobInformer {
+	informer := factory.Batch().V1().Jobs()
+	setTransform(informer.Informer(), trimOwner)
+	return informer
+}
+
+func setTransform(informer cache.SharedIndexInformer, transform cache.TransformFunc) {
+	// Transform can't be changed when informer has already been started
+	if err := informer.SetTransform(transform); err != nil {
+		glog.Warningf("Can't set transform of informer: %s", err)
+	}
+}
+
+// trimMeta drops managed fields which are never read and take a lot of memory
+func trimMeta(obj interface{}) (interface{}, error) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetManagedFields(nil)
+	}
+	return obj, nil
+}
+
+// trimPod drops all fields of pod which are never read by controllers
+func trimPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return obj, nil
+	}
+	pod.ObjectMeta.ManagedFields = nil
+
+	var containers []v1.Container
+	for _, container := range pod.Spec.Containers {
+		containers = append(containers, v1.Container{
+			Name:           container.Name,
+			Ports:          container.Ports,
+			LivenessProbe:  container.LivenessProbe,
+			ReadinessProbe: container.ReadinessProbe,
+		})
+	}
+	pod.Spec = v1.PodSpec{
+		NodeName:       pod.Spec.NodeName,
+		Containers:     containers,
+		ReadinessGates: pod.Spec.ReadinessGates,
+	}
+	pod.Status = v1.PodStatus{
+		Phase:             pod.Status.Phase,
+		Conditions:        pod.Status.Conditions,
+		HostIP:            pod.Status.HostIP,
+		PodIP:             pod.Status.PodIP,
+		ContainerStatuses: pod.Status.ContainerStatuses,
+	}
+	return pod, nil
+}
+
+// trimOwner drops all fields of replica set or job except metadata, only owners are read by controllers
+func trimOwner(obj interface{}) (interface{}, error) {
+	switch owner := obj.(type) {
+	case *appsv1.ReplicaSet:
+		owner.ObjectMeta.ManagedFields = nil
+		return &appsv1.ReplicaSet{TypeMeta: owner.TypeMeta, ObjectMeta: owner.ObjectMeta}, nil
+	case *batchv1.Job:
+		owner.ObjectMeta.ManagedFields = nil
+		return &batchv1.Job{TypeMeta: owner.TypeMeta, ObjectMeta: owner.ObjectMeta}, nil
+	}
+	return obj, nil
+}
@@ -0,0 +1,99 @@
+package informers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestTrimPod(t *testing.T) {
+	t.Parallel()
+
+	probe := &v1.Probe{PeriodSeconds: 10}
+	objPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:          "podname",
+			Labels:        map[string]string{"app": "web"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+		Spec: v1.PodSpec{
+			NodeName:       "nodename",
+			InitContainers: []v1.Container{{Name: "init"}},
+			Volumes:        []v1.Volume{{Name: "data"}},
+			ReadinessGates: []v1.PodReadinessGate{{ConditionType: "consul.register/registered"}},
+			Containers: []v1.Container{{
+				Name:           "web",
+				Image:          "nginx",
+				Env:            []v1.EnvVar{{Name: "KEY", Value: "value"}},
+				Ports:          []v1.ContainerPort{{ContainerPort: 80}},
+				LivenessProbe:  probe,
+				ReadinessProbe: probe,
+			}},
+		},
+		Status: v1.PodStatus{
+			Phase:                 v1.PodRunning,
+			PodIP:                 "10.0.0.1",
+			HostIP:                "192.168.0.1",
+			InitContainerStatuses: []v1.ContainerStatus{{Name: "init"}},
+			ContainerStatuses:     []v1.ContainerStatus{{Name: "web", Ready: true}},
+		},
+	}
+
+	obj, err := trimPod(objPod)
+	assert.Nil(t, err)
+	pod := obj.(*v1.Pod)
+
+	assert.Nil(t, pod.ObjectMeta.ManagedFields)
+	assert.Equal(t, map[string]string{"app": "web"}, pod.ObjectMeta.Labels)
+	assert.Equal(t, "nodename", pod.Spec.NodeName)
+	assert.Nil(t, pod.Spec.InitContainers)
+	assert.Nil(t, pod.Spec.Volumes)
+	assert.Len(t, pod.Spec.ReadinessGates, 1)
+	assert.Equal(t, []v1.Container{{
+		Name:           "web",
+		Ports:          []v1.ContainerPort{{ContainerPort: 80}},
+		LivenessProbe:  probe,
+		ReadinessProbe: probe,
+	}}, pod.Spec.Containers)
+	assert.Equal(t, v1.PodRunning, pod.Status.Phase)
+	assert.Equal(t, "10.0.0.1", pod.Status.PodIP)
+	assert.Equal(t, "192.168.0.1", pod.Status.HostIP)
+	assert.Nil(t, pod.Status.InitContainerStatuses)
+	assert.Len(t, pod.Status.ContainerStatuses, 1)
+
+	// Tombstones are passed as they are
+	tombstone := cache.DeletedFinalStateUnknown{Key: "default/podname"}
+	obj, err = trimPod(tombstone)
+	assert.Nil(t, err)
+	assert.Equal(t, tombstone, obj)
+}
+
+func TestNodeInternalIP(t *testing.T) {
+	t.Parallel()
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "nodename"},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: "nodename"},
+			{Type: v1.NodeInternalIP, Address: "192.168.0.1"},
+		}},
+	})
+	assert.Nil(t, err)
+	err = indexer.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "noaddress"}})
+	assert.Nil(t, err)
+
+	lookup := NodeInternalIP(corelisters.NewNodeLister(indexer))
+	address, err := lookup("nodename")
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.0.1", address)
+
+	_, err = lookup("noaddress")
+	assert.Error(t, err, "An error was expected")
+	_, err = lookup("missing")
+	assert.Error(t, err, "An error was expected")
+}
@@ -1,12 +1,12 @@
 package pods
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/labels"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,10 +16,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/warjiang/kube-consul-register/config"
 	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/annotations"
+	"github.com/warjiang/kube-consul-register/controller/events"
+	"github.com/warjiang/kube-consul-register/controller/finalizer"
+	"github.com/warjiang/kube-consul-register/controller/informers"
+	"github.com/warjiang/kube-consul-register/controller/queue"
 	"github.com/warjiang/kube-consul-register/metrics"
 	"github.com/warjiang/kube-consul-register/utils"
 
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 
 	consulapi "github.com/hashicorp/consul/api"
@@ -34,22 +41,41 @@ import (
 // used to create the resource
 // "ExpectedContainerNamesAnnotation" is a name of container or list of names (separated by comma)
 // which are take into account during register process.
+// "ConsulRegisterServicePortAnnotation" is a name or number of port which is registered.
+// "ConsulRegisterServiceNamedPortsAnnotation" enables registration of every named port as separate service,
+// its value determines whether the port name is added to the service name or to the tags.
+// "ConsulRegisterDrainSecondsAnnotation" is a number of seconds during which services of terminated POD
+// or not ready container are kept in maintenance mode before they are deregistered.
 const (
 	ConsulRegisterEnabledAnnotation           string = "consul.register/enabled"
-	ConsulRegisterServiceNameAnnotation       string = "consul.register/service.name"
-	ConsulRegisterServiceMetaPrefixAnnotation string = "consul.register/service.meta."
+	ConsulRegisterServiceNameAnnotation       string = annotations.ServiceNameAnnotation
+	ConsulRegisterServicePortAnnotation       string = "consul.register/service.port"
+	ConsulRegisterServiceNamedPortsAnnotation string = "consul.register/service.named-ports"
+	ConsulRegisterServiceMetaPrefixAnnotation string = annotations.ServiceMetaPrefixAnnotation
+	ConsulRegisterDrainSecondsAnnotation      string = "consul.register/drain.seconds"
 	CreatedByAnnotation                       string = "kubernetes.io/created-by"
 	ExpectedContainerNamesAnnotation          string = "consul.register/pod.container.name"
 	ContainerProbeLivenessAnnotation          string = "consul.register/pod.container.probe.liveness"
 	ContainerProbeReadinessAnnotation         string = "consul.register/pod.container.probe.readiness"
 )
 
+// These are valid values of `service.named-ports` annotation.
+// "NamedPortsName" adds the port name to the service name, e.g. `web-http`.
+// "NamedPortsTag" keeps the service name and adds `port:<name>` tag.
+const (
+	NamedPortsName string = "name"
+	NamedPortsTag  string = "tag"
+)
+
+// addedPods, addedContainers and notReadyContainers are shared by all workers of the queue.
+// addedContainers keeps services registered for the container, so changes of POD are detected.
+// notReadyContainers keeps containers whose services are kept in Consul by `not_ready_policy`.
 var (
-	addedPods       = make(map[types.UID]bool)
-	addedContainers = make(map[string]bool)
-	addedServices   = make(map[string]bool)
+	addedPods          sync.Map
+	addedContainers    sync.Map
+	notReadyContainers sync.Map
 
-	consulAgents map[string]*consul.Adapter
+	consulAgents map[string]consul.Registry
 )
 
 // Factory has a method to return a FactoryAdapter
@@ -57,59 +83,107 @@ var (
 
 // Controller describes the attributes that are uses by Controller
 type Controller struct {
-	clientset      *kubernetes.Clientset
-	consulInstance consul.Adapter
+	clientset      kubernetes.Interface
+	consulInstance consul.Registry
 	cfg            *config.Config
 	namespace      string
 	mutex          *sync.Mutex
+
+	queue       *queue.Queue
+	podInformer cache.SharedIndexInformer
+	podLister   corelisters.PodLister
+	// nodeLister is set only in `node` mode
+	nodeLister corelisters.NodeLister
+	// owners resolves Deployment or CronJob of pods, which is used as the name of service
+	owners *ownerResolver
+	// deleted keeps the last known state of deleted pods until they are reconciled
+	deleted sync.Map
+	// drains keeps timers of drains of containers whose services are in maintenance mode
+	drains *drainer
+	// rechecks keeps keys of pods whose readiness gate is checked again
+	rechecks sync.Map
+	// recorder records events about registration of pods
+	recorder *events.Recorder
 }
 
-// New creates an instance of controller
-func New(clientset *kubernetes.Clientset, consulInstance consul.Adapter, cfg *config.Config, namespace string) FactoryAdapter {
-	return &Controller{
+// New creates an instance of controller. Informers are taken from the informerFactory,
+// which has to be started and synced before the controller is used.
+func New(clientset kubernetes.Interface, informerFactory kubeinformers.SharedInformerFactory, consulInstance consul.Registry, cfg *config.Config, namespace string) FactoryAdapter {
+	podInformer := informers.Pods(informerFactory)
+
+	c := &Controller{
 		clientset:      clientset,
 		consulInstance: consulInstance,
 		cfg:            cfg,
 		namespace:      namespace,
-		mutex:          &sync.Mutex{}}
+		mutex:          &sync.Mutex{},
+		podInformer:    podInformer.Informer(),
+		podLister:      podInformer.Lister(),
+		owners: &ownerResolver{
+			replicaSetLister: informers.ReplicaSets(informerFactory).Lister(),
+			jobLister:        informers.Jobs(informerFactory).Lister(),
+		}}
+	if cfg.Controller.RegisterMode == config.RegisterNodeMode {
+		c.nodeLister = informers.Nodes(informerFactory).Lister()
+	}
+	c.queue = queue.New("pods", c.reconcile)
+	c.drains = newDrainer(c.queue.AddKey)
+	c.recorder = events.NewRecorder(clientset)
+	return c
 }
 
-func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
-	consulAgents = make(map[string]*consul.Adapter)
-	ctx := context.TODO()
+func (c *Controller) cacheConsulAgent() (map[string]consul.Registry, error) {
+	agents := make(map[string]consul.Registry)
 	//Cache Consul's Agents
 	if c.cfg.Controller.RegisterMode == config.RegisterSingleMode {
 		consulAgent := c.consulInstance.New(c.cfg, "", "")
-		consulAgents[c.cfg.Controller.ConsulAddress] = consulAgent
+		agents[c.cfg.Controller.ConsulAddress] = consulAgent
 
 	} else if c.cfg.Controller.RegisterMode == config.RegisterNodeMode {
-		nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
-			LabelSelector: c.cfg.Controller.ConsulNodeSelector,
-		})
+		selector, err := labels.Parse(c.cfg.Controller.ConsulNodeSelector)
 		if err != nil {
-			return consulAgents, err
+			return agents, err
+		}
+		nodes, err := c.nodeLister.List(selector)
+		if err != nil {
+			return agents, err
 		}
 
-		for _, node := range nodes.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
-			consulAgents[node.ObjectMeta.Name] = consulAgent
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+			agents[node.ObjectMeta.Name] = consulAgent
 		}
 	} else if c.cfg.Controller.RegisterMode == config.RegisterPodMode {
-		pods, err := c.clientset.CoreV1().Pods(c.namespace).List(ctx, metav1.ListOptions{
-			LabelSelector: c.cfg.Controller.PodLabelSelector,
-		})
+		pods, err := c.listPods()
 		if err != nil {
-			return consulAgents, err
+			return agents, err
 		}
-		for _, pod := range pods.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, "", pod.Status.HostIP)
-			consulAgents[pod.Status.HostIP] = consulAgent
+		for _, pod := range pods {
+			consulAgent := c.consulInstance.New(c.cfg, "", pod.Status.HostIP)
+			agents[pod.Status.HostIP] = consulAgent
+		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		// Every synthetic node in the catalog is treated as separate agent
+		nodes, err := consul.Nodes(c.consulInstance.New(c.cfg, "", ""))
+		if err != nil {
+			return agents, err
+		}
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, node, "")
+			agents[node] = consulAgent
 		}
 	}
 
-	return consulAgents, nil
+	consul.SkipInvalidAgents(agents)
+
+	// Drop clients of agents which have disappeared. The lock is held only while
+	// the cached agents are swapped, so listing of agents doesn't block each other.
+	c.mutex.Lock()
+	consul.InvalidateAgents(consulAgents, agents)
+	consulAgents = agents
+	c.mutex.Unlock()
+
+	return agents, nil
 }
 
 // Clean checks Consul services and remove them if service does not appear in K8S cluster
@@ -118,35 +192,27 @@ func (c *Controller) Clean() error {
 	defer timer.ObserveDuration()
 
 	var podsInCluster []*PodInfo
-	var err error
-
-	c.mutex.Lock()
-
-	consulAgents, err = c.cacheConsulAgent()
+	var addedServices = make(map[string]bool)
+	agents, err := c.cacheConsulAgent()
 	if err != nil {
-		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
 	}
 
 	// Get list of added Consul' services
-	addedConsulServices, err := c.getAddedConsulServices()
+	addedConsulServices, _, err := c.getAddedConsulServices(consul.ListAgents(agents))
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 
 	// Make list of Kubernetes PODs
-	pods, err := c.clientset.CoreV1().Pods(c.namespace).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: c.cfg.Controller.PodLabelSelector,
-	})
+	pods, err := c.listPods()
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 
-	for _, pod := range pods.Items {
+	for _, pod := range pods {
 		podInfo := &PodInfo{}
-		podInfo.save(&pod)
+		podInfo.save(pod)
 
 		// If miss or consul.register/enabled annotation is set on `false` then skip pod
 		if !podInfo.isRegisterEnabled() {
@@ -154,8 +220,13 @@ func (c *Controller) Clean() error {
 		}
 
 		for _, container := range podInfo.ContainerStatuses {
-			serviceID := fmt.Sprintf("%s-%s", podInfo.Name, container.Name)
-			addedServices[serviceID] = true
+			// Services of terminated POD are kept only during drain
+			if podInfo.isTerminated() && !c.drains.draining(container.ContainerID) {
+				continue
+			}
+			for _, serviceID := range podInfo.serviceIDs(container.Name, c.cfg) {
+				addedServices[serviceID] = true
+			}
 		}
 
 		podsInCluster = append(podsInCluster, podInfo) // nolint: megacheck
@@ -166,7 +237,7 @@ func (c *Controller) Clean() error {
 	for serviceID, consulAgentID := range addedConsulServices {
 		if _, ok := addedServices[serviceID]; !ok {
 			service := &consulapi.AgentServiceRegistration{ID: serviceID}
-			err := consulAgents[consulAgentID].Deregister(service)
+			err := agents[consulAgentID].Deregister(service)
 			if err != nil {
 				glog.Errorf("Can't deregister service: %s", err)
 				continue
@@ -176,7 +247,6 @@ func (c *Controller) Clean() error {
 			delete(addedConsulServices, service.ID)
 		}
 	}
-	c.mutex.Unlock()
 	return nil
 }
 
@@ -185,135 +255,223 @@ func (c *Controller) Sync() error {
 	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("sync"))
 	defer timer.ObserveDuration()
 
-	var err error
-	c.mutex.Lock()
-
-	consulAgents, err = c.cacheConsulAgent()
+	agents, err := c.cacheConsulAgent()
 	if err != nil {
-		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
 	}
-	glog.V(2).Infof("Agents: %#v", consulAgents)
+	glog.V(2).Infof("Agents: %#v", agents)
 
 	// Get list of added Consul' services
-	addedConsulServices, err := c.getAddedConsulServices()
+	addedConsulServices, consulServices, err := c.getAddedConsulServices(consul.ListAgents(agents))
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
-	pods, err := c.clientset.CoreV1().Pods(c.namespace).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: c.cfg.Controller.PodLabelSelector,
-	})
+	pods, err := c.listPods()
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 
-	for _, pod := range pods.Items {
+	for _, pod := range pods {
 		podInfo := &PodInfo{}
-		podInfo.save(&pod)
+		podInfo.save(pod)
 
 		// If miss or consul.register/enabled annotation is set on `false` then skip pod
 		if !podInfo.isRegisterEnabled() {
+			// Finalizer of disabled object is stripped in reconcile
+			if finalizer.Has(pod) {
+				c.queue.Add(pod)
+			}
+			continue
+		}
+
+		// Terminated POD isn't registered again, it's reconciled only to remove its finalizer
+		if podInfo.isTerminated() {
+			if finalizer.Has(pod) {
+				c.queue.Add(pod)
+			}
 			continue
 		}
+		// Readiness gate of POD whose services aren't registered yet is checked again
+		if hasReadinessGate(pod) {
+			if condition := registeredCondition(pod); condition == nil || condition.Status != v1.ConditionTrue {
+				c.queue.Add(pod)
+			}
+		}
+		podInfo.OwnerKind, podInfo.OwnerName, _ = c.owners.resolve(podInfo.Namespace, podInfo.OwnerReferences)
 
 		for _, container := range podInfo.ContainerStatuses {
-			serviceID := fmt.Sprintf("%s-%s", podInfo.Name, container.Name)
-			// If service does not appears in Consul's services then remove
-			// container from addedContainers map and call update.
-			if _, ok := addedConsulServices[serviceID]; !ok {
-				delete(addedContainers, container.ContainerID)
-				if err := eventUpdateFunc(&pod, c.consulInstance, c.cfg); err != nil {
-					glog.Errorf("Failed to sync pod: %s: %s", podInfo.Name, err)
+			for _, serviceID := range podInfo.serviceIDs(container.Name, c.cfg) {
+				// If service does not appears in Consul's services then remove
+				// container from addedContainers map and reconcile the pod.
+				if _, ok := addedConsulServices[serviceID]; !ok {
+					addedContainers.Delete(container.ContainerID)
+					notReadyContainers.Delete(container.ContainerID)
+					c.queue.Add(pod)
+				}
+			}
+
+			// Registered service is compared with the desired one,
+			// e.g. tags could be changed in Consul or in annotations of POD
+			if podInfo.Phase != v1.PodRunning || !container.Ready {
+				continue
+			}
+			services, err := podInfo.PodToConsulServices(container, c.cfg)
+			if err != nil {
+				continue
+			}
+			for _, service := range services {
+				actual, ok := consulServices[service.ID]
+				if !ok {
+					continue
+				}
+				if consul.CheckDrift(service, actual) {
+					addedContainers.Delete(container.ContainerID)
+					c.queue.Add(pod)
+					continue
+				}
+				// TTL of readiness check is refreshed while container is ready
+				if _, notReady := notReadyContainers.Load(container.ContainerID); !notReady && c.cfg.Controller.NotReadyPolicy == config.NotReadyCritical {
+					consulAgent := agents[addedConsulServices[service.ID]]
+					if err := consul.UpdateTTL(consulAgent, readinessCheckID(service.ID), "Container is ready", consulapi.HealthPassing); err != nil {
+						glog.Errorf("Can't update TTL of service %s: %s", service.ID, err)
+					}
 				}
 			}
 		}
 	}
-	c.mutex.Unlock()
 	return nil
 }
 
 // Watch watches events in K8S cluster
 func (c *Controller) Watch() {
-	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "pods", c.namespace,
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1.Pod{},
-		time.Second*0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("add"))
-				defer timer.ObserveDuration()
-
-				podInfo := &PodInfo{}
-				podInfo.save(obj)
-
-				glog.V(1).Infof("POD ADD: Name: %s, Namespace: %s, Phase: %s", podInfo.Name, podInfo.Namespace, podInfo.Phase)
-				metrics.PodSuccess.WithLabelValues("add").Inc()
-			},
-			DeleteFunc: func(obj interface{}) {
-				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("delete"))
-				defer timer.ObserveDuration()
-
-				if !utils.HasLabel(obj.(*v1.Pod).ObjectMeta.Labels, c.cfg.Controller.PodLabelSelector) && c.cfg.Controller.PodLabelSelector != "" {
-					glog.Infof("Skip pod %s. Label selector is %s, pod's labels: %#v",
-						obj.(*v1.Pod).ObjectMeta.Name, c.cfg.Controller.PodLabelSelector, obj.(*v1.Pod).ObjectMeta.Labels)
-					return
-				}
-				c.mutex.Lock()
-				if err := eventDeleteFunc(obj, c.consulInstance, c.cfg); err != nil {
-					glog.Errorf("Failed to delete pods: %s", err)
-				}
-				c.mutex.Unlock()
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("update"))
-				defer timer.ObserveDuration()
-
-				if !utils.HasLabel(newObj.(*v1.Pod).ObjectMeta.Labels, c.cfg.Controller.PodLabelSelector) && c.cfg.Controller.PodLabelSelector != "" {
-					glog.Infof("Skip pod %s. Label selector is %s, pod's labels: %#v",
-						newObj.(*v1.Pod).ObjectMeta.Name, c.cfg.Controller.PodLabelSelector, newObj.(*v1.Pod).ObjectMeta.Labels)
-					return
-				}
-				c.mutex.Lock()
-				if err := eventUpdateFunc(newObj, c.consulInstance, c.cfg); err != nil {
-					glog.Errorf("Failed to update pods: %s", err)
-				}
-				c.mutex.Unlock()
-			},
+	c.podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			podInfo := &PodInfo{}
+			podInfo.save(obj)
+
+			glog.V(1).Infof("POD ADD: Name: %s, Namespace: %s, Phase: %s", podInfo.Name, podInfo.Namespace, podInfo.Phase)
+			metrics.PodSuccess.WithLabelValues("add").Inc()
+			if c.isSelected(obj.(*v1.Pod)) {
+				c.queue.Add(obj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*v1.Pod)
+			if !ok || !c.isSelected(pod) {
+				return
+			}
+			key, err := cache.MetaNamespaceKeyFunc(pod)
+			if err != nil {
+				glog.Errorf("Failed to delete pods: %s", err)
+				return
+			}
+			c.deleted.Store(key, pod)
+			c.queue.AddKey(key)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if c.isSelected(newObj.(*v1.Pod)) {
+				c.queue.Add(newObj)
+			}
 		},
-	)
+	})
 
 	stop := make(chan struct{})
-	controller.Run(stop)
+	c.queue.Run(c.cfg.Controller.Workers, stop)
+}
+
+// listPods returns pods from the cache which match `pod_label_selector` option
+func (c *Controller) listPods() ([]*v1.Pod, error) {
+	selector, err := labels.Parse(c.cfg.Controller.PodLabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	return c.podLister.Pods(c.namespace).List(selector)
+}
+
+// isSelected checks if pod matches `pod_label_selector` option
+func (c *Controller) isSelected(pod *v1.Pod) bool {
+	if !utils.HasLabel(pod.ObjectMeta.Labels, c.cfg.Controller.PodLabelSelector) && c.cfg.Controller.PodLabelSelector != "" {
+		glog.Infof("Skip pod %s. Label selector is %s, pod's labels: %#v",
+			pod.ObjectMeta.Name, c.cfg.Controller.PodLabelSelector, pod.ObjectMeta.Labels)
+		return false
+	}
+	return true
+}
+
+// reconcile deregisters services of deleted pod and registers services of existing pod with the given key
+func (c *Controller) reconcile(key string) error {
+	if pod, ok := c.deleted.Load(key); ok {
+		if err := eventDeleteFunc(pod, c.consulInstance, c.cfg, c.drains, c.recorder); err != nil {
+			return err
+		}
+		c.deleted.CompareAndDelete(key, pod)
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	pod, err := c.podLister.Pods(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Terminated POD is deregistered before it's deleted
+	podInfo := &PodInfo{}
+	podInfo.save(pod)
+	if podInfo.isTerminated() {
+		if err := eventTerminateFunc(podInfo, c.consulInstance, c.cfg, c.drains, c.recorder); err != nil {
+			return err
+		}
+		if err := c.updateReadinessGate(pod, podInfo); err != nil {
+			return err
+		}
+		return c.releasePod(pod, podInfo)
+	}
+	if err := eventUpdateFunc(pod, c.consulInstance, c.cfg, c.owners, c.drains, c.recorder); err != nil {
+		return err
+	}
+	if err := c.updateReadinessGate(pod, podInfo); err != nil {
+		return err
+	}
+	return c.updateFinalizer(pod, podInfo)
 }
 
-// getAddedConsulServices returns the list of added Consul Services
-func (c *Controller) getAddedConsulServices() (map[string]string, error) {
+// getAddedConsulServices returns the list of added Consul Services, agents which can't be listed are skipped
+func (c *Controller) getAddedConsulServices(listedAgents map[string]consul.AgentServices) (map[string]string, map[string]*consulapi.AgentService, error) {
 	var addedServices = make(map[string]string)
+	var consulServices = make(map[string]*consulapi.AgentService)
 
 	// Make list of Consul's services
-	for consulAgentID, consulAgent := range consulAgents {
-		services, err := consulAgent.Services()
+	for consulAgentID, listed := range listedAgents {
+		services, err := listed.Services, listed.Err
 		if err != nil {
 			glog.Errorf("Can't get services from Consul Agent, register mode=%s: %s", c.cfg.Controller.RegisterMode, err)
 		} else {
 			glog.V(3).Infof("agent: %#v, services: %#v", consulAgentID, services)
 			for _, service := range services {
-				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) {
+				// Services of other clusters and sources are skipped
+				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) &&
+					utils.CheckK8sCluster(service.Meta, c.cfg.Controller.ClusterID, c.cfg.Controller.AdoptLegacy) &&
+					utils.CheckK8sSource(service.Meta, config.RegisterSourcePod, c.cfg.Controller.RegisterSources) {
 					addedServices[service.ID] = consulAgentID
+					consulServices[service.ID] = service
 				}
 			}
 		}
 	}
-	return addedServices, nil
+	return addedServices, consulServices, nil
 }
 
-func eventDeleteFunc(obj interface{}, consulInstance consul.Adapter, cfg *config.Config) error {
+func eventDeleteFunc(obj interface{}, consulInstance consul.Registry, cfg *config.Config, drains *drainer, recorder *events.Recorder) error {
 	podInfo := &PodInfo{}
 	podInfo.save(obj)
 
@@ -321,7 +479,9 @@ func eventDeleteFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 		return nil
 	}
 	glog.Infof("POD DELETE: Name: %s, Namespace: %s, Phase: %s, Ready: %s", podInfo.Name, podInfo.Namespace, podInfo.Phase, podInfo.Ready)
-	delete(addedPods, podInfo.UID)
+	addedPods.Delete(podInfo.UID)
+
+	var failed consul.Failures
 
 	for _, container := range podInfo.ContainerStatuses {
 		glog.Infof("Container %s in POD %s has status: Ready:%t", container.Name, podInfo.Name, container.Ready)
@@ -331,35 +491,194 @@ func eventDeleteFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 
 		// Consul Agent
 		consulAgent := consulInstance.New(cfg, podInfo.NodeName, podInfo.IP)
-		serviceID := fmt.Sprintf("%s-%s", podInfo.Name, container.Name)
-		service := &consulapi.AgentServiceRegistration{ID: serviceID}
+		for _, serviceID := range podInfo.serviceIDs(container.Name, cfg) {
+			service := &consulapi.AgentServiceRegistration{ID: serviceID}
+			err := consulAgent.Deregister(service)
+			if err != nil {
+				glog.Errorf("Can't deregister service: %s", err)
+				metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+				recorder.ConsulFailed(podInfo.reference(), "deregister", service.ID, consulAgent.Address(), err)
+				failed.Add(err)
+			} else {
+				metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+				recorder.Deregistered(podInfo.reference(), service.ID, consulAgent.Address())
+				glog.Infof("Service's been deregistered, ID: %s", service.ID)
+				glog.V(2).Infof("%#v", service)
+			}
+		}
+
+		addedContainers.Delete(container.ContainerID)
+		notReadyContainers.Delete(container.ContainerID)
+		drains.stop(container.ContainerID)
+	}
+
+	if failed.Count > 0 {
+		metrics.PodFailure.WithLabelValues("delete").Inc()
+		return failed.Err("Can't deregister %d service(s) of POD %s", failed.Count, podInfo.Name)
+	}
+	metrics.PodSuccess.WithLabelValues("delete").Inc()
+	return nil
+}
+
+// eventDisableFunc deregisters services of POD whose registration has been turned off
+func eventDisableFunc(podInfo *PodInfo, consulInstance consul.Registry, cfg *config.Config, drains *drainer, recorder *events.Recorder) error {
+	if !podInfo.isRegistered() {
+		return nil
+	}
+	glog.Infof("POD DISABLE: Name: %s, Namespace: %s, Phase: %s, Ready: %s", podInfo.Name, podInfo.Namespace, podInfo.Phase, podInfo.Ready)
+
+	var failed consul.Failures
+	consulAgent := consulInstance.New(cfg, podInfo.NodeName, podInfo.IP)
+	for _, container := range podInfo.ContainerStatuses {
+		if registered, ok := addedContainers.Load(container.ContainerID); ok {
+			failed.Merge(deregisterContainer(podInfo, consulAgent, container.ContainerID, registered.([]*consulapi.AgentServiceRegistration), drains, recorder))
+		}
+	}
+
+	addedPods.Delete(podInfo.UID)
+	if failed.Count > 0 {
+		metrics.PodFailure.WithLabelValues("disable").Inc()
+		return failed.Err("Can't deregister %d service(s) of POD %s", failed.Count, podInfo.Name)
+	}
+	metrics.PodSuccess.WithLabelValues("disable").Inc()
+	return nil
+}
+
+// eventTerminateFunc deregisters services of POD which is being deleted or whose containers have terminated.
+// If drain is given in `drain.seconds` annotation or `drain_delay` option then services are put
+// into maintenance mode first and they are deregistered when drain ends.
+func eventTerminateFunc(podInfo *PodInfo, consulInstance consul.Registry, cfg *config.Config, drains *drainer, recorder *events.Recorder) error {
+	if !podInfo.isRegisterEnabled() {
+		return eventDisableFunc(podInfo, consulInstance, cfg, drains, recorder)
+	}
+	if !podInfo.isRegistered() {
+		return nil
+	}
+
+	reason := fmt.Sprintf("POD %s has %s phase", podInfo.Name, podInfo.Phase)
+	if podInfo.Terminating {
+		reason = fmt.Sprintf("POD %s is being deleted", podInfo.Name)
+	}
+
+	var failed consul.Failures
+	var draining bool
+	consulAgent := consulInstance.New(cfg, podInfo.NodeName, podInfo.IP)
+	for _, container := range podInfo.ContainerStatuses {
+		registered, ok := addedContainers.Load(container.ContainerID)
+		if !ok {
+			continue
+		}
+		services := registered.([]*consulapi.AgentServiceRegistration)
+
+		drained, err := drainContainer(podInfo, container, services, consulAgent, cfg, drains, reason)
+		if err != nil {
+			glog.Errorf("Can't drain services of container %s in POD %s: %s", container.Name, podInfo.Name, err)
+			failed.Add(err)
+			continue
+		}
+		if !drained {
+			draining = true
+			continue
+		}
+		glog.Infof("POD TERMINATE: Name: %s, Namespace: %s, Container: %s, Reason: %s", podInfo.Name, podInfo.Namespace, container.Name, reason)
+		failed.Merge(deregisterContainer(podInfo, consulAgent, container.ContainerID, services, drains, recorder))
+	}
+
+	if failed.Count > 0 {
+		metrics.PodFailure.WithLabelValues("terminate").Inc()
+		return failed.Err("Can't deregister %d service(s) of POD %s", failed.Count, podInfo.Name)
+	}
+	if !draining {
+		addedPods.Delete(podInfo.UID)
+		metrics.PodSuccess.WithLabelValues("terminate").Inc()
+	}
+	return nil
+}
+
+// drainContainer puts services of container into maintenance mode with the given reason and starts
+// drain, if it's given in `drain.seconds` annotation or `drain_delay` option. It returns true
+// if services can be deregistered, i.e. drain is not set or it has ended.
+func drainContainer(podInfo *PodInfo, container v1.ContainerStatus, services []*consulapi.AgentServiceRegistration,
+	consulAgent consul.Registry, cfg *config.Config, drains *drainer, reason string) (bool, error) {
+	delay := podInfo.drainDelay(cfg)
+	if delay == 0 || drains == nil || drains.ended(container.ContainerID) {
+		return true, nil
+	}
+	if drains.draining(container.ContainerID) {
+		return false, nil
+	}
+
+	for _, service := range services {
+		if err := consul.EnableMaintenance(consulAgent, service.ID, reason); err != nil {
+			metrics.PodFailure.WithLabelValues("drain").Inc()
+			return false, err
+		}
+	}
+	drains.start(container.ContainerID, podInfo.Namespace+"/"+podInfo.Name, delay)
+	glog.Infof("POD DRAIN: Name: %s, Namespace: %s, Container: %s, Reason: %s, Delay: %s", podInfo.Name, podInfo.Namespace, container.Name, reason, delay)
+	metrics.PodSuccess.WithLabelValues("drain").Inc()
+	return false, nil
+}
+
+// undrainContainer takes services of container out of maintenance mode if drain has been started
+func undrainContainer(container v1.ContainerStatus, services []*consulapi.AgentServiceRegistration, consulAgent consul.Registry, drains *drainer) error {
+	if !drains.stop(container.ContainerID) {
+		return nil
+	}
+	var failed int
+	for _, service := range services {
+		if err := consul.DisableMaintenance(consulAgent, service.ID); err != nil {
+			glog.Errorf("Can't disable maintenance of service %s: %s", service.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Can't disable maintenance of %d service(s)", failed)
+	}
+	return nil
+}
+
+// deregisterContainer deregisters services registered for the container of POD.
+// It returns failures of deregistrations.
+func deregisterContainer(podInfo *PodInfo, consulAgent consul.Registry, containerID string, services []*consulapi.AgentServiceRegistration,
+	drains *drainer, recorder *events.Recorder) consul.Failures {
+	var failed consul.Failures
+	for _, service := range services {
 		err := consulAgent.Deregister(service)
 		if err != nil {
 			glog.Errorf("Can't deregister service: %s", err)
-			metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+			metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+			recorder.ConsulFailed(podInfo.reference(), "deregister", service.ID, consulAgent.Address(), err)
+			failed.Add(err)
 		} else {
-			metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+			metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+			recorder.Deregistered(podInfo.reference(), service.ID, consulAgent.Address())
 			glog.Infof("Service's been deregistered, ID: %s", service.ID)
-			glog.V(2).Infof("%#v", service)
 		}
-
-		delete(addedContainers, container.ContainerID)
 	}
-
-	metrics.PodSuccess.WithLabelValues("delete").Inc()
-	return nil
+	// Container is kept in the map, so deregistration is retried
+	if failed.Count == 0 {
+		addedContainers.Delete(containerID)
+		notReadyContainers.Delete(containerID)
+		drains.stop(containerID)
+	}
+	return failed
 }
 
-func eventUpdateFunc(obj interface{}, consulInstance consul.Adapter, cfg *config.Config) error {
+func eventUpdateFunc(obj interface{}, consulInstance consul.Registry, cfg *config.Config, owners *ownerResolver, drains *drainer, recorder *events.Recorder) error {
 	podInfo := &PodInfo{}
 	podInfo.save(obj)
+	podInfo.OwnerKind, podInfo.OwnerName, _ = owners.resolve(podInfo.Namespace, podInfo.OwnerReferences)
 
 	message := fmt.Sprintf("POD UPDATE: Name: %s, Namespace: %s, Phase: %s, Ready: %s", podInfo.Name, podInfo.Namespace, podInfo.Phase, podInfo.Ready)
 
 	if !podInfo.isRegisterEnabled() {
-		return nil
+		// Registration could have been turned off on the running POD
+		return eventDisableFunc(podInfo, consulInstance, cfg, drains, recorder)
 	}
 
+	var failed consul.Failures
+
 	//Add service if POD has 'Running' status
 	if podInfo.Phase == v1.PodRunning {
 		glog.Info(message)
@@ -377,40 +696,125 @@ func eventUpdateFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 
 			glog.Infof("Container %s in POD %s has status: Ready:%t", container.Name, podInfo.Name, container.Ready)
 
+			registered, added := addedContainers.Load(container.ContainerID)
+
 			//Add service to consul
-			if _, ok := addedContainers[container.ContainerID]; !ok && container.Ready {
-				glog.Infof("Adding service for container %s in POD %s to consul", container.Name, podInfo.Name)
-				// Convert POD to Consul's service
-				service, err := podInfo.PodToConsulService(container, cfg)
+			if container.Ready {
+				// Convert POD to Consul's services, one per registered port
+				services, err := podInfo.PodToConsulServices(container, cfg)
 				if err != nil {
 					glog.Errorf("Can't convert POD to Consul's service: %s", err)
 					metrics.PodFailure.WithLabelValues("update").Inc()
+					recorder.ConversionFailed(podInfo.reference(), err)
 					continue
 				}
 
 				// Consul Agent
 				consulAgent := consulInstance.New(cfg, podInfo.NodeName, podInfo.IP)
-				err = consulAgent.Register(service)
-				if err != nil {
-					glog.Errorf("Can't register service: %s", err)
-					metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+
+				// Drain of container which is ready again is cancelled
+				if added {
+					if err := undrainContainer(container, registered.([]*consulapi.AgentServiceRegistration), consulAgent, drains); err != nil {
+						glog.Errorf("Can't cancel drain of container %s in POD %s: %s", container.Name, podInfo.Name, err)
+						failed.Add(err)
+						continue
+					}
+				}
+
+				// Services kept in Consul while container was not ready come back
+				if _, notReady := notReadyContainers.Load(container.ContainerID); notReady && added {
+					if err := setContainerReady(consulAgent, registered.([]*consulapi.AgentServiceRegistration), cfg); err != nil {
+						glog.Errorf("Can't restore services of container %s in POD %s: %s", container.Name, podInfo.Name, err)
+						failed.Add(err)
+						continue
+					}
+					notReadyContainers.Delete(container.ContainerID)
+					glog.Infof("Services of container %s in POD %s have been restored", container.Name, podInfo.Name)
+				}
+
+				// Services are registered again only if annotations or labels of POD change them
+				if added && reflect.DeepEqual(registered, services) {
+					continue
+				}
+				glog.Infof("Adding service for container %s in POD %s to consul", container.Name, podInfo.Name)
+
+				if added {
+					remaining, n := deregisterStaleServices(podInfo, consulAgent, registered.([]*consulapi.AgentServiceRegistration), services, recorder)
+					if n.Count > 0 {
+						// Services which haven't been deregistered are kept, so they are deregistered on retry
+						addedContainers.Store(container.ContainerID, remaining)
+						failed.Merge(n)
+						continue
+					}
+				}
+
+				ok := true
+				for _, service := range services {
+					err = consulAgent.Register(service)
+					if err != nil {
+						glog.Errorf("Can't register service: %s", err)
+						metrics.ConsulFailure.WithLabelValues("register", consulAgent.Address()).Inc()
+						recorder.ConsulFailed(podInfo.reference(), "register", service.ID, consulAgent.Address(), err)
+						ok = false
+						failed.Add(err)
+					} else {
+						glog.Infof("Service's been registered, Name: %s, ID: %s", service.Name, service.ID)
+						glog.V(2).Infof("%#v", service)
+						metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Address()).Inc()
+						recorder.Registered(podInfo.reference(), service.ID, consulAgent.Address())
+					}
+				}
+				// Service registered with the ID of older versions is replaced by the new ones
+				if ok && !added {
+					if err := deregisterLegacyService(podInfo, consulAgent, container.Name, services, cfg, recorder); err != nil {
+						ok = false
+						failed.Add(err)
+					}
+				}
+				if ok {
+					addedContainers.Store(container.ContainerID, services)
 				} else {
-					glog.Infof("Service's been registered, Name: %s, ID: %s", service.Name, service.ID)
-					glog.V(2).Infof("%#v", service)
-					addedContainers[container.ContainerID] = true
-					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+					addedContainers.Delete(container.ContainerID)
 				}
-			} else if _, ok := addedContainers[container.ContainerID]; ok && !container.Ready {
+			} else if added {
+				if _, notReady := notReadyContainers.Load(container.ContainerID); notReady {
+					continue
+				}
+				consulAgent := consulInstance.New(cfg, podInfo.NodeName, podInfo.IP)
+				services := registered.([]*consulapi.AgentServiceRegistration)
+
+				// Services are drained before they are deregistered
+				if cfg.Controller.NotReadyPolicy == config.NotReadyDeregister {
+					reason := fmt.Sprintf("Container %s in POD %s is not ready", container.Name, podInfo.Name)
+					drained, err := drainContainer(podInfo, container, services, consulAgent, cfg, drains, reason)
+					if err != nil {
+						glog.Errorf("Can't drain services of container %s in POD %s: %s", container.Name, podInfo.Name, err)
+						failed.Add(err)
+						continue
+					}
+					if !drained {
+						continue
+					}
+				}
+
 				glog.Warningf("Container %s in POD %s has status: Ready:%t, RestartCount:%d", container.Name, podInfo.Name, container.Ready, container.RestartCount)
-				glog.Warningf("Removing service for container %s in POD %s from consul", container.Name, podInfo.Name)
+				glog.Warningf("Applying `%s` not ready policy to services of container %s in POD %s", cfg.Controller.NotReadyPolicy, container.Name, podInfo.Name)
 
-				delete(addedContainers, container.ContainerID)
+				if err := setContainerNotReady(podInfo, consulAgent, services, cfg, recorder); err != nil {
+					glog.Errorf("Can't apply not ready policy to services of container %s in POD %s: %s", container.Name, podInfo.Name, err)
+					failed.Add(err)
+					continue
+				}
+				if cfg.Controller.NotReadyPolicy == config.NotReadyCritical || cfg.Controller.NotReadyPolicy == config.NotReadyMaintenance {
+					notReadyContainers.Store(container.ContainerID, true)
+				} else {
+					addedContainers.Delete(container.ContainerID)
+					drains.stop(container.ContainerID)
+				}
 			}
 		}
 	} else if podInfo.Phase == v1.PodRunning && podInfo.Ready == v1.ConditionTrue {
-		if _, ok := addedPods[podInfo.UID]; !ok {
-			addedPods[podInfo.UID] = true
-		}
+		addedPods.LoadOrStore(podInfo.UID, true)
 	} else {
 		glog.V(1).Info(message)
 
@@ -420,31 +824,292 @@ func eventUpdateFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 		}
 	}
 
+	if failed.Count > 0 {
+		return failed.Err("Can't register %d service(s) of POD %s", failed.Count, podInfo.Name)
+	}
 	metrics.PodSuccess.WithLabelValues("update").Inc()
 	return nil
 }
 
+// setContainerNotReady applies `not_ready_policy` to services of container which is not ready
+func setContainerNotReady(podInfo *PodInfo, consulAgent consul.Registry, services []*consulapi.AgentServiceRegistration, cfg *config.Config, recorder *events.Recorder) error {
+	var failed consul.Failures
+	for _, service := range services {
+		var err error
+		switch cfg.Controller.NotReadyPolicy {
+		case config.NotReadyCritical:
+			err = consul.UpdateTTL(consulAgent, readinessCheckID(service.ID), "Container is not ready", consulapi.HealthCritical)
+		case config.NotReadyMaintenance:
+			err = consul.EnableMaintenance(consulAgent, service.ID, "Container is not ready")
+		default:
+			err = consulAgent.Deregister(service)
+			if err != nil {
+				metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+				recorder.ConsulFailed(podInfo.reference(), "deregister", service.ID, consulAgent.Address(), err)
+			} else {
+				metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+				recorder.Deregistered(podInfo.reference(), service.ID, consulAgent.Address())
+				glog.Infof("Service's been deregistered, ID: %s", service.ID)
+			}
+		}
+		if err != nil {
+			glog.Errorf("Can't apply not ready policy to service %s: %s", service.ID, err)
+			failed.Add(err)
+		}
+	}
+	if failed.Count > 0 {
+		return failed.Err("%d service(s) failed", failed.Count)
+	}
+	return nil
+}
+
+// setContainerReady reverts `not_ready_policy` applied to services of container which is ready again
+func setContainerReady(consulAgent consul.Registry, services []*consulapi.AgentServiceRegistration, cfg *config.Config) error {
+	var failed int
+	for _, service := range services {
+		var err error
+		switch cfg.Controller.NotReadyPolicy {
+		case config.NotReadyCritical:
+			err = consul.UpdateTTL(consulAgent, readinessCheckID(service.ID), "Container is ready", consulapi.HealthPassing)
+		case config.NotReadyMaintenance:
+			err = consul.DisableMaintenance(consulAgent, service.ID)
+		}
+		if err != nil {
+			glog.Errorf("Can't restore service %s: %s", service.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d service(s) failed", failed)
+	}
+	return nil
+}
+
+// readinessCheckID returns ID of TTL check which reflects readiness of container
+func readinessCheckID(serviceID string) string {
+	return fmt.Sprintf("service:%s:ready", serviceID)
+}
+
+// readinessCheck returns TTL check which reflects readiness of container,
+// it's added to services only in `critical` not ready policy and refreshed on every synchronization
+func readinessCheck(serviceID string, cfg *config.Config) *consulapi.AgentServiceCheck {
+	return &consulapi.AgentServiceCheck{
+		CheckID: readinessCheckID(serviceID),
+		Name:    "Container readiness",
+		TTL:     cfg.Controller.CheckTTL(),
+		Status:  consulapi.HealthPassing,
+	}
+}
+
+// deregisterStaleServices deregisters previously registered services of POD which are replaced
+// by the new ones with other ID or name. It returns registered services which haven't been
+// deregistered and failures of deregistrations.
+func deregisterStaleServices(podInfo *PodInfo, consulAgent consul.Registry, registered, services []*consulapi.AgentServiceRegistration, recorder *events.Recorder) ([]*consulapi.AgentServiceRegistration, consul.Failures) {
+	names := make(map[string]string)
+	for _, service := range services {
+		names[service.ID] = service.Name
+	}
+
+	var remaining []*consulapi.AgentServiceRegistration
+	var failed consul.Failures
+	for _, service := range registered {
+		if name, ok := names[service.ID]; ok && name == service.Name {
+			remaining = append(remaining, service)
+			continue
+		}
+		err := consulAgent.Deregister(service)
+		if err != nil {
+			glog.Errorf("Can't deregister service: %s", err)
+			metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+			recorder.ConsulFailed(podInfo.reference(), "deregister", service.ID, consulAgent.Address(), err)
+			remaining = append(remaining, service)
+			failed.Add(err)
+			continue
+		}
+		glog.Infof("Service's been deregistered, Name: %s, ID: %s", service.Name, service.ID)
+		metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+		recorder.Deregistered(podInfo.reference(), service.ID, consulAgent.Address())
+	}
+	return remaining, failed
+}
+
+// deregisterLegacyService deregisters the service of container registered with `<pod>-<container>` ID
+// by older versions, so it doesn't wait for the clean loop
+func deregisterLegacyService(podInfo *PodInfo, consulAgent consul.Registry, containerName string, services []*consulapi.AgentServiceRegistration,
+	cfg *config.Config, recorder *events.Recorder) error {
+	legacyID := fmt.Sprintf("%s-%s", podInfo.Name, containerName)
+	for _, service := range services {
+		if service.ID == legacyID {
+			return nil
+		}
+	}
+
+	registered, err := consulAgent.List()
+	if err != nil {
+		glog.Errorf("Can't get services from Consul Agent %s: %s", consulAgent.Address(), err)
+		return err
+	}
+	legacy, ok := registered[legacyID]
+	if !ok || !utils.CheckK8sTag(legacy.Tags, cfg.Controller.K8sTag) {
+		return nil
+	}
+	// Older versions haven't set meta, only the tag identifies their services.
+	// Cluster and source are checked only if they are in meta.
+	if _, ok := legacy.Meta[utils.K8sClusterMeta]; ok && !utils.CheckK8sCluster(legacy.Meta, cfg.Controller.ClusterID, cfg.Controller.AdoptLegacy) {
+		return nil
+	}
+	if _, ok := legacy.Meta[utils.K8sSourceMeta]; ok && !utils.CheckK8sSource(legacy.Meta, config.RegisterSourcePod, cfg.Controller.RegisterSources) {
+		return nil
+	}
+	// Service of POD with the same name in other namespace is kept
+	if namespace, ok := legacy.Meta["k8s-namespace"]; ok && namespace != podInfo.Namespace {
+		return nil
+	}
+
+	service := &consulapi.AgentServiceRegistration{ID: legacyID}
+	if err := consulAgent.Deregister(service); err != nil {
+		glog.Errorf("Can't deregister service: %s", err)
+		metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+		recorder.ConsulFailed(podInfo.reference(), "deregister", service.ID, consulAgent.Address(), err)
+		return err
+	}
+	glog.Infof("Service with legacy ID's been deregistered, ID: %s", service.ID)
+	metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+	recorder.Deregistered(podInfo.reference(), service.ID, consulAgent.Address())
+	return nil
+}
+
+// serviceID returns ID of Consul service of the container. Port is given only
+// if every named port of the container is registered as separate service.
+func (p *PodInfo) serviceID(containerName string, port *v1.ContainerPort, cfg *config.Config) string {
+	data := config.ServiceIDData{
+		Namespace: p.Namespace,
+		Pod:       p.Name,
+		Container: containerName,
+		Node:      p.NodeName,
+		UID:       string(p.UID),
+	}
+	if port != nil {
+		data.Port = port.Name
+		data.PortNumber = port.ContainerPort
+	}
+	return cfg.Controller.ServiceID(data)
+}
+
+// serviceIDs returns IDs of all Consul services of the container
+func (p *PodInfo) serviceIDs(containerName string, cfg *config.Config) []string {
+	ports := p.getNamedContainerPorts(containerName)
+	if len(ports) == 0 {
+		return []string{p.serviceID(containerName, nil, cfg)}
+	}
+
+	var serviceIDs []string
+	for i := range ports {
+		serviceIDs = append(serviceIDs, p.serviceID(containerName, &ports[i], cfg))
+	}
+	return serviceIDs
+}
+
+// PodToConsulServices converts POD data to Consul services of the container. If `service.named-ports`
+// annotation is set then every named port is registered as separate service.
+func (p *PodInfo) PodToConsulServices(containerStatus v1.ContainerStatus, cfg *config.Config) ([]*consulapi.AgentServiceRegistration, error) {
+	ports := p.getNamedContainerPorts(containerStatus.Name)
+	if len(ports) == 0 {
+		service, err := p.PodToConsulService(containerStatus, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return withReadinessCheck([]*consulapi.AgentServiceRegistration{service}, cfg), nil
+	}
+
+	base, err := p.PodToConsulService(containerStatus, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*consulapi.AgentServiceRegistration
+	for i := range ports {
+		service := *base
+		service.ID = p.serviceID(containerStatus.Name, &ports[i], cfg)
+		service.Port = int(ports[i].ContainerPort)
+		service.Tags = append([]string{}, base.Tags...)
+		service.Meta = make(map[string]string)
+		for key, value := range base.Meta {
+			service.Meta[key] = value
+		}
+
+		// Check given in annotations is the last one, it's created again for the port of service
+		if annotations.HasHealthCheck(p.Annotations) {
+			check, err := annotations.HealthCheck(p.Annotations, p.IP, ports[i].ContainerPort)
+			if err != nil {
+				return nil, err
+			}
+			service.Checks = append(append(consulapi.AgentServiceChecks{}, base.Checks[:len(base.Checks)-1]...), check)
+		}
+
+		if p.Annotations[ConsulRegisterServiceNamedPortsAnnotation] == NamedPortsTag {
+			service.Tags = utils.UniqueSorted(append(service.Tags, fmt.Sprintf("port:%s", ports[i].Name)))
+		} else {
+			service.Name = fmt.Sprintf("%s-%s", base.Name, ports[i].Name)
+		}
+		services = append(services, &service)
+	}
+	return withReadinessCheck(services, cfg), nil
+}
+
+// withReadinessCheck adds the readiness check to services in `critical` not ready policy
+func withReadinessCheck(services []*consulapi.AgentServiceRegistration, cfg *config.Config) []*consulapi.AgentServiceRegistration {
+	if cfg.Controller.NotReadyPolicy != config.NotReadyCritical {
+		return services
+	}
+	for _, service := range services {
+		service.Checks = append(append(consulapi.AgentServiceChecks{}, service.Checks...), readinessCheck(service.ID, cfg))
+	}
+	return services
+}
+
 // PodToConsulService converts POD data to Consul service structure
 func (p *PodInfo) PodToConsulService(containerStatus v1.ContainerStatus, cfg *config.Config) (*consulapi.AgentServiceRegistration, error) {
 	service := &consulapi.AgentServiceRegistration{}
 
-	if value, ok := p.Annotations[ConsulRegisterServiceNameAnnotation]; ok {
+	if value, ok := annotations.Name(p.Annotations); ok {
 		service.Name = value
 	} else {
-		reference, found := p.getReference()
-		if found {
-			service.Name = reference.Reference.Name
-		} else {
-			service.Name = p.Name
+		data := config.NewServiceNameData(p.Name, metav1.ObjectMeta{
+			Namespace:       p.Namespace,
+			Labels:          p.Labels,
+			Annotations:     p.Annotations,
+			OwnerReferences: p.OwnerReferences,
+		})
+		// Top-level controller is used as default name, so all replicas are registered as one service.
+		// The deprecated created-by annotation is taken into account only for PODs without owner.
+		if p.OwnerName != "" {
+			data.Name = p.OwnerName
+			data.Owner = p.OwnerName
+		} else if reference, found := p.getReference(); found {
+			data.Name = reference.Reference.Name
+			data.Owner = reference.Reference.Name
 		}
+		service.Name = cfg.Controller.ServiceName(data)
 	}
 
-	service.ID = fmt.Sprintf("%s-%s", p.Name, containerStatus.Name)
-	service.Tags = p.labelsToTags(containerStatus.Name)
-	service.Meta = p.annotationsToMeta()
+	service.ID = p.serviceID(containerStatus.Name, nil, cfg)
+	labelTags, labelMeta := cfg.Controller.ConvertLabels(p.Labels)
+	service.Tags = append(p.podTags(containerStatus.Name), labelTags...)
+	service.Tags = append(service.Tags, annotations.Tags(p.Annotations)...)
+	// Meta given in annotations takes precedence over meta converted from labels
+	service.Meta = labelMeta
+	for key, value := range annotations.Meta(p.Annotations) {
+		service.Meta[key] = value
+	}
+	utils.SetOwnerMeta(service.Meta, cfg.Controller.ClusterID, config.RegisterSourcePod, p.Namespace, string(p.UID))
+	if p.OwnerKind != "" {
+		service.Meta[utils.K8sOwnerKindMeta] = p.OwnerKind
+		service.Meta[utils.K8sOwnerNameMeta] = p.OwnerName
+	}
 
 	//Add K8sTag from configuration
-	service.Tags = append(service.Tags, cfg.Controller.K8sTag)
+	service.Tags = utils.UniqueSorted(append(service.Tags, cfg.Controller.K8sTag))
 
 	port := p.getContainerPort(containerStatus.Name)
 	if port == 0 {
@@ -459,10 +1124,39 @@ func (p *PodInfo) PodToConsulService(containerStatus v1.ContainerStatus, cfg *co
 	if p.isProbeReadinessEnabled() {
 		service.Checks = append(service.Checks, p.probeToConsulCheck(p.getContainerReadinessProbe(containerStatus.Name), "Readiness Probe"))
 	}
+	if annotations.HasHealthCheck(p.Annotations) {
+		check, err := annotations.HealthCheck(p.Annotations, p.IP, int32(port))
+		if err != nil {
+			return service, err
+		}
+		service.Checks = append(service.Checks, check)
+	}
 
 	return service, nil
 }
 
+// drainDelay returns drain of services given in `drain.seconds` annotation, the value of `drain_delay` option is the default
+func (p *PodInfo) drainDelay(cfg *config.Config) time.Duration {
+	if value, ok := p.Annotations[ConsulRegisterDrainSecondsAnnotation]; ok {
+		seconds, err := strconv.Atoi(value)
+		if err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterDrainSecondsAnnotation, value)
+	}
+	return cfg.Controller.DrainDelay
+}
+
+// isRegistered returns true if services of any container of POD are registered
+func (p *PodInfo) isRegistered() bool {
+	for _, container := range p.ContainerStatuses {
+		if _, ok := addedContainers.Load(container.ContainerID); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *PodInfo) isRegisterEnabled() bool {
 	if value, ok := p.Annotations[ConsulRegisterEnabledAnnotation]; ok {
 		enabled, err := strconv.ParseBool(value)
@@ -582,46 +1276,72 @@ func (p *PodInfo) getContainerReadinessProbe(searchContainer string) *v1.Probe {
 	return nil
 }
 
-func (p *PodInfo) labelsToTags(containerName string) []string {
+// podTags returns tags which describe POD and container, labels are converted by ConvertLabels
+func (p *PodInfo) podTags(containerName string) []string {
 	var tags []string
 	tags = append(tags, p.Name)
 	tags = append(tags, fmt.Sprintf("pod:%s", p.Name))
 	tags = append(tags, fmt.Sprintf("node:%s", p.NodeName))
 	tags = append(tags, fmt.Sprintf("container:%s", containerName))
-
-	for key, value := range p.Labels {
-		// if value is equal to "tag" then set only key as tag
-		if value == "tag" {
-			tags = append(tags, key)
-		} else {
-			tags = append(tags, fmt.Sprintf("%s:%s", key, value))
-		}
-	}
 	return tags
 }
 
-func (p *PodInfo) annotationsToMeta() map[string]string {
-	meta := make(map[string]string)
-	for key, value := range p.Annotations {
-		if strings.HasPrefix(key, ConsulRegisterServiceMetaPrefixAnnotation) {
-			meta[strings.TrimPrefix(key, ConsulRegisterServiceMetaPrefixAnnotation)] = value
+// getContainerPort returns the port of container which is given in `service.port` annotation
+// as name or number. If the annotation is missing then the first port of container is returned.
+func (p *PodInfo) getContainerPort(searchContainer string) int {
+	value, annotated := p.Annotations[ConsulRegisterServicePortAnnotation]
+	if annotated {
+		// Explicit port number is used also for containers without ports
+		if port, err := strconv.Atoi(value); err == nil {
+			return port
 		}
 	}
-	return meta
-}
 
-func (p *PodInfo) getContainerPort(searchContainer string) int {
 	for _, container := range p.Containers {
-		if container.Name == searchContainer {
-			if len(container.Ports) > 0 {
-				return int(container.Ports[0].ContainerPort)
+		if container.Name != searchContainer {
+			continue
+		}
+		if annotated {
+			for _, port := range container.Ports {
+				if port.Name == value {
+					return int(port.ContainerPort)
+				}
 			}
+			glog.Warningf("Container %s in POD %s hasn't port named %s, the first port is used", searchContainer, p.Name, value)
+		}
+		if len(container.Ports) > 0 {
+			return int(container.Ports[0].ContainerPort)
 		}
 	}
 	glog.Warningf("Container hasn't set ContainerPort")
 	return 0
 }
 
+// getNamedContainerPorts returns named ports of container if `service.named-ports` annotation is set
+func (p *PodInfo) getNamedContainerPorts(searchContainer string) []v1.ContainerPort {
+	value, ok := p.Annotations[ConsulRegisterServiceNamedPortsAnnotation]
+	if !ok {
+		return nil
+	}
+	if value != NamedPortsName && value != NamedPortsTag {
+		glog.Errorf("Wrong value of %s annotation: %s. Available values: %s, %s", ConsulRegisterServiceNamedPortsAnnotation, value, NamedPortsName, NamedPortsTag)
+		return nil
+	}
+
+	var ports []v1.ContainerPort
+	for _, container := range p.Containers {
+		if container.Name != searchContainer {
+			continue
+		}
+		for _, port := range container.Ports {
+			if port.Name != "" {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
 func (p *PodInfo) getReference() (v1.SerializedReference, bool) {
 	var sr v1.SerializedReference
 
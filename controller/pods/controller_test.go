@@ -1,14 +1,24 @@
 package pods
 
 import (
+	"context"
+	"fmt"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 	"testing"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/warjiang/kube-consul-register/config"
+	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/events"
+	"github.com/warjiang/kube-consul-register/controller/finalizer"
+	"github.com/warjiang/kube-consul-register/controller/informers"
 	//"k8s.io/client-go/pkg/api/v1"
 	//"k8s.io/client-go/pkg/util/intstr"
 )
@@ -25,6 +35,7 @@ func TestPodInfoMethods(t *testing.T) {
 	annotations["consul.register/service.name"] = "servicename"
 	annotations["consul.register/service.meta.abc"] = "123"
 	annotations["consul.register/service.meta.XYZ"] = "790_0"
+	annotations["consul.register/service.tags"] = "tag1,tag2"
 
 	objPod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -61,18 +72,98 @@ func TestPodInfoMethods(t *testing.T) {
 
 	service, err := podInfo.PodToConsulService(containerStatus, cfg)
 	assert.Error(t, err, "An error was expected")
-	assert.Equal(t, "podname-containername", service.ID)
+	assert.Equal(t, "default-podname-containername", service.ID)
 	assert.Contains(t, service.Tags, "kubernetes")
 	assert.Contains(t, service.Tags, "production")
 	assert.Contains(t, service.Tags, "pod:podname")
 	assert.Contains(t, service.Tags, "podname")
 	assert.Equal(t, service.Meta["abc"], "123")
 	assert.Equal(t, service.Meta["XYZ"], "790_0")
+	assert.Contains(t, service.Tags, "tag1")
+	assert.Contains(t, service.Tags, "tag2")
+
+	// Top-level controller is added to meta
+	podInfo.OwnerKind = "Deployment"
+	podInfo.OwnerName = "deploymentname"
+	service, _ = podInfo.PodToConsulService(containerStatus, cfg)
+	assert.Equal(t, "servicename", service.Name)
+	assert.Equal(t, "Deployment", service.Meta["k8s-owner-kind"])
+	assert.Equal(t, "deploymentname", service.Meta["k8s-owner-name"])
 
 	isEnabledByAnnotation := podInfo.isRegisterEnabled()
 	assert.Equal(t, true, isEnabledByAnnotation)
 }
 
+func TestContainerPorts(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag: "kubernetes",
+		},
+	}
+
+	podInfo := &PodInfo{
+		Name:        "podname",
+		Namespace:   "default",
+		IP:          "127.0.0.1",
+		Annotations: map[string]string{},
+		Containers: []v1.Container{
+			{Name: "app", Ports: []v1.ContainerPort{
+				{Name: "grpc", ContainerPort: 9090},
+				{Name: "metrics", ContainerPort: 9100},
+				{ContainerPort: 9200},
+			}},
+			{Name: "sidecar"},
+		},
+	}
+	app := v1.ContainerStatus{Name: "app"}
+	sidecar := v1.ContainerStatus{Name: "sidecar"}
+
+	// The first port is registered as default
+	services, err := podInfo.PodToConsulServices(app, cfg)
+	assert.Nil(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, 9090, services[0].Port)
+	_, err = podInfo.PodToConsulServices(sidecar, cfg)
+	assert.Error(t, err, "An error was expected")
+
+	// Port is selected by name
+	podInfo.Annotations["consul.register/service.port"] = "metrics"
+	services, _ = podInfo.PodToConsulServices(app, cfg)
+	assert.Equal(t, 9100, services[0].Port)
+
+	// Explicit port is used also for container without ports
+	podInfo.Annotations["consul.register/service.port"] = "8080"
+	services, err = podInfo.PodToConsulServices(sidecar, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 8080, services[0].Port)
+	assert.Equal(t, "default-podname-sidecar", services[0].ID)
+	delete(podInfo.Annotations, "consul.register/service.port")
+
+	// Every named port is registered as separate service
+	podInfo.Annotations["consul.register/service.named-ports"] = "name"
+	services, _ = podInfo.PodToConsulServices(app, cfg)
+	assert.Len(t, services, 2)
+	assert.Equal(t, "default-podname-app-9090", services[0].ID)
+	assert.Equal(t, "podname-grpc", services[0].Name)
+	assert.Equal(t, 9090, services[0].Port)
+	assert.Equal(t, "podname-metrics", services[1].Name)
+	assert.Equal(t, 9100, services[1].Port)
+	assert.Equal(t, []string{"default-podname-app-9090", "default-podname-app-9100"}, podInfo.serviceIDs("app", cfg))
+
+	podInfo.Annotations["consul.register/service.named-ports"] = "tag"
+	services, _ = podInfo.PodToConsulServices(app, cfg)
+	assert.Equal(t, "podname", services[1].Name)
+	assert.Contains(t, services[1].Tags, "port:metrics")
+	assert.NotContains(t, services[0].Tags, "port:metrics")
+
+	// Invalid port of health check is reported
+	podInfo.Annotations["consul.register/service.health.port"] = "http"
+	_, err = podInfo.PodToConsulServices(app, cfg)
+	assert.Error(t, err, "An error was expected")
+}
+
 func TestProbeToConsulCheck(t *testing.T) {
 	t.Parallel()
 	emptyCheck := consulapi.AgentServiceCheck{}
@@ -116,3 +207,994 @@ func TestProbeToConsulCheck(t *testing.T) {
 	assert.Equal(t, emptyCheck, *noProbeCheck)
 	assert.Equal(t, emptyCheck, *execCheck)
 }
+
+func TestSyncAndClean(t *testing.T) {
+	t.Parallel()
+
+	objPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "11111111-89ab-cdef-0123-456789abcdef",
+			Name:        "syncpod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			NodeName: "nodename",
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.1",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://syncpod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:       "localhost",
+			ConsulPort:          "8500",
+			ConsulScheme:        "http",
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			RegisterMode:        config.RegisterSingleMode,
+			RegisterSources:     []string{config.RegisterSourcePod, config.RegisterSourceService},
+			Workers:             2,
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(objPod)
+	informerFactory := informers.NewFactory(clientset, "")
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+	ctr := New(clientset, informerFactory, registry, cfg, "")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+	go ctr.Watch()
+
+	registered := func() bool {
+		services, _ := agent.List()
+		_, ok := services["default-syncpod-web"]
+		return ok
+	}
+
+	// Service is registered by the worker after the pod has been added
+	assert.Eventually(t, registered, 5*time.Second, 10*time.Millisecond)
+	services, _ := agent.List()
+	assert.Equal(t, "10.0.0.1", services["default-syncpod-web"].Address)
+	assert.Equal(t, 80, services["default-syncpod-web"].Port)
+
+	// Missing service is registered again by Sync
+	err := agent.Deregister(&consulapi.AgentServiceRegistration{ID: "default-syncpod-web"})
+	assert.Nil(t, err)
+	err = ctr.Sync()
+	assert.Nil(t, err)
+	assert.Eventually(t, registered, 5*time.Second, 10*time.Millisecond)
+
+	// Drifted service is registered again by Sync
+	services, _ = agent.List()
+	drifted := services["default-syncpod-web"]
+	err = agent.Register(&consulapi.AgentServiceRegistration{
+		ID:      drifted.ID,
+		Name:    drifted.Service,
+		Tags:    []string{"kubernetes", "edited"},
+		Meta:    drifted.Meta,
+		Port:    8080,
+		Address: drifted.Address,
+	})
+	assert.Nil(t, err)
+	err = ctr.Sync()
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		services, _ := agent.List()
+		return services["default-syncpod-web"].Port == 80
+	}, 5*time.Second, 10*time.Millisecond)
+	services, _ = agent.List()
+	assert.NotContains(t, services["default-syncpod-web"].Tags, "edited")
+
+	// Service registered by another source is not cleaned
+	err = agent.Register(&consulapi.AgentServiceRegistration{
+		ID:   "nodeport-service",
+		Tags: []string{"kubernetes"},
+		Meta: map[string]string{"k8s-source": config.RegisterSourceService},
+	})
+	assert.Nil(t, err)
+
+	// Service registered with the legacy ID is cleaned
+	err = agent.Register(&consulapi.AgentServiceRegistration{
+		ID:   "syncpod-web",
+		Tags: []string{"kubernetes"},
+		Meta: map[string]string{"k8s-source": config.RegisterSourcePod},
+	})
+	assert.Nil(t, err)
+
+	// Service registered by another cluster is not cleaned
+	err = agent.Register(&consulapi.AgentServiceRegistration{
+		ID:   "other-cluster-pod",
+		Tags: []string{"kubernetes"},
+		Meta: map[string]string{"k8s-cluster": "other", "k8s-source": config.RegisterSourcePod},
+	})
+	assert.Nil(t, err)
+
+	// Service of existing pod is kept
+	err = ctr.Clean()
+	assert.Nil(t, err)
+	assert.True(t, registered())
+	services, _ = agent.List()
+	assert.Contains(t, services, "nodeport-service")
+	assert.Contains(t, services, "other-cluster-pod")
+	assert.NotContains(t, services, "syncpod-web")
+	assert.Equal(t, "default", services["default-syncpod-web"].Meta["k8s-namespace"])
+	assert.Equal(t, "11111111-89ab-cdef-0123-456789abcdef", services["default-syncpod-web"].Meta["k8s-uid"])
+
+	err = clientset.CoreV1().Pods("default").Delete(context.TODO(), "syncpod", metav1.DeleteOptions{})
+	assert.Nil(t, err)
+
+	// Service is deregistered by the worker after the pod has been deleted
+	assert.Eventually(t, func() bool { return !registered() }, 5*time.Second, 10*time.Millisecond)
+
+	err = ctr.Clean()
+	assert.Nil(t, err)
+	assert.False(t, registered())
+}
+
+func TestCleanAdoptLegacy(t *testing.T) {
+	t.Parallel()
+
+	objPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "bbbbbbbb-89ab-cdef-0123-456789abcdef",
+			Name:        "adoptpod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.11",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://adoptpod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:       "localhost",
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			ClusterID:           "cluster1",
+			AdoptLegacy:         true,
+			RegisterMode:        config.RegisterSingleMode,
+			RegisterSources:     []string{config.RegisterSourcePod},
+			Workers:             1,
+		},
+	}
+
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+
+	// Services registered by older versions have only the tag
+	err := agent.Register(&consulapi.AgentServiceRegistration{ID: "default-adoptpod-web", Tags: []string{"kubernetes"}})
+	assert.Nil(t, err)
+	err = agent.Register(&consulapi.AgentServiceRegistration{ID: "default-deletedpod-web", Tags: []string{"kubernetes"}})
+	assert.Nil(t, err)
+
+	clientset := fake.NewSimpleClientset(objPod)
+	informerFactory := informers.NewFactory(clientset, "")
+	ctr := New(clientset, informerFactory, registry, cfg, "")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+	go ctr.Watch()
+
+	// Adopted service of existing pod is registered again with the cluster in meta
+	err = ctr.Sync()
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		services, _ := agent.List()
+		service, ok := services["default-adoptpod-web"]
+		return ok && service.Meta["k8s-cluster"] == "cluster1"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Adopted service of deleted pod is cleaned
+	err = ctr.Clean()
+	assert.Nil(t, err)
+	services, _ := agent.List()
+	assert.Contains(t, services, "default-adoptpod-web")
+	assert.NotContains(t, services, "default-deletedpod-web")
+}
+
+func TestPodUpdate(t *testing.T) {
+	t.Parallel()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "22222222-89ab-cdef-0123-456789abcdef",
+			Name:        "updpod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+			Labels:      map[string]string{"app": "web"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.2",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://updpod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			RegisterMode:        config.RegisterSingleMode,
+		},
+	}
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+
+	err := eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	services, _ := agent.List()
+	assert.Equal(t, "updpod", services["default-updpod-web"].Service)
+	assert.Contains(t, services["default-updpod-web"].Tags, "app:web")
+
+	// Changed labels and name are applied to the registered service
+	pod.ObjectMeta.Labels["app"] = "api"
+	pod.ObjectMeta.Annotations[ConsulRegisterServiceNameAnnotation] = "api"
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	services, _ = agent.List()
+	assert.Len(t, services, 1)
+	assert.Equal(t, "api", services["default-updpod-web"].Service)
+	assert.Contains(t, services["default-updpod-web"].Tags, "app:api")
+	assert.NotContains(t, services["default-updpod-web"].Tags, "app:web")
+
+	// Service with the old ID is deregistered
+	pod.ObjectMeta.Annotations[ConsulRegisterServiceNamedPortsAnnotation] = NamedPortsName
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	services, _ = agent.List()
+	assert.Len(t, services, 1)
+	assert.Equal(t, "api-http", services["default-updpod-web-80"].Service)
+
+	// Services are deregistered as soon as registration is turned off
+	pod.ObjectMeta.Annotations[ConsulRegisterEnabledAnnotation] = "false"
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	services, _ = agent.List()
+	assert.Empty(t, services)
+	_, added := addedContainers.Load("docker://updpod-web")
+	assert.False(t, added)
+}
+
+func TestLegacyServiceID(t *testing.T) {
+	t.Parallel()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "77777777-89ab-cdef-0123-456789abcdef",
+			Name:        "legacypod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.7",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://legacypod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			ClusterID:           "cluster1",
+			RegisterMode:        config.RegisterSingleMode,
+			RegisterSources:     []string{config.RegisterSourcePod, config.RegisterSourceService},
+		},
+	}
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+
+	// Services registered with the ID of older versions, which have only the tag
+	err := agent.Register(&consulapi.AgentServiceRegistration{
+		ID:   "legacypod-web",
+		Tags: []string{"kubernetes"},
+	})
+	assert.Nil(t, err)
+	err = agent.Register(&consulapi.AgentServiceRegistration{
+		ID:   "legacypod-sidecar",
+		Tags: []string{"kubernetes"},
+		Meta: map[string]string{"k8s-source": config.RegisterSourcePod},
+	})
+	assert.Nil(t, err)
+
+	// Legacy service of registered container is replaced without waiting for Clean
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	services, _ := agent.List()
+	assert.Contains(t, services, "default-legacypod-web")
+	assert.NotContains(t, services, "legacypod-web")
+	assert.Contains(t, services, "legacypod-sidecar")
+
+	// Service of another cluster with the same ID is kept
+	err = agent.Register(&consulapi.AgentServiceRegistration{
+		ID:   "legacypod-web",
+		Tags: []string{"kubernetes"},
+		Meta: map[string]string{"k8s-cluster": "other", "k8s-source": config.RegisterSourcePod},
+	})
+	assert.Nil(t, err)
+	addedContainers.Delete("docker://legacypod-web")
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	services, _ = agent.List()
+	assert.Contains(t, services, "legacypod-web")
+}
+
+// failingRegistry fails every registration and deregistration while fail is set
+type failingRegistry struct {
+	consul.Registry
+	fail *bool
+}
+
+func (f *failingRegistry) New(cfg *config.Config, podNodeName string, podIP string) consul.Registry {
+	return &failingRegistry{Registry: f.Registry.New(cfg, podNodeName, podIP), fail: f.fail}
+}
+
+func (f *failingRegistry) Register(service *consulapi.AgentServiceRegistration) error {
+	if *f.fail {
+		return fmt.Errorf("connection refused")
+	}
+	return f.Registry.Register(service)
+}
+
+func (f *failingRegistry) Deregister(service *consulapi.AgentServiceRegistration) error {
+	if *f.fail {
+		return fmt.Errorf("connection refused")
+	}
+	return f.Registry.Deregister(service)
+}
+
+func TestStaleServicesFailure(t *testing.T) {
+	t.Parallel()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "88888888-89ab-cdef-0123-456789abcdef",
+			Name:        "stalepod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.8",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://stalepod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			RegisterMode:        config.RegisterSingleMode,
+		},
+	}
+	fail := false
+	registry := &failingRegistry{Registry: consul.NewMemory(), fail: &fail}
+	agent := registry.New(cfg, "", "")
+
+	err := eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+
+	// New services aren't registered while the old one can't be deregistered
+	fail = true
+	pod.ObjectMeta.Annotations[ConsulRegisterServiceNamedPortsAnnotation] = NamedPortsName
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Error(t, err, "An error was expected")
+	services, _ := agent.List()
+	assert.Contains(t, services, "default-stalepod-web")
+	assert.NotContains(t, services, "default-stalepod-web-80")
+
+	// Old service is deregistered on retry
+	fail = false
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	services, _ = agent.List()
+	assert.NotContains(t, services, "default-stalepod-web")
+	assert.Contains(t, services, "default-stalepod-web-80")
+}
+
+func TestQueuedFailure(t *testing.T) {
+	t.Parallel()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "99999999-89ab-cdef-0123-456789abcdef",
+			Name:        "queuedpod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.9",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://queuedpod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulContainerName:  "consul",
+			K8sTag:               "kubernetes",
+			RegisterMode:         config.RegisterSingleMode,
+			RetryInitialInterval: time.Second,
+			RetryMaxInterval:     time.Minute,
+		},
+	}
+	fail := true
+	registry := consul.NewRetry(&failingRegistry{Registry: consul.NewMemory(), fail: &fail}, cfg, nil)
+	agent := registry.New(cfg, "", "")
+
+	// Failed registration queued for retry reaches the controller
+	err := eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.ErrorIs(t, err, consul.ErrQueued)
+	_, added := addedContainers.Load("docker://queuedpod-web")
+	assert.False(t, added)
+
+	// Failed deregistration queued for retry reaches the controller
+	fail = false
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	fail = true
+	pod.ObjectMeta.Annotations[ConsulRegisterEnabledAnnotation] = "false"
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.ErrorIs(t, err, consul.ErrQueued)
+	services, _ := agent.List()
+	assert.Contains(t, services, "default-queuedpod-web")
+	_, added = addedContainers.Load("docker://queuedpod-web")
+	assert.True(t, added)
+}
+
+func TestNotReadyPolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []config.NotReadyPolicy{config.NotReadyDeregister, config.NotReadyCritical, config.NotReadyMaintenance} {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				UID:         "33333333-89ab-cdef-0123-456789abcdef",
+				Name:        "notready-" + string(policy),
+				Namespace:   "default",
+				Annotations: map[string]string{"consul.register/enabled": "true"},
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+				},
+			},
+			Status: v1.PodStatus{
+				Phase: v1.PodRunning,
+				PodIP: "10.0.0.3",
+				ContainerStatuses: []v1.ContainerStatus{
+					{Name: "web", ContainerID: "docker://notready-" + string(policy), Ready: true},
+				},
+			},
+		}
+		cfg := &config.Config{
+			Controller: &config.ControllerConfig{
+				ConsulContainerName: "consul",
+				K8sTag:              "kubernetes",
+				RegisterMode:        config.RegisterSingleMode,
+				NotReadyPolicy:      policy,
+			},
+		}
+		registry := consul.NewMemory()
+		agent := registry.New(cfg, "", "")
+		serviceID := "default-notready-" + string(policy) + "-web"
+
+		err := eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+		assert.Nil(t, err)
+		status, _ := agent.Health(serviceID)
+		assert.Equal(t, consulapi.HealthPassing, status, string(policy))
+
+		// Container goes not ready
+		pod.Status.ContainerStatuses[0].Ready = false
+		err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+		assert.Nil(t, err)
+		services, _ := agent.List()
+		if policy == config.NotReadyDeregister {
+			assert.NotContains(t, services, serviceID)
+		} else {
+			assert.Contains(t, services, serviceID, string(policy))
+			status, _ = agent.Health(serviceID)
+			assert.Equal(t, consulapi.HealthCritical, status, string(policy))
+		}
+
+		// Service comes back when container is ready again
+		pod.Status.ContainerStatuses[0].Ready = true
+		err = eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+		assert.Nil(t, err)
+		status, _ = agent.Health(serviceID)
+		assert.Equal(t, consulapi.HealthPassing, status, string(policy))
+	}
+}
+
+func TestTerminatedPod(t *testing.T) {
+	t.Parallel()
+
+	newPod := func(name string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				UID:         types.UID(name),
+				Name:        name,
+				Namespace:   "default",
+				Annotations: map[string]string{"consul.register/enabled": "true"},
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+				},
+			},
+			Status: v1.PodStatus{
+				Phase: v1.PodRunning,
+				PodIP: "10.0.0.4",
+				ContainerStatuses: []v1.ContainerStatus{
+					{Name: "web", ContainerID: "docker://" + name, Ready: true},
+				},
+			},
+		}
+	}
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			RegisterMode:        config.RegisterSingleMode,
+		},
+	}
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+
+	// Services of deleted POD are deregistered right away
+	pod := newPod("terminating")
+	err := eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+	now := metav1.Now()
+	pod.ObjectMeta.DeletionTimestamp = &now
+	podInfo := &PodInfo{}
+	podInfo.save(pod)
+	assert.True(t, podInfo.isTerminated())
+	err = eventTerminateFunc(podInfo, registry, cfg, newDrainer(nil), nil)
+	assert.Nil(t, err)
+	services, _ := agent.List()
+	assert.NotContains(t, services, "default-terminating-web")
+
+	// Services of failed POD are put into maintenance and deregistered after drain
+	requeued := make(chan string, 1)
+	drains := newDrainer(func(podKey string) { requeued <- podKey })
+	pod = newPod("failed")
+	pod.ObjectMeta.Annotations[ConsulRegisterDrainSecondsAnnotation] = "1"
+	err = eventUpdateFunc(pod, registry, cfg, nil, drains, nil)
+	assert.Nil(t, err)
+	pod.Status.Phase = v1.PodFailed
+	podInfo = &PodInfo{}
+	podInfo.save(pod)
+	err = eventTerminateFunc(podInfo, registry, cfg, drains, nil)
+	assert.Nil(t, err)
+	status, _ := agent.Health("default-failed-web")
+	assert.Equal(t, consulapi.HealthCritical, status)
+
+	// Next events of the same POD don't extend drain
+	err = eventTerminateFunc(podInfo, registry, cfg, drains, nil)
+	assert.Nil(t, err)
+	assert.True(t, drains.draining("docker://failed"))
+
+	select {
+	case key := <-requeued:
+		assert.Equal(t, "default/failed", key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("POD hasn't been reconciled after drain")
+	}
+	err = eventTerminateFunc(podInfo, registry, cfg, drains, nil)
+	assert.Nil(t, err)
+	services, _ = agent.List()
+	assert.NotContains(t, services, "default-failed-web")
+	assert.False(t, drains.ended("docker://failed"))
+}
+
+func TestNotReadyDrain(t *testing.T) {
+	t.Parallel()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:       "drainpod",
+			Name:      "drainpod",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"consul.register/enabled":            "true",
+				ConsulRegisterDrainSecondsAnnotation: "60",
+			},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.5",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://drainpod-web", Ready: true},
+			},
+		},
+	}
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			RegisterMode:        config.RegisterSingleMode,
+			NotReadyPolicy:      config.NotReadyDeregister,
+		},
+	}
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+	drains := newDrainer(nil)
+
+	err := eventUpdateFunc(pod, registry, cfg, nil, drains, nil)
+	assert.Nil(t, err)
+
+	// Not ready container is drained before deregistration
+	pod.Status.ContainerStatuses[0].Ready = false
+	err = eventUpdateFunc(pod, registry, cfg, nil, drains, nil)
+	assert.Nil(t, err)
+	status, _ := agent.Health("default-drainpod-web")
+	assert.Equal(t, consulapi.HealthCritical, status)
+	assert.True(t, drains.draining("docker://drainpod-web"))
+
+	// Drain is cancelled when container is ready again
+	pod.Status.ContainerStatuses[0].Ready = true
+	err = eventUpdateFunc(pod, registry, cfg, nil, drains, nil)
+	assert.Nil(t, err)
+	status, _ = agent.Health("default-drainpod-web")
+	assert.Equal(t, consulapi.HealthPassing, status)
+	assert.False(t, drains.draining("docker://drainpod-web"))
+
+	// Invalid annotation falls back to the default
+	podInfo := &PodInfo{}
+	podInfo.save(pod)
+	assert.Equal(t, time.Minute, podInfo.drainDelay(cfg))
+	pod.ObjectMeta.Annotations[ConsulRegisterDrainSecondsAnnotation] = "soon"
+	podInfo.save(pod)
+	assert.Equal(t, time.Duration(0), podInfo.drainDelay(cfg))
+}
+
+func TestCleanupFinalizer(t *testing.T) {
+	t.Parallel()
+
+	objPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "22222222-89ab-cdef-0123-456789abcdef",
+			Name:        "finalizerpod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			NodeName: "nodename",
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.6",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://finalizerpod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:           "localhost",
+			ConsulPort:              "8500",
+			ConsulScheme:            "http",
+			ConsulContainerName:     "consul",
+			K8sTag:                  "kubernetes",
+			RegisterMode:            config.RegisterSingleMode,
+			RegisterSources:         []string{config.RegisterSourcePod},
+			Workers:                 1,
+			CleanupFinalizer:        true,
+			CleanupFinalizerTimeout: 5 * time.Minute,
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(objPod)
+	informerFactory := informers.NewFactory(clientset, "")
+	registry := consul.NewMemory()
+	agent := registry.New(cfg, "", "")
+	ctr := New(clientset, informerFactory, registry, cfg, "")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+	go ctr.Watch()
+
+	getPod := func() *v1.Pod {
+		pod, err := clientset.CoreV1().Pods("default").Get(context.TODO(), "finalizerpod", metav1.GetOptions{})
+		assert.Nil(t, err)
+		return pod
+	}
+
+	// Finalizer is put on POD after its services have been registered
+	assert.Eventually(t, func() bool {
+		return finalizer.Has(getPod())
+	}, 5*time.Second, 10*time.Millisecond)
+	services, _ := agent.List()
+	assert.Contains(t, services, "default-finalizerpod-web")
+
+	// Services are deregistered before the finalizer is removed from deleted POD
+	pod := getPod()
+	now := metav1.Now()
+	pod.ObjectMeta.DeletionTimestamp = &now
+	_, err := clientset.CoreV1().Pods("default").Update(context.TODO(), pod, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return !finalizer.Has(getPod())
+	}, 5*time.Second, 10*time.Millisecond)
+	services, _ = agent.List()
+	assert.NotContains(t, services, "default-finalizerpod-web")
+}
+
+func TestCleanupFinalizerQueued(t *testing.T) {
+	t.Parallel()
+
+	now := metav1.Now()
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:               "aaaaaaaa-89ab-cdef-0123-456789abcdef",
+			Name:              "queuedfinalizerpod",
+			Namespace:         "default",
+			Annotations:       map[string]string{"consul.register/enabled": "true"},
+			Finalizers:        []string{finalizer.Name},
+			DeletionTimestamp: &now,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.10",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://queuedfinalizerpod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:           "localhost",
+			ConsulContainerName:     "consul",
+			K8sTag:                  "kubernetes",
+			RegisterMode:            config.RegisterSingleMode,
+			CleanupFinalizer:        true,
+			CleanupFinalizerTimeout: 5 * time.Minute,
+			RetryInitialInterval:    time.Second,
+			RetryMaxInterval:        time.Minute,
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(pod)
+	informerFactory := informers.NewFactory(clientset, "")
+	fail := false
+	registry := consul.NewRetry(&failingRegistry{Registry: consul.NewMemory(), fail: &fail}, cfg, nil)
+	agent := registry.New(cfg, "", "")
+	ctr := New(clientset, informerFactory, registry, cfg, "").(*Controller)
+
+	err := eventUpdateFunc(pod, registry, cfg, nil, nil, nil)
+	assert.Nil(t, err)
+
+	getPod := func() *v1.Pod {
+		pod, err := clientset.CoreV1().Pods("default").Get(context.TODO(), "queuedfinalizerpod", metav1.GetOptions{})
+		assert.Nil(t, err)
+		return pod
+	}
+	podInfo := &PodInfo{}
+	podInfo.save(pod)
+
+	// Deregistration queued for retry doesn't release the finalizer
+	fail = true
+	err = ctr.releasePod(getPod(), podInfo)
+	assert.Error(t, err)
+	assert.True(t, finalizer.Has(getPod()))
+	services, _ := agent.List()
+	assert.Contains(t, services, "default-queuedfinalizerpod-web")
+
+	// Finalizer is removed once services are deregistered
+	fail = false
+	err = ctr.releasePod(getPod(), podInfo)
+	assert.Nil(t, err)
+	assert.False(t, finalizer.Has(getPod()))
+	services, _ = agent.List()
+	assert.NotContains(t, services, "default-queuedfinalizerpod-web")
+}
+
+func TestReadinessGate(t *testing.T) {
+	t.Parallel()
+
+	objPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "33333333-89ab-cdef-0123-456789abcdef",
+			Name:        "gatepod",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			NodeName: "nodename",
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+			},
+			ReadinessGates: []v1.PodReadinessGate{{ConditionType: ConsulRegisteredCondition}},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.7",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://gatepod-web", Ready: true},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:       "localhost",
+			ConsulPort:          "8500",
+			ConsulScheme:        "http",
+			ConsulContainerName: "consul",
+			K8sTag:              "kubernetes",
+			RegisterMode:        config.RegisterSingleMode,
+			RegisterSources:     []string{config.RegisterSourcePod},
+			Workers:             1,
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(objPod)
+	informerFactory := informers.NewFactory(clientset, "")
+	registry := consul.NewMemory()
+	ctr := New(clientset, informerFactory, registry, cfg, "")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+	go ctr.Watch()
+
+	conditionStatus := func() v1.ConditionStatus {
+		pod, err := clientset.CoreV1().Pods("default").Get(context.TODO(), "gatepod", metav1.GetOptions{})
+		assert.Nil(t, err)
+		if condition := registeredCondition(pod); condition != nil {
+			return condition.Status
+		}
+		return v1.ConditionUnknown
+	}
+
+	// Condition is True after services of POD have been registered
+	assert.Eventually(t, func() bool {
+		return conditionStatus() == v1.ConditionTrue
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Condition is False after services of POD have been deregistered
+	pod, err := clientset.CoreV1().Pods("default").Get(context.TODO(), "gatepod", metav1.GetOptions{})
+	assert.Nil(t, err)
+	pod.ObjectMeta.Annotations["consul.register/enabled"] = "false"
+	_, err = clientset.CoreV1().Pods("default").Update(context.TODO(), pod, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return conditionStatus() == v1.ConditionFalse
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPodEvents(t *testing.T) {
+	t.Parallel()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:         "events",
+			Name:        "events",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "web", Ports: []v1.ContainerPort{{ContainerPort: 80}}},
+				{Name: "sidecar"},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.0.0.8",
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "web", ContainerID: "docker://events-web", Ready: true},
+				{Name: "sidecar", ContainerID: "docker://events-sidecar", Ready: true},
+			},
+		},
+	}
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:        "localhost",
+			ConsulPort:           "8500",
+			ConsulScheme:         "http",
+			ConsulContainerName:  "consul",
+			K8sTag:               "kubernetes",
+			RegisterMode:         config.RegisterSingleMode,
+			RetryInitialInterval: time.Second,
+			RetryMaxInterval:     time.Minute,
+		},
+	}
+	fail := false
+	registry := consul.NewRetry(&failingRegistry{Registry: consul.NewMemory(), fail: &fail}, cfg, nil)
+	fakeRecorder := record.NewFakeRecorder(10)
+	recorder := events.WithEventRecorder(fakeRecorder)
+
+	// Registration and conversion failure are recorded
+	err := eventUpdateFunc(pod, registry, cfg, nil, nil, recorder)
+	assert.Nil(t, err)
+	recorded := []string{<-fakeRecorder.Events, <-fakeRecorder.Events}
+	assert.Contains(t, recorded, "Normal ConsulRegistered Service default-events-web has been registered in Consul Agent http://localhost:8500")
+	assert.Contains(t, recorded, "Warning ConsulConversionFailed Can't convert to Consul's service: Port's equal to 0")
+
+	// Deregistration is recorded
+	pod.ObjectMeta.Annotations["consul.register/enabled"] = "false"
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, recorder)
+	assert.Nil(t, err)
+	assert.Equal(t, "Normal ConsulDeregistered Service default-events-web has been deregistered from Consul Agent http://localhost:8500", <-fakeRecorder.Events)
+
+	// Registration queued for retry is recorded as failure
+	fail = true
+	pod.ObjectMeta.Annotations["consul.register/enabled"] = "true"
+	err = eventUpdateFunc(pod, registry, cfg, nil, nil, recorder)
+	assert.ErrorIs(t, err, consul.ErrQueued)
+	recorded = []string{<-fakeRecorder.Events, <-fakeRecorder.Events}
+	assert.Contains(t, recorded, "Warning ConsulFailed Can't register service default-events-web in Consul Agent http://localhost:8500: operation has been queued for retry: connection refused")
+	assert.Len(t, fakeRecorder.Events, 0)
+}
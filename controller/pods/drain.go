@@ -0,0 +1,99 @@
+package pods
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// drainer keeps timers of drains keyed by container ID. Drain of container is started only once,
+// so concurrent events of the same POD don't extend it. When drain ends the POD is reconciled again
+// by requeue function, so services are deregistered by the worker of the queue.
+type drainer struct {
+	mutex   sync.Mutex
+	drains  map[string]*drain
+	requeue func(podKey string)
+}
+
+type drain struct {
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// newDrainer returns the drainer which calls requeue with the key of POD whose drain has ended
+func newDrainer(requeue func(podKey string)) *drainer {
+	return &drainer{
+		drains:  make(map[string]*drain),
+		requeue: requeue,
+	}
+}
+
+// start starts drain of container unless it's already started.
+// It returns true if drain has been started by this call.
+func (d *drainer) start(containerID string, podKey string, delay time.Duration) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.drains[containerID]; ok {
+		return false
+	}
+	glog.V(2).Infof("Starting drain of container %s in POD %s for %s", containerID, podKey, delay)
+	d.drains[containerID] = &drain{
+		deadline: time.Now().Add(delay),
+		timer: time.AfterFunc(delay, func() {
+			if d.requeue != nil {
+				d.requeue(podKey)
+			}
+		}),
+	}
+	return true
+}
+
+// draining returns true if drain of container is started and hasn't ended yet
+func (d *drainer) draining(containerID string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	drain, ok := d.drains[containerID]
+	return ok && time.Now().Before(drain.deadline)
+}
+
+// ended returns true if drain of container is started and has ended
+func (d *drainer) ended(containerID string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	drain, ok := d.drains[containerID]
+	return ok && !time.Now().Before(drain.deadline)
+}
+
+// stop forgets drain of container. It returns true if drain has been started.
+func (d *drainer) stop(containerID string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	drain, ok := d.drains[containerID]
+	if !ok {
+		return false
+	}
+	drain.timer.Stop()
+	delete(d.drains, containerID)
+	return true
+}
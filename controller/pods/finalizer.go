@@ -0,0 +1,99 @@
+package pods
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/finalizer"
+	"github.com/warjiang/kube-consul-register/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// patchPod applies the merge patch to POD
+func (c *Controller) patchPod(namespace string, name string, data []byte) error {
+	_, err := c.clientset.CoreV1().Pods(namespace).Patch(context.TODO(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+// updateFinalizer puts the cleanup finalizer on registered POD if `cleanup_finalizer` option is enabled.
+// The finalizer is removed from POD whose registration has been turned off.
+func (c *Controller) updateFinalizer(pod *v1.Pod, podInfo *PodInfo) error {
+	if c.cfg.Controller.CleanupFinalizer && podInfo.isRegisterEnabled() {
+		if !podInfo.isRegistered() {
+			return nil
+		}
+		return finalizer.Add(pod, c.patchPod)
+	}
+	return finalizer.Remove(pod, c.patchPod)
+}
+
+// releasePod deregisters services of terminated POD which are left in Consul and removes the cleanup finalizer.
+// If services can't be deregistered until `cleanup_finalizer_timeout` the finalizer is removed anyway.
+func (c *Controller) releasePod(pod *v1.Pod, podInfo *PodInfo) error {
+	if !finalizer.Has(pod) {
+		return nil
+	}
+	// Finalizer is kept until drain ends
+	for _, container := range podInfo.ContainerStatuses {
+		if c.drains.draining(container.ContainerID) {
+			return nil
+		}
+	}
+
+	if err := c.deregisterPod(pod); err != nil {
+		if !finalizer.Expired(pod, c.cfg.Controller.CleanupFinalizerTimeout) {
+			return err
+		}
+		glog.Warningf("Services of POD %s/%s can't be deregistered in %s, removing finalizer %s: %s",
+			pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, c.cfg.Controller.CleanupFinalizerTimeout, finalizer.Name, err)
+	}
+	return finalizer.Remove(pod, c.patchPod)
+}
+
+// deregisterPod deregisters every service of POD which is registered in Consul
+func (c *Controller) deregisterPod(pod *v1.Pod) error {
+	var err error
+	uid := string(pod.ObjectMeta.UID)
+
+	agents, err := c.cacheConsulAgent()
+	if err != nil {
+		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
+	}
+	// Services of agent which can't be listed would be left in Consul
+	listedAgents := consul.ListAgents(agents)
+	if err := consul.ListErr(listedAgents); err != nil {
+		return err
+	}
+	addedConsulServices, consulServices, err := c.getAddedConsulServices(listedAgents)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for serviceID, consulAgentID := range addedConsulServices {
+		service := consulServices[serviceID]
+		if utils.GetConsulServiceUID(service.Meta, service.Tags) != uid {
+			continue
+		}
+		consulAgent := agents[consulAgentID]
+		if err := consulAgent.Deregister(&consulapi.AgentServiceRegistration{ID: serviceID}); err != nil {
+			glog.Errorf("Can't deregister service: %s", err)
+			c.recorder.ConsulFailed(pod, "deregister", serviceID, consulAgent.Address(), err)
+			// Deregistration queued for retry isn't done yet, the error doesn't wrap consul.ErrQueued,
+			// so release is requeued and the finalizer is kept until services are gone
+			failed++
+			continue
+		}
+		glog.Infof("Service's been deregistered, ID: %s", serviceID)
+		c.recorder.Deregistered(pod, serviceID, consulAgent.Address())
+	}
+	if failed > 0 {
+		return fmt.Errorf("Can't deregister %d service(s) of POD with UID %s", failed, uid)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package pods
+
+import (
+	"github.com/golang/glog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+)
+
+// ownerResolver finds the top-level controller of POD through ownerReferences.
+// Owners are taken from the informers' cache, so lookups don't call API.
+type ownerResolver struct {
+	replicaSetLister appslisters.ReplicaSetLister
+	jobLister        batchlisters.JobLister
+}
+
+// resolve returns kind and name of the top-level controller of POD, ReplicaSet is followed
+// to Deployment and Job to CronJob. If POD has no controller then false is returned.
+func (r *ownerResolver) resolve(namespace string, ownerReferences []metav1.OwnerReference) (string, string, bool) {
+	owner := controllerOf(ownerReferences)
+	if owner == nil {
+		return "", "", false
+	}
+	if r == nil {
+		return owner.Kind, owner.Name, true
+	}
+
+	var parents []metav1.OwnerReference
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet, err := r.replicaSetLister.ReplicaSets(namespace).Get(owner.Name)
+		if err != nil {
+			glog.V(2).Infof("Can't get ReplicaSet %s/%s: %s", namespace, owner.Name, err)
+			break
+		}
+		parents = replicaSet.ObjectMeta.OwnerReferences
+	case "Job":
+		job, err := r.jobLister.Jobs(namespace).Get(owner.Name)
+		if err != nil {
+			glog.V(2).Infof("Can't get Job %s/%s: %s", namespace, owner.Name, err)
+			break
+		}
+		parents = job.ObjectMeta.OwnerReferences
+	}
+
+	if parent := controllerOf(parents); parent != nil && (parent.Kind == "Deployment" || parent.Kind == "CronJob") {
+		return parent.Kind, parent.Name, true
+	}
+	return owner.Kind, owner.Name, true
+}
+
+// controllerOf returns the owner reference which is the managing controller
+func controllerOf(ownerReferences []metav1.OwnerReference) *metav1.OwnerReference {
+	for i := range ownerReferences {
+		if ownerReferences[i].Controller != nil && *ownerReferences[i].Controller {
+			return &ownerReferences[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package pods
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warjiang/kube-consul-register/controller/informers"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestOwnerResolver(t *testing.T) {
+	t.Parallel()
+
+	controller := true
+	ownedBy := func(kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+	}
+
+	objReplicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-5d8f7c9b4",
+			Namespace:       "default",
+			OwnerReferences: ownedBy("Deployment", "web"),
+		},
+	}
+	objJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "backup-28000000",
+			Namespace:       "default",
+			OwnerReferences: ownedBy("CronJob", "backup"),
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(objReplicaSet, objJob)
+	informerFactory := informers.NewFactory(clientset, "")
+	owners := &ownerResolver{
+		replicaSetLister: informers.ReplicaSets(informerFactory).Lister(),
+		jobLister:        informers.Jobs(informerFactory).Lister(),
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+
+	kind, name, found := owners.resolve("default", ownedBy("ReplicaSet", "web-5d8f7c9b4"))
+	assert.True(t, found)
+	assert.Equal(t, "Deployment", kind)
+	assert.Equal(t, "web", name)
+
+	kind, name, _ = owners.resolve("default", ownedBy("Job", "backup-28000000"))
+	assert.Equal(t, "CronJob", kind)
+	assert.Equal(t, "backup", name)
+
+	// Owner which is not in the cache is used as is
+	kind, name, _ = owners.resolve("default", ownedBy("ReplicaSet", "unknown"))
+	assert.Equal(t, "ReplicaSet", kind)
+	assert.Equal(t, "unknown", name)
+
+	kind, name, _ = owners.resolve("default", ownedBy("StatefulSet", "db"))
+	assert.Equal(t, "StatefulSet", kind)
+	assert.Equal(t, "db", name)
+
+	// References which are not controllers are skipped
+	_, _, found = owners.resolve("default", []metav1.OwnerReference{{Kind: "ConfigMap", Name: "config"}})
+	assert.False(t, found)
+}
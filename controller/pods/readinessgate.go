@@ -0,0 +1,145 @@
+package pods
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConsulRegisteredCondition is the condition of readiness gate which is True
+// when services of all containers of POD are registered in Consul and passing
+const ConsulRegisteredCondition v1.PodConditionType = "consul.register/registered"
+
+// These are reasons of ConsulRegisteredCondition
+const (
+	ReasonRegistered    string = "Registered"
+	ReasonNotRegistered string = "NotRegistered"
+	ReasonNotPassing    string = "NotPassing"
+)
+
+// readinessGateRecheck is the delay after which POD is reconciled again
+// when its services are registered but their checks aren't passing yet
+const readinessGateRecheck = 5 * time.Second
+
+// hasReadinessGate returns true if POD has ConsulRegisteredCondition in its readiness gates
+func hasReadinessGate(pod *v1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == ConsulRegisteredCondition {
+			return true
+		}
+	}
+	return false
+}
+
+// registeredCondition returns ConsulRegisteredCondition of POD if it's set
+func registeredCondition(pod *v1.Pod) *v1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == ConsulRegisteredCondition {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// registrationStatus returns the status of ConsulRegisteredCondition and its reason.
+// It's True if every expected container is ready and its services are registered,
+// checks of services have to pass only if checkHealth is set.
+func (c *Controller) registrationStatus(podInfo *PodInfo, checkHealth bool) (v1.ConditionStatus, string) {
+	if !podInfo.isRegisterEnabled() || podInfo.isTerminated() || podInfo.Phase != v1.PodRunning {
+		return v1.ConditionFalse, ReasonNotRegistered
+	}
+
+	consulAgent := c.consulInstance.New(c.cfg, podInfo.NodeName, podInfo.IP)
+	for _, container := range podInfo.ContainerStatuses {
+		if container.Name == c.cfg.Controller.ConsulContainerName || !podInfo.expectedContainerNames(container.Name) {
+			continue
+		}
+		// Container which can't be converted to services isn't registered at all
+		if _, err := podInfo.PodToConsulServices(container, c.cfg); err != nil {
+			continue
+		}
+		if !container.Ready {
+			return v1.ConditionFalse, ReasonNotRegistered
+		}
+		if _, notReady := notReadyContainers.Load(container.ContainerID); notReady {
+			return v1.ConditionFalse, ReasonNotRegistered
+		}
+		registered, ok := addedContainers.Load(container.ContainerID)
+		if !ok {
+			return v1.ConditionFalse, ReasonNotRegistered
+		}
+		if !checkHealth {
+			continue
+		}
+		for _, service := range registered.([]*consulapi.AgentServiceRegistration) {
+			status, err := consulAgent.Health(service.ID)
+			if err != nil {
+				glog.Errorf("Can't get health of service %s: %s", service.ID, err)
+				return v1.ConditionFalse, ReasonNotPassing
+			}
+			if status != consulapi.HealthPassing {
+				return v1.ConditionFalse, ReasonNotPassing
+			}
+		}
+	}
+	return v1.ConditionTrue, ReasonRegistered
+}
+
+// updateReadinessGate sets ConsulRegisteredCondition of POD which has it in its readiness gates.
+// Only the first check of services has to pass, so the condition which is True is kept
+// until services are deregistered. POD whose services aren't passing yet is reconciled
+// again after readinessGateRecheck.
+func (c *Controller) updateReadinessGate(pod *v1.Pod, podInfo *PodInfo) error {
+	if !hasReadinessGate(pod) {
+		return nil
+	}
+
+	condition := registeredCondition(pod)
+	passed := condition != nil && condition.Status == v1.ConditionTrue
+	status, reason := c.registrationStatus(podInfo, !passed)
+	if reason == ReasonNotPassing {
+		c.recheckReadinessGate(pod)
+	}
+	if condition != nil && condition.Status == status && condition.Reason == reason {
+		return nil
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.PodCondition{{
+				Type:               ConsulRegisteredCondition,
+				Status:             status,
+				Reason:             reason,
+				LastTransitionTime: metav1.Now(),
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	glog.Infof("Setting condition %s of POD %s/%s to %s (%s)", ConsulRegisteredCondition, pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, status, reason)
+	_, err = c.clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).Patch(context.TODO(), pod.ObjectMeta.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// recheckReadinessGate reconciles POD again after readinessGateRecheck unless it's already scheduled
+func (c *Controller) recheckReadinessGate(pod *v1.Pod) {
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		return
+	}
+	if _, scheduled := c.rechecks.LoadOrStore(key, true); scheduled {
+		return
+	}
+	time.AfterFunc(readinessGateRecheck, func() {
+		c.rechecks.Delete(key)
+		c.queue.AddKey(key)
+	})
+}
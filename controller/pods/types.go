@@ -3,6 +3,7 @@ package pods
 import (
 	"github.com/golang/glog"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -19,6 +20,7 @@ type PodInfo struct {
 	Name              string
 	Namespace         string
 	Phase             v1.PodPhase
+	Terminating       bool
 	IP                string
 	NodeName          string
 	Containers        []v1.Container
@@ -26,6 +28,10 @@ type PodInfo struct {
 	Ready             v1.ConditionStatus
 	Labels            map[string]string
 	Annotations       map[string]string
+	OwnerReferences   []metav1.OwnerReference
+	// OwnerKind and OwnerName describe the top-level controller, e.g. Deployment
+	OwnerKind string
+	OwnerName string
 }
 
 func (p *PodInfo) save(obj interface{}) {
@@ -38,6 +44,8 @@ func (p *PodInfo) save(obj interface{}) {
 	p.Namespace = objectMeta.Namespace
 	p.Labels = objectMeta.Labels
 	p.Annotations = objectMeta.Annotations
+	p.OwnerReferences = objectMeta.OwnerReferences
+	p.Terminating = objectMeta.DeletionTimestamp != nil
 
 	p.NodeName = spec.NodeName
 	p.Containers = spec.Containers
@@ -54,3 +62,20 @@ func (p *PodInfo) save(obj interface{}) {
 
 	glog.V(4).Infof("Save PodInfo: %#v", p)
 }
+
+// isTerminated returns true if POD is being deleted or its containers have terminated,
+// so it shouldn't receive traffic anymore
+func (p *PodInfo) isTerminated() bool {
+	return p.Terminating || p.Phase == v1.PodFailed || p.Phase == v1.PodSucceeded
+}
+
+// reference returns the reference to POD which is used as the object of recorded events
+func (p *PodInfo) reference() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  p.Namespace,
+		Name:       p.Name,
+		UID:        p.UID,
+	}
+}
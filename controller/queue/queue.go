@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/metrics"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// maxRetries is the number of times a key is retried before it's dropped out of the queue
+const maxRetries = 5
+
+// Queue is a rate-limited queue of object keys which is drained by workers.
+// The same key is never reconciled by two workers at the same time, failed
+// keys are retried with per-key exponential backoff.
+type Queue struct {
+	name      string
+	queue     workqueue.RateLimitingInterface
+	reconcile func(key string) error
+}
+
+// New creates an instance of Queue. Function reconcile is called for every key
+// taken from the queue.
+func New(name string, reconcile func(key string) error) *Queue {
+	return &Queue{
+		name:      name,
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name),
+		reconcile: reconcile,
+	}
+}
+
+// Add adds key of the object to the queue. Object can be a tombstone of deleted object.
+func (q *Queue) Add(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Can't get key of object: %s", err)
+		return
+	}
+	q.queue.Add(key)
+}
+
+// AddKey adds key to the queue
+func (q *Queue) AddKey(key string) {
+	q.queue.Add(key)
+}
+
+// Run starts workers and blocks until stop is closed
+func (q *Queue) Run(workers int, stop <-chan struct{}) {
+	defer q.queue.ShutDown()
+
+	glog.Infof("Starting %d workers of %s queue", workers, q.name)
+	for i := 0; i < workers; i++ {
+		go wait.Until(q.worker, time.Second, stop)
+	}
+	<-stop
+}
+
+func (q *Queue) worker() {
+	for q.processNextItem() {
+	}
+}
+
+func (q *Queue) processNextItem() bool {
+	key, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	defer q.queue.Done(key)
+
+	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("reconcile"))
+	err := q.reconcile(key.(string))
+	timer.ObserveDuration()
+
+	if err == nil {
+		q.queue.Forget(key)
+		return true
+	}
+
+	// Failed operations have been queued by the retry of registry, they aren't retried twice.
+	// Objects whose services aren't registered yet are reconciled again by synchronization.
+	if errors.Is(err, consul.ErrQueued) {
+		glog.Warningf("Failed to reconcile %s, waiting for retry of queued operations: %s", key, err)
+		q.queue.Forget(key)
+		return true
+	}
+
+	if q.queue.NumRequeues(key) < maxRetries {
+		glog.Warningf("Failed to reconcile %s, retrying: %s", key, err)
+		q.queue.AddRateLimited(key)
+		return true
+	}
+
+	glog.Errorf("Failed to reconcile %s, dropping out of the %s queue: %s", key, q.name, err)
+	metrics.QueueDropped.WithLabelValues(q.name).Inc()
+	q.queue.Forget(key)
+	return true
+}
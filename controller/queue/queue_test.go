@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warjiang/kube-consul-register/consul"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	calls := make(map[string]int)
+
+	q := New("test", func(key string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		calls[key]++
+		// The first attempt of "default/flaky" fails and is retried
+		if key == "default/flaky" && calls[key] == 1 {
+			return fmt.Errorf("failure")
+		}
+		// "default/broken" always fails and is dropped after maxRetries
+		if key == "default/broken" {
+			return fmt.Errorf("failure")
+		}
+		// "default/queued" fails, but it's retried by registry, so it's not requeued
+		if key == "default/queued" {
+			return fmt.Errorf("failure: %w", consul.ErrQueued)
+		}
+		return nil
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Run(2, stop)
+
+	q.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"}})
+	q.Add(cache.DeletedFinalStateUnknown{Key: "default/deleted"})
+	q.AddKey("default/flaky")
+	q.AddKey("default/broken")
+	q.AddKey("default/queued")
+
+	count := func(key string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return calls[key]
+	}
+
+	assert.Eventually(t, func() bool { return count("default/pod") == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return count("default/deleted") == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return count("default/flaky") == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return count("default/broken") == maxRetries+1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Dropped key is not retried anymore
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, maxRetries+1, count("default/broken"))
+	assert.Equal(t, 1, count("default/queued"))
+}
@@ -4,21 +4,27 @@ import (
 	"context"
 	"fmt"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/warjiang/kube-consul-register/config"
 	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/annotations"
+	"github.com/warjiang/kube-consul-register/controller/events"
+	"github.com/warjiang/kube-consul-register/controller/finalizer"
+	"github.com/warjiang/kube-consul-register/controller/informers"
+	"github.com/warjiang/kube-consul-register/controller/queue"
 	"github.com/warjiang/kube-consul-register/metrics"
 	"github.com/warjiang/kube-consul-register/utils"
 
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	//"k8s.io/client-go/pkg/api/v1"
 	//"k8s.io/client-go/pkg/fields"
 	"k8s.io/client-go/tools/cache"
@@ -28,83 +34,130 @@ import (
 
 // These are valid annotations names which are take into account.
 // "ConsulRegisterEnabledAnnotation" is a name of annotation key for `enabled` option.
+// Other annotations are common for all sources, they are described in annotations package.
 const (
 	ConsulRegisterEnabledAnnotation                string = "consul.register/enabled"
-	ConsulRegisterServiceNameAnnotation            string = "consul.register/service.name"
-	ConsulRegisterServiceTags                      string = "consul.register/service.tags"
-	ConsulRegisterServiceHealthIntervalAnnotation  string = "consul.register/service.health.interval"
-	ConsulRegisterServiceHealthTimeoutAnnotation   string = "consul.register/service.health.timeout"
-	ConsulRegisterServiceHealthCheckPathAnnotation string = "consul.register/service.health.path"
-	ConsulRegisterServiceHealthHostAnnotation      string = "consul.register/service.health.host"
-	ConsulRegisterServiceHealthPortAnnotation      string = "consul.register/service.health.port"
-	ConsulRegisterServiceHealthTTLAnnotation       string = "consul.register/service.health.ttl"
-	ConsulRegisterServiceHealthTCPAnnotation       string = "consul.register/service.health.tcp"
+	ConsulRegisterServiceNameAnnotation            string = annotations.ServiceNameAnnotation
+	ConsulRegisterServiceTags                      string = annotations.ServiceTagsAnnotation
+	ConsulRegisterServiceHealthIntervalAnnotation  string = annotations.ServiceHealthIntervalAnnotation
+	ConsulRegisterServiceHealthTimeoutAnnotation   string = annotations.ServiceHealthTimeoutAnnotation
+	ConsulRegisterServiceHealthCheckPathAnnotation string = annotations.ServiceHealthCheckPathAnnotation
+	ConsulRegisterServiceHealthHostAnnotation      string = annotations.ServiceHealthHostAnnotation
+	ConsulRegisterServiceHealthPortAnnotation      string = annotations.ServiceHealthPortAnnotation
+	ConsulRegisterServiceHealthTTLAnnotation       string = annotations.ServiceHealthTTLAnnotation
+	ConsulRegisterServiceHealthTCPAnnotation       string = annotations.ServiceHealthTCPAnnotation
 )
 
+// allAddedServices is shared by all workers of the queue
 var (
-	allAddedServices = make(map[string]bool)
+	allAddedServices sync.Map
 
-	consulAgents map[string]*consul.Adapter
+	consulAgents map[string]consul.Registry
 )
 
 // Controller describes the attributes that are uses by Controller
 type Controller struct {
-	clientset      *kubernetes.Clientset
-	consulInstance consul.Adapter
+	clientset      kubernetes.Interface
+	consulInstance consul.Registry
 	cfg            *config.Config
 	namespace      string
 	mutex          *sync.Mutex
+
+	queue           *queue.Queue
+	serviceInformer cache.SharedIndexInformer
+	serviceLister   corelisters.ServiceLister
+	nodeInformer    cache.SharedIndexInformer
+	nodeLister      corelisters.NodeLister
+	// podLister is set only in `pod` mode
+	podLister corelisters.PodLister
+	// deleted keeps the last known state of deleted services until they are reconciled
+	deleted sync.Map
+	// recorder records events about registration of services
+	recorder *events.Recorder
 }
 
-// New creates an instance of controller
-func New(clientset *kubernetes.Clientset, consulInstance consul.Adapter, cfg *config.Config, namespace string) FactoryAdapter {
-	return &Controller{
-		clientset:      clientset,
-		consulInstance: consulInstance,
-		cfg:            cfg,
-		namespace:      namespace,
-		mutex:          &sync.Mutex{}}
+// New creates an instance of controller. Informers are taken from the informerFactory,
+// which has to be started and synced before the controller is used.
+func New(clientset kubernetes.Interface, informerFactory kubeinformers.SharedInformerFactory, consulInstance consul.Registry, cfg *config.Config, namespace string) FactoryAdapter {
+	serviceInformer := informers.Services(informerFactory)
+	nodeInformer := informers.Nodes(informerFactory)
+
+	c := &Controller{
+		clientset:       clientset,
+		consulInstance:  consulInstance,
+		cfg:             cfg,
+		namespace:       namespace,
+		mutex:           &sync.Mutex{},
+		serviceInformer: serviceInformer.Informer(),
+		serviceLister:   serviceInformer.Lister(),
+		nodeInformer:    nodeInformer.Informer(),
+		nodeLister:      nodeInformer.Lister(),
+		recorder:        events.NewRecorder(clientset)}
+	if cfg.Controller.RegisterMode == config.RegisterPodMode {
+		c.podLister = informers.Pods(informerFactory).Lister()
+	}
+	c.queue = queue.New("services", c.reconcile)
+	return c
 }
 
-func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
-	consulAgents = make(map[string]*consul.Adapter)
+func (c *Controller) cacheConsulAgent() (map[string]consul.Registry, error) {
+	agents := make(map[string]consul.Registry)
 
-	ctx := context.TODO()
 	//Cache Consul's Agents
 	if c.cfg.Controller.RegisterMode == config.RegisterSingleMode {
 		consulAgent := c.consulInstance.New(c.cfg, "", "")
-		consulAgents[c.cfg.Controller.ConsulAddress] = consulAgent
+		agents[c.cfg.Controller.ConsulAddress] = consulAgent
 
 	} else if c.cfg.Controller.RegisterMode == config.RegisterNodeMode {
-		nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
-			LabelSelector: c.cfg.Controller.ConsulNodeSelector,
-		})
+		selector, err := labels.Parse(c.cfg.Controller.ConsulNodeSelector)
 		if err != nil {
-			return consulAgents, err
+			return agents, err
+		}
+		nodes, err := c.nodeLister.List(selector)
+		if err != nil {
+			return agents, err
 		}
 		// !! should mount /etc/hosts to pod
 		// may be the name of node.ObjectMeta.Name is the hostname of node, not real ip address
-		for _, node := range nodes.Items {
-			consulInstance := consul.Adapter{}
-			_ = utils.GetHostIP(node)
-			consulAgent := consulInstance.New(c.cfg, utils.GetHostIP(node), "")
-			consulAgents[node.ObjectMeta.Name] = consulAgent
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, utils.GetHostIP(*node), "")
+			agents[node.ObjectMeta.Name] = consulAgent
 		}
 	} else if c.cfg.Controller.RegisterMode == config.RegisterPodMode {
-		pods, err := c.clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
-			LabelSelector: c.cfg.Controller.PodLabelSelector,
-		})
+		selector, err := labels.Parse(c.cfg.Controller.PodLabelSelector)
+		if err != nil {
+			return agents, err
+		}
+		pods, err := c.podLister.List(selector)
+		if err != nil {
+			return agents, err
+		}
+		for _, pod := range pods {
+			consulAgent := c.consulInstance.New(c.cfg, "", pod.Status.HostIP)
+			agents[pod.Status.HostIP] = consulAgent
+		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		// Every synthetic node in the catalog is treated as separate agent
+		nodes, err := consul.Nodes(c.consulInstance.New(c.cfg, "", ""))
 		if err != nil {
-			return consulAgents, err
+			return agents, err
 		}
-		for _, pod := range pods.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, "", pod.Status.HostIP)
-			consulAgents[pod.Status.HostIP] = consulAgent
+		for _, node := range nodes {
+			consulAgent := c.consulInstance.New(c.cfg, node, "")
+			agents[node] = consulAgent
 		}
 	}
 
-	return consulAgents, nil
+	consul.SkipInvalidAgents(agents)
+
+	// Drop clients of agents which have disappeared. The lock is held only while
+	// the cached agents are swapped, so listing of agents doesn't block each other.
+	c.mutex.Lock()
+	consul.InvalidateAgents(consulAgents, agents)
+	consulAgents = agents
+	c.mutex.Unlock()
+
+	return agents, nil
 }
 
 // Clean checks Consul services and remove them if service does not appear in K8S cluster
@@ -112,35 +165,35 @@ func (c *Controller) Clean() error {
 	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("clean"))
 	defer timer.ObserveDuration()
 
-	var err error
-
-	c.mutex.Lock()
-
-	consulAgents, err = c.cacheConsulAgent()
+	agents, err := c.cacheConsulAgent()
 	if err != nil {
-		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
 	}
 
 	// Get list of added Consul' services
 	// addedConsulServices map[string]string serviceConsulID:consul_agent_hostname
 	// registeredConsulServices map[string][]string UID:serviceConsulID
-	addedConsulServices, registeredConsulServices, err := c.getAddedConsulServices()
+	addedConsulServices, registeredConsulServices, _, err := c.getAddedConsulServices(consul.ListAgents(agents))
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
-	allServices, err := c.clientset.CoreV1().Services(c.namespace).List(context.TODO(), metav1.ListOptions{})
+	allServices, err := c.serviceLister.Services(c.namespace).List(labels.Everything())
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 
 	var currentAddedServices = make(map[string]string)
-	for _, service := range allServices.Items {
-		if !isRegisterEnabled(&service) {
+	for _, service := range allServices {
+		// Deleted Service isn't registered again, it's reconciled only to remove its finalizer
+		if service.ObjectMeta.DeletionTimestamp != nil {
+			if finalizer.Has(service) {
+				c.queue.Add(service)
+			}
+			continue
+		}
+		if !isRegisterEnabled(service) {
 			continue
 		}
 		currentAddedServices[string(service.ObjectMeta.UID)] = service.ObjectMeta.Name
@@ -149,7 +202,7 @@ func (c *Controller) Clean() error {
 	for uid, serviceConsulID := range registeredConsulServices {
 		if name, ok := currentAddedServices[uid]; !ok {
 			for _, serviceID := range serviceConsulID {
-				consulAgent := consulAgents[addedConsulServices[serviceID]]
+				consulAgent := agents[addedConsulServices[serviceID]]
 				consulService := &consulapi.AgentServiceRegistration{
 					ID: serviceID,
 				}
@@ -157,17 +210,16 @@ func (c *Controller) Clean() error {
 				err = consulAgent.Deregister(consulService)
 				if err != nil {
 					glog.Errorf("Cannot deregister service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
 				} else {
-					delete(allAddedServices, serviceID)
+					allAddedServices.Delete(serviceID)
 					glog.Infof("Service %s has been deregistered in Consul with ID: %s", name, serviceID)
-					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
 				}
 			}
 		}
 	}
 
-	c.mutex.Unlock()
 	return nil
 }
 
@@ -176,58 +228,62 @@ func (c *Controller) Sync() error {
 	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("sync"))
 	defer timer.ObserveDuration()
 
-	var err error
-
-	c.mutex.Lock()
-
-	consulAgents, err = c.cacheConsulAgent()
+	agents, err := c.cacheConsulAgent()
 	if err != nil {
-		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
 	}
-	glog.V(2).Infof("Agents: %#v", consulAgents)
+	glog.V(2).Infof("Agents: %#v", agents)
 
 	// Get list of added Consul' services
 	// addedConsulServices map[string]string serviceConsulID:consul_agent_hostname
 	// registeredConsulServices map[string][]string UID:serviceConsulID
-	addedConsulServices, registeredConsulServices, err := c.getAddedConsulServices()
+	addedConsulServices, registeredConsulServices, consulServices, err := c.getAddedConsulServices(consul.ListAgents(agents))
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
-	allServices, err := c.clientset.CoreV1().Services(c.namespace).List(context.TODO(), metav1.ListOptions{})
+	allServices, err := c.serviceLister.Services(c.namespace).List(labels.Everything())
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 
-	for _, service := range allServices.Items {
-		if !isRegisterEnabled(&service) {
+	for _, service := range allServices {
+		// Deleted Service isn't registered again, it's reconciled only to remove its finalizer
+		if service.ObjectMeta.DeletionTimestamp != nil {
+			if finalizer.Has(service) {
+				c.queue.Add(service)
+			}
+			continue
+		}
+		if !isRegisterEnabled(service) {
+			// Finalizer of disabled object is stripped in reconcile
+			if finalizer.Has(service) {
+				c.queue.Add(service)
+			}
 			continue
 		}
 
 		// Check if service has already added to Consul
-		if consulServices, ok := registeredConsulServices[string(service.ObjectMeta.UID)]; ok {
-			for _, serviceConsulID := range consulServices {
+		if serviceConsulIDs, ok := registeredConsulServices[string(service.ObjectMeta.UID)]; ok {
+			for _, serviceConsulID := range serviceConsulIDs {
 				if _, ok := addedConsulServices[serviceConsulID]; !ok {
-					err := c.eventAddFunc(&service)
-					if err != nil {
-						c.mutex.Unlock()
-						return err
-					}
+					c.queue.Add(service)
+					continue
+				}
+
+				// Address and port are a part of ID, so the desired service is built from them
+				actual := consulServices[serviceConsulID]
+				desired, err := c.createConsulService(service, actual.Address, int32(actual.Port))
+				if err == nil && consul.CheckDrift(desired, actual) {
+					allAddedServices.Delete(serviceConsulID)
+					c.queue.Add(service)
 				}
 			}
 		} else {
-			err := c.eventAddFunc(&service)
-			if err != nil {
-				c.mutex.Unlock()
-				return err
-			}
+			c.queue.Add(service)
 		}
 	}
-	c.mutex.Unlock()
 	return nil
 }
 
@@ -238,22 +294,22 @@ func (c *Controller) nodeDelete(obj interface{}) error {
 
 	var err error
 
-	c.mutex.Lock()
-	allAddedServices = make(map[string]bool)
+	allAddedServices.Range(func(key, _ interface{}) bool {
+		allAddedServices.Delete(key)
+		return true
+	})
 
-	consulAgents, err = c.cacheConsulAgent()
+	agents, err := c.cacheConsulAgent()
 	if err != nil {
-		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
 	}
-	glog.V(2).Infof("Agents: %#v", consulAgents)
+	glog.V(2).Infof("Agents: %#v", agents)
 
 	// Get list of added Consul' services
 	// addedConsulServices map[string]string serviceConsulID:consul_agent_hostname
 	// registeredConsulServices map[string][]string UID:serviceConsulID
-	addedConsulServices, _, err := c.getAddedConsulServices()
+	addedConsulServices, _, _, err := c.getAddedConsulServices(consul.ListAgents(agents))
 	if err != nil {
-		c.mutex.Unlock()
 		return err
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
@@ -261,7 +317,7 @@ func (c *Controller) nodeDelete(obj interface{}) error {
 	for serviceConsulID, consulAgentHostname := range addedConsulServices {
 		for _, address := range obj.(*v1.Node).Status.Addresses {
 			if strings.Contains(serviceConsulID, "-"+address.Address+"-") {
-				consulAgent := consulAgents[consulAgentHostname]
+				consulAgent := agents[consulAgentHostname]
 				consulService := &consulapi.AgentServiceRegistration{
 					ID: serviceConsulID,
 				}
@@ -269,141 +325,177 @@ func (c *Controller) nodeDelete(obj interface{}) error {
 				err = consulAgent.Deregister(consulService)
 				if err != nil {
 					glog.Errorf("Cannot deregister service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
 				} else {
-					delete(allAddedServices, serviceConsulID)
+					allAddedServices.Delete(serviceConsulID)
 					glog.Infof("Service has been deregistered in Consul with ID: %s", serviceConsulID)
-					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
 				}
 			}
 		}
 	}
 
-	c.mutex.Unlock()
 	return nil
 }
 
 // Watch watches events in K8S cluster
 func (c *Controller) Watch() {
-	go c.watchNodes()
-	go c.watchServices()
+	c.watchNodes()
+	c.watchServices()
+
+	stop := make(chan struct{})
+	c.queue.Run(c.cfg.Controller.Workers, stop)
 }
 
 func (c *Controller) watchNodes() {
-	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "nodes", c.namespace,
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1.Node{},
-		time.Second*0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				c.mutex.Lock()
-				glog.Info("Add node.")
-				allServices, err := c.clientset.CoreV1().Services(c.namespace).List(context.TODO(), metav1.ListOptions{})
-				if err != nil {
-					c.mutex.Unlock()
-				}
-
-				for _, service := range allServices.Items {
-					if !isRegisterEnabled(&service) {
-						continue
-					}
-
-					if err := c.eventAddFunc(&service); err != nil {
-						glog.Errorf("Failed to add node: %s", err)
-					}
-				}
-				c.mutex.Unlock()
-			},
-			DeleteFunc: func(obj interface{}) {
-				glog.Info("Delete node. ")
-				err := c.nodeDelete(obj)
-				if err != nil {
-					glog.Error(err)
+	c.nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			glog.Info("Add node.")
+			// Services of type NodePort have to be registered on the new node
+			services, err := c.serviceLister.Services(c.namespace).List(labels.Everything())
+			if err != nil {
+				glog.Errorf("Failed to add node: %s", err)
+				return
+			}
+			for _, service := range services {
+				if isRegisterEnabled(service) {
+					c.queue.Add(service)
 				}
-			},
+			}
 		},
-	)
-
-	stop := make(chan struct{})
-	controller.Run(stop)
+		DeleteFunc: func(obj interface{}) {
+			glog.Info("Delete node. ")
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if _, ok := obj.(*v1.Node); !ok {
+				return
+			}
+			err := c.nodeDelete(obj)
+			if err != nil {
+				glog.Error(err)
+			}
+		},
+	})
 }
 
 func (c *Controller) watchServices() {
-	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "services", c.namespace,
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1.Service{},
-		time.Second*0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				if !isRegisterEnabled(obj) {
-					return
-				}
+	c.serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if !isRegisterEnabled(obj) {
+				return
+			}
+			c.queue.Add(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if _, ok := obj.(*v1.Service); !ok || !isRegisterEnabled(obj) {
+				return
+			}
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil {
+				glog.Errorf("Failed to delete services: %s", err)
+				return
+			}
+			c.deleted.Store(key, obj)
+			c.queue.AddKey(key)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Service is deregistered in reconcile if it's been disabled
+			c.queue.Add(newObj)
+		},
+	})
+}
 
-				c.mutex.Lock()
-				if err := c.eventAddFunc(obj); err != nil {
-					glog.Errorf("Failed to add services: %s", err)
-				}
-				c.mutex.Unlock()
-			},
-			DeleteFunc: func(obj interface{}) {
-				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("delete"))
-				defer timer.ObserveDuration()
-				if !isRegisterEnabled(obj) {
-					return
-				}
+// reconcile deregisters deleted service and registers or deregisters existing service with the given key
+func (c *Controller) reconcile(key string) error {
+	if service, ok := c.deleted.Load(key); ok {
+		if err := c.eventDeleteFunc(service); err != nil {
+			return err
+		}
+		c.deleted.CompareAndDelete(key, service)
+	}
 
-				c.mutex.Lock()
-				if err := c.eventDeleteFunc(obj); err != nil {
-					glog.Errorf("Failed to delete services: %s", err)
-				}
-				c.mutex.Unlock()
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("update"))
-				defer timer.ObserveDuration()
-				if !isRegisterEnabled(newObj) {
-					// Deregister the service on update if disabled
-					c.mutex.Lock()
-					if err := c.eventDeleteFunc(newObj); err != nil {
-						glog.Errorf("Failed to delete services during update: %s", err)
-					}
-					c.mutex.Unlock()
-				} else {
-					c.mutex.Lock()
-					if err := c.eventAddFunc(newObj); err != nil {
-						glog.Errorf("Failed to add services during update: %s", err)
-					}
-					c.mutex.Unlock()
-				}
-			},
-		},
-	)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	service, err := c.serviceLister.Services(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	stop := make(chan struct{})
-	controller.Run(stop)
+	// Service which is being deleted is kept by the cleanup finalizer until its services are deregistered
+	if service.ObjectMeta.DeletionTimestamp != nil {
+		return c.releaseService(service)
+	}
+
+	if !isRegisterEnabled(service) {
+		// Deregister the service on update if disabled
+		if err := c.eventDisableFunc(service); err != nil {
+			return err
+		}
+		return c.updateFinalizer(service)
+	}
+	if err := c.eventAddFunc(service); err != nil {
+		return err
+	}
+	return c.updateFinalizer(service)
+}
+
+// isRegistered returns true if any service of Service has been added to Consul
+func isRegistered(svc *v1.Service) bool {
+	prefix := fmt.Sprintf("%s-%s-", svc.ObjectMeta.Name, svc.ObjectMeta.UID)
+	registered := false
+	allAddedServices.Range(func(key, _ interface{}) bool {
+		registered = strings.HasPrefix(key.(string), prefix)
+		return !registered
+	})
+	return registered
+}
+
+// eventDisableFunc deregisters services of Service whose registration has been turned off
+func (c *Controller) eventDisableFunc(svc *v1.Service) error {
+	if !isRegistered(svc) {
+		return nil
+	}
+
+	glog.Infof("Service %s in %s namespace is disabled, deregistering its services", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace)
+	if err := c.eventDeleteFunc(svc); err != nil {
+		metrics.SourceFailure.WithLabelValues(config.RegisterSourceService, "disable").Inc()
+		return err
+	}
+	metrics.SourceSuccess.WithLabelValues(config.RegisterSourceService, "disable").Inc()
+	return nil
 }
 
-// getAddedConsulServices returns the list of added Consul Services
-func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]string, error) {
+// getAddedConsulServices returns the list of added Consul Services, agents which can't be listed are skipped
+func (c *Controller) getAddedConsulServices(listedAgents map[string]consul.AgentServices) (map[string]string, map[string][]string, map[string]*consulapi.AgentService, error) {
 	var addedServices = make(map[string]string)
 	var registeredConsulServices = make(map[string][]string)
+	var consulServices = make(map[string]*consulapi.AgentService)
 
 	// Make list of Consul's services
-	for consulAgentID, consulAgent := range consulAgents {
-		services, err := consulAgent.Services()
+	for consulAgentID, listed := range listedAgents {
+		services, err := listed.Services, listed.Err
 		if err != nil {
 			glog.Errorf("Can't get services from Consul Agent, register mode=%s: %s", c.cfg.Controller.RegisterMode, err)
 		} else {
 			glog.V(3).Infof("agent: %#v, services: %#v", consulAgentID, services)
 			for _, service := range services {
-				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) {
+				// Services of other clusters and sources are skipped
+				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) &&
+					utils.CheckK8sCluster(service.Meta, c.cfg.Controller.ClusterID, c.cfg.Controller.AdoptLegacy) &&
+					utils.CheckK8sSource(service.Meta, config.RegisterSourceService, c.cfg.Controller.RegisterSources) {
 					addedServices[service.ID] = consulAgentID
+					consulServices[service.ID] = service
 
-					uid := utils.GetConsulServiceTag(service.Tags, "uid")
+					uid := utils.GetConsulServiceUID(service.Meta, service.Tags)
 					if value, ok := registeredConsulServices[uid]; ok {
 						registeredConsulServices[uid] = append(value, service.ID)
 					} else {
@@ -413,7 +505,7 @@ func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]s
 			}
 		}
 	}
-	return addedServices, registeredConsulServices, nil
+	return addedServices, registeredConsulServices, consulServices, nil
 }
 
 func (c *Controller) eventAddFunc(obj interface{}) error {
@@ -423,6 +515,7 @@ func (c *Controller) eventAddFunc(obj interface{}) error {
 
 	var nodesIPs []string
 	var ports []int32
+	var failed consul.Failures
 	var err error
 
 	switch serviceType := obj.(*v1.Service).Spec.Type; serviceType {
@@ -449,10 +542,11 @@ func (c *Controller) eventAddFunc(obj interface{}) error {
 				service, err := c.createConsulService(obj.(*v1.Service), nodeAddress, port)
 				if err != nil {
 					glog.Errorf("Cannot create Consul service: %s", err)
+					c.recorder.ConversionFailed(obj.(*v1.Service), err)
 					continue
 				}
 				// Check if service's already added
-				if _, ok := allAddedServices[service.ID]; ok {
+				if _, ok := allAddedServices.Load(service.ID); ok {
 					glog.V(3).Infof("Service %s has already registered in Consul", service.ID)
 					continue
 				}
@@ -461,11 +555,14 @@ func (c *Controller) eventAddFunc(obj interface{}) error {
 				err = consulAgent.Register(service)
 				if err != nil {
 					glog.Errorf("Cannot register service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+					metrics.ConsulFailure.WithLabelValues("register", consulAgent.Address()).Inc()
+					c.recorder.ConsulFailed(obj.(*v1.Service), "register", service.ID, consulAgent.Address(), err)
+					failed.Add(err)
 				} else {
-					allAddedServices[service.ID] = true
+					allAddedServices.Store(service.ID, true)
 					glog.Infof("Service %s has been registered in Consul with ID: %s", obj.(*v1.Service).ObjectMeta.Name, service.ID)
-					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Address()).Inc()
+					c.recorder.Registered(obj.(*v1.Service), service.ID, consulAgent.Address())
 				}
 			}
 		}
@@ -489,10 +586,11 @@ func (c *Controller) eventAddFunc(obj interface{}) error {
 				service, err := c.createConsulService(obj.(*v1.Service), nodeAddress, port)
 				if err != nil {
 					glog.Errorf("Cannot create Consul service: %s", err)
+					c.recorder.ConversionFailed(obj.(*v1.Service), err)
 					continue
 				}
 				// Check if service's already added
-				if _, ok := allAddedServices[service.ID]; ok {
+				if _, ok := allAddedServices.Load(service.ID); ok {
 					glog.V(3).Infof("Service %s has already registered in Consul", service.ID)
 					continue
 				}
@@ -501,30 +599,40 @@ func (c *Controller) eventAddFunc(obj interface{}) error {
 				err = consulAgent.Register(service)
 				if err != nil {
 					glog.Errorf("Cannot register service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+					metrics.ConsulFailure.WithLabelValues("register", consulAgent.Address()).Inc()
+					c.recorder.ConsulFailed(obj.(*v1.Service), "register", service.ID, consulAgent.Address(), err)
+					failed.Add(err)
 				} else {
-					allAddedServices[service.ID] = true
+					allAddedServices.Store(service.ID, true)
 					glog.Infof("Service %s has been registered in Consul with ID: %s", obj.(*v1.Service).ObjectMeta.Name, service.ID)
-					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Address()).Inc()
+					c.recorder.Registered(obj.(*v1.Service), service.ID, consulAgent.Address())
 				}
 			}
 		}
 	}
+	if failed.Count > 0 {
+		return failed.Err("Cannot register %d service(s) of %s in Consul", failed.Count, obj.(*v1.Service).ObjectMeta.Name)
+	}
 	return nil
 }
 
 func (c *Controller) getNodesIPs() ([]string, error) {
-	var listOptions metav1.ListOptions
+	selector := labels.Everything()
 	if c.cfg.Controller.RegisterMode == config.RegisterNodeMode {
-		listOptions.LabelSelector = c.cfg.Controller.ConsulNodeSelector
+		var err error
+		selector, err = labels.Parse(c.cfg.Controller.ConsulNodeSelector)
+		if err != nil {
+			return nil, err
+		}
 	}
-	nodes, err := c.clientset.CoreV1().Nodes().List(context.TODO(), listOptions)
+	nodes, err := c.nodeLister.List(selector)
 	if err != nil {
 		return nil, err
 	}
 
 	var addresses []string
-	for _, node := range nodes.Items {
+	for _, node := range nodes {
 		for _, address := range node.Status.Addresses {
 			switch addressType := address.Type; addressType {
 			case v1.NodeExternalIP:
@@ -540,6 +648,7 @@ func (c *Controller) getNodesIPs() ([]string, error) {
 func (c *Controller) eventDeleteFunc(obj interface{}) error {
 	var nodesIPs []string
 	var ports []int32
+	var failed consul.Failures
 	var err error
 
 	switch serviceType := obj.(*v1.Service).Spec.Type; serviceType {
@@ -569,7 +678,7 @@ func (c *Controller) eventDeleteFunc(obj interface{}) error {
 					continue
 				}
 				// Check if service's already added
-				if _, ok := allAddedServices[service.ID]; !ok {
+				if _, ok := allAddedServices.Load(service.ID); !ok {
 					glog.V(3).Infof("Service %s has already been deleted in Consul", service.ID)
 					continue
 				}
@@ -577,15 +686,21 @@ func (c *Controller) eventDeleteFunc(obj interface{}) error {
 				err = consulAgent.Deregister(service)
 				if err != nil {
 					glog.Errorf("Cannot deregister service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+					c.recorder.ConsulFailed(obj.(*v1.Service), "deregister", service.ID, consulAgent.Address(), err)
+					failed.Add(err)
 				} else {
 					glog.Infof("Service %s has been deregistered in Consul with ID: %s", obj.(*v1.Service).ObjectMeta.Name, service.ID)
-					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-					delete(allAddedServices, service.ID)
+					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+					c.recorder.Deregistered(obj.(*v1.Service), service.ID, consulAgent.Address())
+					allAddedServices.Delete(service.ID)
 				}
 			}
 		}
 	}
+	if failed.Count > 0 {
+		return failed.Err("Cannot deregister %d service(s) of %s in Consul", failed.Count, obj.(*v1.Service).ObjectMeta.Name)
+	}
 	return nil
 }
 
@@ -593,65 +708,30 @@ func (c *Controller) createConsulService(svc *v1.Service, address string, port i
 	service := &consulapi.AgentServiceRegistration{}
 
 	service.ID = fmt.Sprintf("%s-%s-%s-%d", svc.ObjectMeta.Name, svc.ObjectMeta.UID, address, port)
-	service.Name = svc.ObjectMeta.Name
-	if serviceName, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceNameAnnotation]; ok {
+	service.Name = c.cfg.Controller.ServiceName(config.NewServiceNameData(svc.ObjectMeta.Name, svc.ObjectMeta))
+	if serviceName, ok := annotations.Name(svc.ObjectMeta.Annotations); ok {
 		service.Name = serviceName
 	}
 
 	//Add K8sTag from configuration
 	service.Tags = []string{c.cfg.Controller.K8sTag}
-	service.Tags = append(service.Tags, fmt.Sprintf("uid:%s", svc.ObjectMeta.UID))
-
-	// if set consul.register/service.tags: "tag1,tag2,tag3", then set tags as ["tag1","tag2","tag3"]
-	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceTags]; ok {
-		tags := strings.Split(value, ",")
-		for _, tag := range tags {
-			service.Tags = append(service.Tags, strings.TrimSpace(tag))
-		}
+	service.Tags = append(service.Tags, annotations.Tags(svc.ObjectMeta.Annotations)...)
+	labelTags, labelMeta := c.cfg.Controller.ConvertLabels(svc.ObjectMeta.Labels)
+	service.Tags = utils.UniqueSorted(append(service.Tags, labelTags...))
+	service.Meta = labelMeta
+	for key, value := range annotations.Meta(svc.ObjectMeta.Annotations) {
+		service.Meta[key] = value
 	}
-	service.Tags = append(service.Tags, labelsToTags(svc.ObjectMeta.Labels)...)
+	utils.SetOwnerMeta(service.Meta, c.cfg.Controller.ClusterID, config.RegisterSourceService, svc.ObjectMeta.Namespace, string(svc.ObjectMeta.UID))
 
 	service.Port = int(port)
 	service.Address = address
 
 	// generate health check for consul
-	check := &consulapi.AgentServiceCheck{}
-	// !!todo default value from configmap
-	check.Interval = "10s"
-	check.Timeout = "90s"
-	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceHealthIntervalAnnotation]; ok {
-		check.Interval = fmt.Sprintf("%ss", value)
-	}
-	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceHealthTimeoutAnnotation]; ok {
-		check.Timeout = fmt.Sprintf("%ss", value)
-	}
-
-	healthHost := address
-	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceHealthHostAnnotation]; ok {
-		healthHost = value
-	}
-
-	healthPort := port
-	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceHealthPortAnnotation]; ok {
-		annotationPort, err := strconv.ParseInt(value, 10, 32)
-		if err != nil {
-			glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterServiceHealthPortAnnotation, err)
-			return nil, err
-		} else {
-			healthPort = int32(annotationPort)
-		}
-	}
-
-	healthPath := "/"
-	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceHealthCheckPathAnnotation]; ok {
-		healthPath = value
-		check.HTTP = fmt.Sprintf("%s://%s:%d%s", "http", healthHost, healthPort, healthPath)
-	} else if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceHealthTTLAnnotation]; ok {
-		check.TTL = value
-	} else if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceHealthTCPAnnotation]; ok && value != "" {
-		check.TCP = fmt.Sprintf("%s:%d", healthHost, healthPort)
-	} else {
-		check.HTTP = fmt.Sprintf("%s://%s:%d%s", "http", healthHost, healthPort, healthPath)
+	check, err := annotations.HealthCheck(svc.ObjectMeta.Annotations, address, port)
+	if err != nil {
+		glog.Errorf("Can't create health check of service %s: %s", svc.ObjectMeta.Name, err)
+		return nil, err
 	}
 
 	glog.Infof("%s tags %#v Consul check: %#v", service.Name, service.Tags, check)
@@ -660,21 +740,6 @@ func (c *Controller) createConsulService(svc *v1.Service, address string, port i
 	return service, nil
 }
 
-func labelsToTags(labels map[string]string) []string {
-	var tags []string
-
-	for key, value := range labels {
-		// if value is equal to "tag" then set only key as tag
-		if value == "tag" {
-			tags = append(tags, key)
-		} else {
-			tags = append(tags, fmt.Sprintf("%s:%s", key, value))
-		}
-	}
-	return tags
-
-}
-
 func isRegisterEnabled(obj interface{}) bool {
 	if value, ok := obj.(*v1.Service).ObjectMeta.Annotations[ConsulRegisterEnabledAnnotation]; ok {
 		enabled, err := strconv.ParseBool(value)
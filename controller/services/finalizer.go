@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/warjiang/kube-consul-register/consul"
+	"github.com/warjiang/kube-consul-register/controller/finalizer"
+	"github.com/warjiang/kube-consul-register/metrics"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// patchService applies the merge patch to Service
+func (c *Controller) patchService(namespace string, name string, data []byte) error {
+	_, err := c.clientset.CoreV1().Services(namespace).Patch(context.TODO(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+// updateFinalizer puts the cleanup finalizer on registered Service if `cleanup_finalizer` option is enabled.
+// The finalizer is removed from Service whose registration has been turned off.
+func (c *Controller) updateFinalizer(svc *v1.Service) error {
+	if c.cfg.Controller.CleanupFinalizer && isRegisterEnabled(svc) {
+		if !isRegistered(svc) {
+			return nil
+		}
+		return finalizer.Add(svc, c.patchService)
+	}
+	return finalizer.Remove(svc, c.patchService)
+}
+
+// releaseService deregisters services of deleted Service which are left in Consul and removes the cleanup finalizer.
+// If services can't be deregistered until `cleanup_finalizer_timeout` the finalizer is removed anyway.
+func (c *Controller) releaseService(svc *v1.Service) error {
+	if !finalizer.Has(svc) {
+		return nil
+	}
+
+	if err := c.deregisterService(svc); err != nil {
+		if !finalizer.Expired(svc, c.cfg.Controller.CleanupFinalizerTimeout) {
+			return err
+		}
+		glog.Warningf("Services of Service %s/%s can't be deregistered in %s, removing finalizer %s: %s",
+			svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, c.cfg.Controller.CleanupFinalizerTimeout, finalizer.Name, err)
+	}
+	return finalizer.Remove(svc, c.patchService)
+}
+
+// deregisterService deregisters every service of Service which is registered in Consul
+func (c *Controller) deregisterService(svc *v1.Service) error {
+	var err error
+	uid := string(svc.ObjectMeta.UID)
+
+	agents, err := c.cacheConsulAgent()
+	if err != nil {
+		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
+	}
+	// Services of agent which can't be listed would be left in Consul
+	listedAgents := consul.ListAgents(agents)
+	if err := consul.ListErr(listedAgents); err != nil {
+		return err
+	}
+	addedConsulServices, registeredConsulServices, _, err := c.getAddedConsulServices(listedAgents)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, serviceID := range registeredConsulServices[uid] {
+		consulAgent := agents[addedConsulServices[serviceID]]
+		if err := consulAgent.Deregister(&consulapi.AgentServiceRegistration{ID: serviceID}); err != nil {
+			glog.Errorf("Cannot deregister service in Consul: %s", err)
+			metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Address()).Inc()
+			c.recorder.ConsulFailed(svc, "deregister", serviceID, consulAgent.Address(), err)
+			failed++
+			continue
+		}
+		glog.Infof("Service has been deregistered in Consul with ID: %s", serviceID)
+		metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Address()).Inc()
+		c.recorder.Deregistered(svc, serviceID, consulAgent.Address())
+		allAddedServices.Delete(serviceID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("Cannot deregister %d service(s) of Service with UID %s in Consul", failed, uid)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package election
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Consul is an Elector which uses lock on Consul session. It can be used
+// when RBAC for Kubernetes Leases is unavailable.
+type Consul struct {
+	client        *consulapi.Client
+	key           string
+	identity      string
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+}
+
+// NewConsul returns the Consul elector
+func NewConsul(client *consulapi.Client, key string, identity string,
+	leaseDuration time.Duration, retryPeriod time.Duration) *Consul {
+	return &Consul{
+		client:        client,
+		key:           key,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		retryPeriod:   retryPeriod,
+	}
+}
+
+// Run runs leader election until ctx is done
+func (c *Consul) Run(ctx context.Context, onStartedLeading func(ctx context.Context), onStoppedLeading func()) {
+	// Consul doesn't accept session TTL shorter than 10s
+	ttl := c.leaseDuration
+	if ttl < 10*time.Second {
+		ttl = 10 * time.Second
+	}
+
+	for {
+		lock, err := c.client.LockOpts(&consulapi.LockOptions{
+			Key:         c.key,
+			Value:       []byte(c.identity),
+			SessionName: c.identity,
+			SessionTTL:  ttl.String(),
+		})
+		if err != nil {
+			glog.Errorf("Can't create Consul lock %s: %s", c.key, err)
+		} else {
+			c.lead(ctx, lock, onStartedLeading, onStoppedLeading)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.retryPeriod):
+		}
+	}
+}
+
+// lead acquires the lock and keeps leadership until the lock is lost or ctx is done
+func (c *Consul) lead(ctx context.Context, lock *consulapi.Lock, onStartedLeading func(ctx context.Context), onStoppedLeading func()) {
+	lostCh, err := lock.Lock(ctx.Done())
+	if err != nil {
+		glog.Errorf("Can't acquire Consul lock %s: %s", c.key, err)
+		return
+	}
+	if lostCh == nil {
+		// ctx is done
+		return
+	}
+	glog.Infof("Acquired Consul lock %s as %s", c.key, c.identity)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	go onStartedLeading(leaderCtx)
+
+	select {
+	case <-lostCh:
+		glog.Warningf("Consul lock %s has been lost", c.key)
+	case <-ctx.Done():
+	}
+	cancel()
+
+	if err := lock.Unlock(); err != nil && err != consulapi.ErrLockNotHeld {
+		glog.Errorf("Can't release Consul lock %s: %s", c.key, err)
+	}
+	onStoppedLeading()
+}
@@ -0,0 +1,229 @@
+package election
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsul implements sessions and KV endpoints of Consul which are used by the lock
+type fakeConsul struct {
+	mutex     sync.Mutex
+	index     uint64
+	changed   chan struct{}
+	pair      *consulapi.KVPair
+	sessions  map[string]bool
+	destroyed map[string]bool
+	nextID    int
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:     1,
+		changed:   make(chan struct{}),
+		sessions:  make(map[string]bool),
+		destroyed: make(map[string]bool),
+	}
+}
+
+// notify wakes up blocking queries, it's called with the mutex held
+func (f *fakeConsul) notify() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// invalidate drops the session of the lock holder as Consul does when the session expires
+func (f *fakeConsul) invalidate() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.pair != nil && f.pair.Session != "" {
+		delete(f.sessions, f.pair.Session)
+		f.pair.Session = ""
+		f.notify()
+	}
+}
+
+func (f *fakeConsul) holder() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.pair == nil {
+		return ""
+	}
+	return f.pair.Session
+}
+
+func (f *fakeConsul) isDestroyed(session string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.destroyed[session]
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/session/"):
+		f.serveSession(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.serveKV(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeConsul) serveSession(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/session/")
+	switch {
+	case path == "create":
+		f.nextID++
+		id := fmt.Sprintf("session-%d", f.nextID)
+		f.sessions[id] = true
+		_ = json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(path, "renew/"):
+		id := strings.TrimPrefix(path, "renew/")
+		if !f.sessions[id] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]map[string]string{{"ID": id, "TTL": "10s"}})
+	case strings.HasPrefix(path, "destroy/"):
+		id := strings.TrimPrefix(path, "destroy/")
+		delete(f.sessions, id)
+		f.destroyed[id] = true
+		if f.pair != nil && f.pair.Session == id {
+			f.pair.Session = ""
+			f.notify()
+		}
+		_, _ = w.Write([]byte("true"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+
+	if r.Method == http.MethodGet {
+		f.mutex.Lock()
+		// Blocking query waits for change of the index
+		if index, err := strconv.ParseUint(query.Get("index"), 10, 64); err == nil && index >= f.index {
+			changed := f.changed
+			f.mutex.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+			f.mutex.Lock()
+		}
+		defer f.mutex.Unlock()
+
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		if f.pair == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*consulapi.KVPair{f.pair})
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch {
+	case query.Has("acquire"):
+		session := query.Get("acquire")
+		if !f.sessions[session] || (f.pair != nil && f.pair.Session != "" && f.pair.Session != session) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		f.pair = &consulapi.KVPair{Key: key, Value: body, Flags: flags, Session: session}
+		f.notify()
+		_, _ = w.Write([]byte("true"))
+	case query.Has("release"):
+		if f.pair == nil || f.pair.Session != query.Get("release") {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		f.pair.Session = ""
+		f.notify()
+		_, _ = w.Write([]byte("true"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestConsul(t *testing.T) {
+	t.Parallel()
+
+	server := newFakeConsul()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	cfg := consulapi.DefaultConfig()
+	cfg.Address = strings.TrimPrefix(httpServer.URL, "http://")
+	client, err := consulapi.NewClient(cfg)
+	assert.Nil(t, err)
+
+	elector := NewConsul(client, "kube-consul-register/default/kube-consul-register/leader", "replica-1",
+		10*time.Second, 100*time.Millisecond)
+
+	started := make(chan struct{}, 2)
+	stopped := make(chan struct{}, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		elector.Run(ctx, func(ctx context.Context) {
+			started <- struct{}{}
+		}, func() {
+			stopped <- struct{}{}
+		})
+	}()
+
+	wait := func(ch chan struct{}, message string) {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal(message)
+		}
+	}
+
+	// Lock is acquired
+	wait(started, "replica hasn't become the leader")
+	session := server.holder()
+	assert.NotEmpty(t, session)
+
+	// Leadership is lost when the session is invalidated and the lock is acquired again
+	server.invalidate()
+	wait(stopped, "loss of the lock hasn't been noticed")
+	wait(started, "replica hasn't become the leader again")
+	session = server.holder()
+	assert.NotEmpty(t, session)
+
+	// Lock is released and the session is destroyed when ctx is done
+	cancel()
+	wait(stopped, "leadership hasn't been released")
+	wait(done, "elector hasn't stopped")
+	assert.Empty(t, server.holder())
+	assert.Eventually(t, func() bool {
+		return server.isDestroyed(session)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,13 @@
+package election
+
+import (
+	"context"
+)
+
+// Elector has a method to run leader election. Only one replica of controller
+// can be the leader at the same time.
+type Elector interface {
+	// Run blocks until ctx is done. onStartedLeading is called when replica becomes
+	// the leader, onStoppedLeading when the leadership is lost.
+	Run(ctx context.Context, onStartedLeading func(ctx context.Context), onStoppedLeading func())
+}
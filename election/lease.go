@@ -0,0 +1,63 @@
+package election
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Lease is an Elector which uses Kubernetes Lease as lock
+type Lease struct {
+	clientset     kubernetes.Interface
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// NewLease returns the Lease elector
+func NewLease(clientset kubernetes.Interface, namespace string, name string, identity string,
+	leaseDuration time.Duration, renewDeadline time.Duration, retryPeriod time.Duration) *Lease {
+	return &Lease{
+		clientset:     clientset,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: renewDeadline,
+		retryPeriod:   retryPeriod,
+	}
+}
+
+// Run runs leader election until ctx is done
+func (l *Lease) Run(ctx context.Context, onStartedLeading func(ctx context.Context), onStoppedLeading func()) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: l.namespace,
+			Name:      l.name,
+		},
+		Client: l.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: l.identity,
+		},
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   l.leaseDuration,
+		RenewDeadline:   l.renewDeadline,
+		RetryPeriod:     l.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: onStartedLeading,
+			OnStoppedLeading: onStoppedLeading,
+		},
+	})
+}
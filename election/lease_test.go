@@ -0,0 +1,46 @@
+package election
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLease(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewSimpleClientset()
+	elector := NewLease(clientset, "default", "kube-consul-register", "replica-1",
+		2*time.Second, time.Second, 100*time.Millisecond)
+
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go elector.Run(ctx, func(ctx context.Context) {
+		close(started)
+	}, func() {
+		close(stopped)
+	})
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica hasn't become the leader")
+	}
+
+	lease, err := clientset.CoordinationV1().Leases("default").Get(context.TODO(), "kube-consul-register", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "replica-1", *lease.Spec.HolderIdentity)
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leadership hasn't been released")
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,20 +18,28 @@ import (
 	"github.com/warjiang/kube-consul-register/config"
 	"github.com/warjiang/kube-consul-register/consul"
 	"github.com/warjiang/kube-consul-register/controller"
+	"github.com/warjiang/kube-consul-register/controller/informers"
+	"github.com/warjiang/kube-consul-register/election"
 	"github.com/warjiang/kube-consul-register/metrics"
 	"github.com/warjiang/kube-consul-register/utils"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// shutdownTimeout is how long the process waits on SIGTERM until the lock of leader election is released
+const shutdownTimeout = 10 * time.Second
+
 var (
 	// VERSION is filled out during the build process (using git describe output)
 	VERSION string
 
-	cfg   *config.Config
-	mutex = &sync.Mutex{}
+	cfg *config.Config
+
+	// ready is set when controllers are running, i.e. replica is the leader
+	ready atomic.Bool
 
 	watchNamespace       = flag.String("watch-namespace", v1.NamespaceAll, "namespace to watch for Pods. Default is to watch all namespaces")
 	kubeconfig           = flag.String("kubeconfig", "./kubeconfig", "absolute path to the kubeconfig file")
@@ -42,6 +50,13 @@ var (
 	cleanInterval        = flag.Duration("clean-interval", 1800*time.Second, "time in seconds, what period of time will be done cleaning of inactive services")
 	metricsListenAddress = flag.String("metrics-listen-address", ":8080", "the address to listen on for HTTP requests.")
 	versionFlag          = flag.Bool("version", false, "print version end exit")
+
+	leaderElect              = flag.Bool("leader-elect", false, "use leader election, only the leader runs controllers. Enable it when controller is running with multiple replicas")
+	leaderElectBackend       = flag.String("leader-elect-backend", "kubernetes", "lock backend of leader election: kubernetes (Lease) or consul (session lock)")
+	leaderElectLock          = flag.String("leader-elect-lock", "default/kube-consul-register", "name of the Lease used as lock, e.g. default/kube-consul-register. In case of consul backend it's a part of the lock key")
+	leaderElectLeaseDuration = flag.Duration("leader-elect-lease-duration", 15*time.Second, "time in seconds, how long followers wait before they try to acquire leadership")
+	leaderElectRenewDeadline = flag.Duration("leader-elect-renew-deadline", 10*time.Second, "time in seconds, how long the leader tries to renew leadership before it gives up")
+	leaderElectRetryPeriod   = flag.Duration("leader-elect-retry-period", 2*time.Second, "time in seconds, how long clients wait between tries of actions")
 )
 
 func init() {
@@ -50,7 +65,13 @@ func init() {
 	prometheus.MustRegister(metrics.ConsulSuccess)
 	prometheus.MustRegister(metrics.PodFailure)
 	prometheus.MustRegister(metrics.PodSuccess)
+	prometheus.MustRegister(metrics.SourceFailure)
+	prometheus.MustRegister(metrics.SourceSuccess)
 	prometheus.MustRegister(metrics.FuncDuration)
+	prometheus.MustRegister(metrics.DriftDetected)
+	prometheus.MustRegister(metrics.QueueDropped)
+	prometheus.MustRegister(metrics.RetryQueueDepth)
+	prometheus.MustRegister(metrics.RetryAttempts)
 }
 
 func main() {
@@ -111,17 +132,100 @@ func main() {
 			cfg.Controller.ConsulToken = string(value)
 		}
 	}
-	//Consul instance
-	consulInstance := consul.Adapter{}
+	// Services of clusters which share Consul are told apart only by the cluster ID
+	if cfg.Controller.ClusterID == "" {
+		cfg.Controller.ClusterID = defaultClusterID(clientset)
+	}
+
+	// TTL of checks refreshed by synchronization is derived from the interval
+	cfg.Controller.SyncInterval = *syncInterval
+
+	//Consul instance, failed operations are retried
+	var retryStore consul.RetryStore
+	if cfg.Controller.RetryConfigMap != "" {
+		namespace, name, err := utils.ParseNsName(cfg.Controller.RetryConfigMap)
+		if err != nil {
+			glog.Fatalf("Retry ConfigMap: %v", err)
+		}
+		retryStore = consul.NewConfigMapStore(clientset, namespace, name)
+	}
 
-	//Controller instance
+	//Controller instance, informers are shared by controllers
+	informerFactory := informers.NewFactory(clientset, *watchNamespace)
+
+	// Synthetic nodes in `catalog` mode get InternalIP of Kubernetes node
+	adapter := consul.NewAdapter()
+	if cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		adapter.NodeAddress = informers.NodeInternalIP(informers.Nodes(informerFactory).Lister())
+	}
+	consulInstance := consul.NewRetry(adapter, cfg, retryStore)
 	ctrInstance := controller.Factory{}
-	ctr := ctrInstance.New(clientset, consulInstance, cfg, *watchNamespace)
+	ctr := ctrInstance.New(clientset, informerFactory, consulInstance, cfg, *watchNamespace)
+
+	// Root context is cancelled on SIGTERM, so the leader releases its lock before exit
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	if *leaderElect {
+		elector := newElector(clientset)
+		go func() {
+			defer close(done)
+			elector.Run(ctx, func(ctx context.Context) {
+				glog.Info("Started leading, running controllers")
+				run(ctx, informerFactory, ctr, consulInstance)
+			}, func() {
+				ready.Store(false)
+				if ctx.Err() != nil {
+					glog.Info("Leadership has been released")
+					return
+				}
+				// Controllers can't be stopped, so restart is the only safe way to become follower
+				glog.Fatalf("Leadership has been lost, exiting")
+			})
+		}()
+	} else {
+		close(done)
+		go run(ctx, informerFactory, ctr, consulInstance)
+	}
+
+	go handleSigterm(cancel, done)
+
+	// Metrics
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	// Followers are not ready
+	http.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not leader"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	glog.Fatal(http.ListenAndServe(*metricsListenAddress, nil))
+}
+
+// run starts retries of failed operations, informers, controllers, cleaning and syncing.
+// Nothing is reconciled until caches of informers are synced.
+func run(ctx context.Context, informerFactory kubeinformers.SharedInformerFactory, ctr controller.FactoryAdapter, consulInstance *consul.Retry) {
+	go consulInstance.Run(ctx.Done())
+
+	informerFactory.Start(ctx.Done())
+	glog.Info("Waiting for caches to sync...")
+	for informerType, synced := range informerFactory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			glog.Fatalf("Unable to sync cache of %s", informerType)
+		}
+	}
+	glog.Info("Caches have been synced")
+	ready.Store(true)
 
 	//Cleaning
 	go func() {
 		for {
-			mutex.Lock()
 			glog.Info("Start cleaning...")
 			err := ctr.Clean()
 			if err != nil {
@@ -129,7 +233,6 @@ func main() {
 			} else {
 				glog.Info("Cleaning has been ended")
 			}
-			mutex.Unlock()
 			time.Sleep(*cleanInterval)
 		}
 	}()
@@ -137,7 +240,6 @@ func main() {
 	//Syncing
 	go func() {
 		for {
-			mutex.Lock()
 			glog.Info("Start syncing...")
 			err := ctr.Sync()
 			if err != nil {
@@ -145,7 +247,6 @@ func main() {
 			} else {
 				glog.Info("Synchronization's been ended")
 			}
-			mutex.Unlock()
 			time.Sleep(*syncInterval)
 		}
 	}()
@@ -153,26 +254,71 @@ func main() {
 	go func() {
 		ctr.Watch()
 	}()
+}
 
-	go handleSigterm()
+// newElector returns the Elector with the backend given in `leader-elect-backend` flag
+func newElector(clientset kubernetes.Interface) election.Elector {
+	namespace, name, err := utils.ParseNsName(*leaderElectLock)
+	if err != nil {
+		glog.Fatalf("Leader election lock: %v", err)
+	}
 
-	// Metrics
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	}))
-	glog.Fatal(http.ListenAndServe(*metricsListenAddress, nil))
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Can't get hostname: %s", err)
+	}
+
+	switch *leaderElectBackend {
+	case "kubernetes":
+		return election.NewLease(clientset, namespace, name, identity,
+			*leaderElectLeaseDuration, *leaderElectRenewDeadline, *leaderElectRetryPeriod)
+	case "consul":
+		client, err := consul.NewClient(cfg)
+		if err != nil {
+			glog.Fatalf("Can't create Consul client: %s", err)
+		}
+		key := fmt.Sprintf("kube-consul-register/%s/%s/leader", namespace, name)
+		return election.NewConsul(client, key, identity, *leaderElectLeaseDuration, *leaderElectRetryPeriod)
+	default:
+		glog.Fatalf("Wrong value of 'leader-elect-backend' flag. Permitted values: kubernetes|consul, is %s", *leaderElectBackend)
+	}
+	return nil
 }
 
-func handleSigterm() {
+// defaultClusterID returns UID of `kube-system` namespace, which is unique for every cluster.
+// Services registered by older versions without the cluster ID are not cleaned anymore, so it's logged loudly.
+func defaultClusterID(clientset kubernetes.Interface) string {
+	namespace, err := clientset.CoreV1().Namespaces().Get(context.TODO(), metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		glog.Fatalf("Option 'cluster_id' is empty and UID of %s namespace can't be used instead: %s", metav1.NamespaceSystem, err)
+	}
+	clusterID := string(namespace.ObjectMeta.UID)
+	glog.Warningf("**********************************************************************************")
+	glog.Warningf("Option 'cluster_id' is empty, UID of %s namespace is used instead: %s", metav1.NamespaceSystem, clusterID)
+	glog.Warningf("Services registered without 'k8s-cluster' meta aren't cleaned by this controller.")
+	glog.Warningf("Set 'cluster_id' option explicitly, it has to be unique for every cluster sharing Consul.")
+	glog.Warningf("**********************************************************************************")
+	return clusterID
+}
+
+// handleSigterm cancels the root context on SIGTERM and waits until leader election
+// has released the lock, but no longer than shutdownTimeout
+func handleSigterm(cancel context.CancelFunc, done <-chan struct{}) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGTERM)
 	<-signalChan
 	glog.Infof("Received SIGTERM, shutting down")
 
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		glog.Warningf("Leader election hasn't stopped in %s", shutdownTimeout)
+	}
+
 	exitCode := 0
 
 	glog.Infof("Exiting with %v", exitCode)
+	glog.Flush()
 	os.Exit(exitCode)
 }
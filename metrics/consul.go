@@ -21,3 +21,23 @@ var (
 		[]string{"operation", "consul_address"},
 	)
 )
+
+var (
+	// RetryQueueDepth returns gauge for consul_retry_queue_depth metric
+	RetryQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "consul_retry_queue_depth",
+			Help: "Number of failed Consul operations waiting for retry.",
+		},
+		[]string{"consul_address"},
+	)
+
+	// RetryAttempts returns counter for consul_retry_attempts_total metric
+	RetryAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "consul_retry_attempts_total",
+			Help: "Number of retries of failed Consul operations.",
+		},
+		[]string{"operation", "result", "consul_address"},
+	)
+)
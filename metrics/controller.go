@@ -21,6 +21,42 @@ var (
 		[]string{"operation"},
 	)
 
+	// SourceFailure returns counter for source_errors_total metric of sources other than PODs
+	SourceFailure = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "source_errors_total",
+			Help: "Number of failure operation on objects of register source",
+		},
+		[]string{"source", "operation"},
+	)
+
+	// SourceSuccess returns counter for source_successes_total metric of sources other than PODs
+	SourceSuccess = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "source_successes_total",
+			Help: "Number of succeed operation on objects of register source",
+		},
+		[]string{"source", "operation"},
+	)
+
+	// DriftDetected returns counter for drift_detected_total metric
+	DriftDetected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "drift_detected_total",
+			Help: "Number of registered services whose field differs from the desired registration",
+		},
+		[]string{"field"},
+	)
+
+	// QueueDropped returns counter for queue_dropped_total metric
+	QueueDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_dropped_total",
+			Help: "Number of keys dropped out of the queue after too many failed reconciliations",
+		},
+		[]string{"queue"},
+	)
+
 	// FuncDuration returns summary for controller_function_duration_seconds metric
 	FuncDuration = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
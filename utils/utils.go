@@ -2,9 +2,24 @@ package utils
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
+// These are keys of Consul service meta which identify the owner of service.
+// "K8sClusterMeta" keeps `cluster_id` of cluster that registered the service.
+// "K8sSourceMeta" keeps `register_source` that registered the service.
+// "K8sNamespaceMeta" and "K8sUIDMeta" keep namespace and UID of K8S object of the service.
+// "K8sOwnerKindMeta" and "K8sOwnerNameMeta" keep the top-level controller of POD, e.g. Deployment.
+const (
+	K8sClusterMeta   = "k8s-cluster"
+	K8sSourceMeta    = "k8s-source"
+	K8sNamespaceMeta = "k8s-namespace"
+	K8sUIDMeta       = "k8s-uid"
+	K8sOwnerKindMeta = "k8s-owner-kind"
+	K8sOwnerNameMeta = "k8s-owner-name"
+)
+
 // ParseNsName parses input and returns namespace name and ConfigMap name.
 func ParseNsName(input string) (string, string, error) {
 	nsName := strings.Split(input, "/")
@@ -26,6 +41,48 @@ func CheckK8sTag(tags []string, k8sTag string) bool {
 	return false
 }
 
+// CheckK8sSource checks whether Consul service has been registered by the given source.
+// Service without source in meta has been registered by older version, it's owned by
+// the source only if this is the only one source which is given in `register_source` option.
+func CheckK8sSource(meta map[string]string, source string, sources []string) bool {
+	if value, ok := meta[K8sSourceMeta]; ok {
+		return value == source
+	}
+	return len(sources) == 1 && sources[0] == source
+}
+
+// CheckK8sCluster checks whether Consul service has been registered by the cluster which is
+// given in `cluster_id` option. Service without cluster in meta has been registered by older version,
+// it's owned if the option is empty or such services are adopted by `adopt_legacy` option.
+func CheckK8sCluster(meta map[string]string, clusterID string, adoptLegacy bool) bool {
+	if value, ok := meta[K8sClusterMeta]; ok {
+		return value == clusterID
+	}
+	return clusterID == "" || adoptLegacy
+}
+
+// SetOwnerMeta sets meta of Consul service which identifies the cluster, source and K8S object
+// of the service. Empty cluster and UID are not set.
+func SetOwnerMeta(meta map[string]string, clusterID string, source string, namespace string, uid string) {
+	if clusterID != "" {
+		meta[K8sClusterMeta] = clusterID
+	}
+	meta[K8sSourceMeta] = source
+	meta[K8sNamespaceMeta] = namespace
+	if uid != "" {
+		meta[K8sUIDMeta] = uid
+	}
+}
+
+// GetConsulServiceUID gets UID of K8S object of Consul service.
+// Services registered by older versions keep UID in `uid` tag.
+func GetConsulServiceUID(meta map[string]string, tags []string) string {
+	if value, ok := meta[K8sUIDMeta]; ok {
+		return value
+	}
+	return GetConsulServiceTag(tags, "uid")
+}
+
 // GetConsulServiceTag gets tag for Consul service
 func GetConsulServiceTag(tags []string, searchKey string) string {
 	for _, tag := range tags {
@@ -57,3 +114,20 @@ func HasLabel(labels map[string]string, searchLabel string) bool {
 	}
 	return false
 }
+
+// UniqueSorted returns sorted tags without duplicates
+func UniqueSorted(tags []string) []string {
+	if len(tags) == 0 {
+		return tags
+	}
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+
+	unique := sorted[:1]
+	for _, tag := range sorted[1:] {
+		if tag != unique[len(unique)-1] {
+			unique = append(unique, tag)
+		}
+	}
+	return unique
+}
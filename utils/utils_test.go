@@ -35,6 +35,46 @@ func TestCheckK8sTag(t *testing.T) {
 	assert.True(t, CheckK8sTag(tags, "kubernetes"), "CheckK8sTag should be true")
 }
 
+func TestCheckK8sSource(t *testing.T) {
+	t.Parallel()
+
+	meta := map[string]string{"k8s-source": "pod"}
+	assert.True(t, CheckK8sSource(meta, "pod", []string{"pod", "service"}), "CheckK8sSource should be true")
+	assert.False(t, CheckK8sSource(meta, "service", []string{"pod", "service"}), "CheckK8sSource should be false")
+
+	// Services without source in meta are owned by the only one source
+	assert.True(t, CheckK8sSource(nil, "pod", []string{"pod"}), "CheckK8sSource should be true")
+	assert.False(t, CheckK8sSource(nil, "service", []string{"pod"}), "CheckK8sSource should be false")
+	assert.False(t, CheckK8sSource(nil, "pod", []string{"pod", "service"}), "CheckK8sSource should be false")
+}
+
+func TestCheckK8sCluster(t *testing.T) {
+	t.Parallel()
+
+	meta := map[string]string{"k8s-cluster": "cluster1"}
+	assert.True(t, CheckK8sCluster(meta, "cluster1", false), "CheckK8sCluster should be true")
+	assert.False(t, CheckK8sCluster(meta, "cluster2", false), "CheckK8sCluster should be false")
+	assert.False(t, CheckK8sCluster(meta, "", false), "CheckK8sCluster should be false")
+	assert.False(t, CheckK8sCluster(meta, "cluster2", true), "CheckK8sCluster should be false")
+
+	// Services without cluster in meta are owned if cluster is not given or they are adopted
+	assert.True(t, CheckK8sCluster(nil, "", false), "CheckK8sCluster should be true")
+	assert.False(t, CheckK8sCluster(nil, "cluster1", false), "CheckK8sCluster should be false")
+	assert.True(t, CheckK8sCluster(nil, "cluster1", true), "CheckK8sCluster should be true")
+}
+
+func TestGetConsulServiceUID(t *testing.T) {
+	t.Parallel()
+
+	meta := make(map[string]string)
+	SetOwnerMeta(meta, "", "pod", "default", "12345")
+	assert.Equal(t, map[string]string{"k8s-source": "pod", "k8s-namespace": "default", "k8s-uid": "12345"}, meta)
+	assert.Equal(t, "12345", GetConsulServiceUID(meta, nil), "GetConsulServiceUID should be 12345")
+
+	// Services registered by older versions keep UID in tag
+	assert.Equal(t, "67890", GetConsulServiceUID(nil, []string{"kubernetes", "uid:67890"}), "GetConsulServiceUID should be 67890")
+}
+
 func TestGetConsulServiceTag(t *testing.T) {
 	t.Parallel()
 
@@ -56,3 +96,10 @@ func TestHasLabel(t *testing.T) {
 	assert.True(t, HasLabel(labels, "pod=selector"), "HasLabel should be true")
 	assert.False(t, HasLabel(labels, ""), "HasLabel should be false")
 }
+
+func TestUniqueSorted(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"a", "b", "c"}, UniqueSorted([]string{"c", "a", "b", "a", "c"}))
+	assert.Nil(t, UniqueSorted(nil))
+}